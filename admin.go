@@ -0,0 +1,208 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// reapInfo describes when the session cleaner will remove a session
+type reapInfo struct {
+	SessionID  string     `json:"sessionID"`
+	LastActive time.Time  `json:"lastActive"`
+	Pinned     bool       `json:"pinned"`
+	ExpiresIn  *float64   `json:"expiresIn,omitempty"` // Seconds until the session counts as inactive
+	ReapAt     *time.Time `json:"reapAt,omitempty"`    // First cleaner pass that will remove the session
+	LifeEnd    *time.Time `json:"lifeEnd,omitempty"`   // Cleaner pass that removes the session for its age, with -max-lifetime
+}
+
+// requireAdmin wraps a handler so it is only reachable with the configured admin token
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if adminAuthorized(w, r) {
+			next(w, r)
+		}
+	}
+}
+
+// adminAuthorized checks that a request carries the admin token, replying with an error if not
+func adminAuthorized(w http.ResponseWriter, r *http.Request) bool {
+	if adminToken == "" {
+		writeJSONError(w, http.StatusForbidden, errAdminDisabled, "Admin API disabled")
+		return false
+	}
+	token := r.Header.Get("X-Admin-Token")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+		requestLogger(r.Context()).Warn("Rejected admin request", "path", r.URL.Path, "remote", r.RemoteAddr)
+		writeJSONError(w, http.StatusUnauthorized, errUnauthorized, "Unauthorized")
+		return false
+	}
+	return true
+}
+
+// sessionReapInfo computes the cleaner's view of a session. Must be called with sessionsMu held.
+func sessionReapInfo(session *Session) reapInfo {
+	info := reapInfo{
+		SessionID:  session.hash,
+		LastActive: session.lastActivity(),
+		Pinned:     session.pinned,
+	}
+	if session.pinned {
+		return info
+	}
+	if end, ok := sessionLifeEnd(session); ok {
+		info.LifeEnd = &end
+	}
+	if session.timeout == 0 {
+		return info
+	}
+
+	expiry := session.lastActivity().Add(session.timeout)
+	expiresIn := time.Until(expiry).Seconds()
+	if expiresIn < 0 {
+		expiresIn = 0
+	}
+	info.ExpiresIn = &expiresIn
+
+	if reapAt, ok := cleanerPassAfter(expiry); ok {
+		info.ReapAt = &reapAt
+	}
+	return info
+}
+
+// sessionLifeEnd returns when the cleaner removes the session for reaching maxLifetime, or the
+// moment it reaches it while the cleaner hasn't started. ok is false without a maximum lifetime.
+// Must be called with sessionsMu held.
+func sessionLifeEnd(session *Session) (end time.Time, ok bool) {
+	if maxLifetime == 0 || session.createdAt.IsZero() {
+		return time.Time{}, false
+	}
+	end = session.createdAt.Add(maxLifetime)
+	if pass, ok := cleanerPassAfter(end); ok {
+		end = pass
+	}
+	return end, true
+}
+
+// cleanerPassAfter returns the first session cleaner pass after t, which is when the cleaner acts
+// on a deadline since it only runs every cleanerInterval. ok is false before the cleaner has
+// started. Must be called with sessionsMu held.
+func cleanerPassAfter(t time.Time) (pass time.Time, ok bool) {
+	if cleanerNextRun.IsZero() {
+		return time.Time{}, false
+	}
+	pass = cleanerNextRun
+	for !pass.After(t) {
+		pass = pass.Add(cleanerInterval)
+	}
+	return pass, true
+}
+
+// sessionInfoHandler returns the reaping state of a single session
+func sessionInfoHandler(w http.ResponseWriter, r *http.Request) {
+	sessionID, ok := sessionIDParam(w, r)
+	if !ok {
+		return
+	}
+
+	sessionsMu.RLock()
+	session, exists := sessions[sessionID]
+	if !exists {
+		sessionsMu.RUnlock()
+		writeJSONError(w, http.StatusNotFound, errSessionNotFound, "Session not found")
+		return
+	}
+	info := sessionReapInfo(session)
+	sessionsMu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(info); err != nil {
+		requestLogger(r.Context()).Error("Error encoding JSON response", "err", err)
+	}
+}
+
+// adminSessionsHandler lists every session together with its computed time-to-reap
+func adminSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	sessionsMu.RLock()
+	infos := make([]reapInfo, 0, len(sessions))
+	for _, session := range sessions {
+		infos = append(infos, sessionReapInfo(session))
+	}
+	sessionsMu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(infos); err != nil {
+		requestLogger(r.Context()).Error("Error encoding JSON response", "err", err)
+	}
+}
+
+// adminPinHandler returns a handler that pins (or unpins) a session so the cleaner skips it
+func adminPinHandler(pin bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeJSONError(w, http.StatusMethodNotAllowed, errMethodNotAllowed, "Method not allowed")
+			return
+		}
+		sessionID, ok := sessionIDParam(w, r)
+		if !ok {
+			return
+		}
+
+		sessionsMu.Lock()
+		session, exists := sessions[sessionID]
+		if !exists {
+			sessionsMu.Unlock()
+			writeJSONError(w, http.StatusNotFound, errSessionNotFound, "Session not found")
+			return
+		}
+		session.pinned = pin
+		info := sessionReapInfo(session)
+		sessionsMu.Unlock()
+
+		requestLogger(r.Context()).Info("Session pinned by admin request", "session", sessionID, "pinned", pin, "remote", r.RemoteAddr)
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(info); err != nil {
+			requestLogger(r.Context()).Error("Error encoding JSON response", "err", err)
+		}
+	}
+}
+
+// adminKillHandler evicts a session right away, whether or not it is pinned or still in use.
+// Attached clients are closed when their consoles end.
+func adminKillHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, errMethodNotAllowed, "Method not allowed")
+		return
+	}
+	sessionID, ok := sessionIDParam(w, r)
+	if !ok {
+		return
+	}
+
+	sessionsMu.Lock()
+	session, exists := sessions[sessionID]
+	if !exists {
+		sessionsMu.Unlock()
+		writeJSONError(w, http.StatusNotFound, errSessionNotFound, "Session not found")
+		return
+	}
+	removeSession(session)
+	sessionsMu.Unlock()
+
+	requestLogger(r.Context()).Info("Session killed by admin request", "session", sessionID, "remote", r.RemoteAddr)
+	notifyClients(session, map[string]any{"type": "session_killed"})
+	cleanupSession(session)
+	sessionsClosed.WithLabelValues(closeReasonAdmin).Inc()
+	w.WriteHeader(http.StatusOK)
+}
+
+// adminMetricsHandler reports internal counters
+func adminMetricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]int64{
+		"ptyReaderRestarts": ptyReaderRestarts.Load(),
+	}); err != nil {
+		requestLogger(r.Context()).Error("Error encoding JSON response", "err", err)
+	}
+}
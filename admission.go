@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// memoryReserveMB is host memory in MB that new sessions must leave available, set with
+// -memory-reserve. 0 disables the check.
+var memoryReserveMB = 512
+
+// memoryPressureError is returned by createSession when the session's guest memory would leave
+// less than memoryReserveMB of the host's memory available
+type memoryPressureError struct {
+	availableMB int
+	requestedMB int
+}
+
+func (e *memoryPressureError) Error() string {
+	return fmt.Sprintf("not enough free host memory: %d MB available, the session needs %d MB and %d MB are kept in reserve",
+		e.availableMB, e.requestedMB, memoryReserveMB)
+}
+
+// checkHostMemory refuses sessions whose guests could push the host into the OOM killer. Guest
+// memory backed by hugepages comes from the preallocated pool, so only the reserve applies to it,
+// as it does in a dry run without VMs.
+// If /proc/meminfo can't be read the session is admitted, since the check is only a safeguard.
+func checkHostMemory(opts sessionOptions) error {
+	if memoryReserveMB <= 0 {
+		return nil
+	}
+	availableMB, err := availableMemoryMB()
+	if err != nil {
+		slog.Warn("Error reading available host memory, admitting session", "err", err)
+		return nil
+	}
+	requestedMB := opts.machineCount * opts.memMB
+	if opts.memBacking == "hugepages" || noVMs {
+		requestedMB = 0
+	}
+	if availableMB-requestedMB < memoryReserveMB {
+		return &memoryPressureError{availableMB: availableMB, requestedMB: requestedMB}
+	}
+	return nil
+}
+
+// availableMemoryMB returns the kernel's estimate of memory available for new allocations
+// without swapping, MemAvailable in /proc/meminfo
+func availableMemoryMB() (int, error) {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// MemAvailable:    8042716 kB
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 3 && fields[0] == "MemAvailable:" && fields[2] == "kB" {
+			kb, err := strconv.Atoi(fields[1])
+			if err != nil {
+				return 0, fmt.Errorf("invalid MemAvailable %q", fields[1])
+			}
+			return kb / 1024, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, fmt.Errorf("MemAvailable not found in /proc/meminfo")
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const maxAuditLine = 4096 // Input buffered without a line break is recorded once it reaches this many bytes
+
+// auditDir receives a <session>.audit.jsonl file of client input per session, set with -audit-dir.
+// Empty disables auditing.
+var auditDir string
+
+// auditLog appends the input clients send to a session's machines to the session's audit file,
+// one JSON record per line. It is shared by all connections of the session.
+type auditLog struct {
+	mu     sync.Mutex
+	file   *os.File
+	closed bool
+}
+
+// auditRecord is one line of an audit file. Input is recorded as sent to the PTY, after any input
+// map, and JSON escapes its control characters, so escape sequences and backspaces stay visible.
+type auditRecord struct {
+	Time    time.Time `json:"time"`
+	Machine string    `json:"machine"`
+	Channel string    `json:"channel"`
+	Source  string    `json:"source"` // "ws" for typed input, "exec" for /exec commands, "upload" for /upload
+	Remote  string    `json:"remote"`
+	Input   string    `json:"input"`
+	Partial bool      `json:"partial,omitempty"` // The line had no line break yet when it was recorded
+	Path    string    `json:"path,omitempty"`    // Destination of an upload
+	Bytes   int       `json:"bytes,omitempty"`   // Size of an upload; its contents aren't recorded
+}
+
+// openAuditLog creates the session's audit file if auditing is on. Appending keeps the records
+// of an earlier session that had the same ID.
+func openAuditLog(session *Session) error {
+	if auditDir == "" {
+		return nil
+	}
+	path := filepath.Join(auditDir, session.hash+".audit.jsonl")
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("error opening audit log: %v", err)
+	}
+	session.audit = &auditLog{file: file}
+	return nil
+}
+
+// write appends a record, unless the log is nil or already closed
+func (a *auditLog) write(record auditRecord) {
+	if a == nil {
+		return
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		slog.Error("Error encoding audit record", "err", err)
+		return
+	}
+	// JSON leaves DEL, which is what Backspace sends, unescaped; it only occurs inside strings
+	data = bytes.ReplaceAll(data, []byte{0x7f}, []byte(`\u007f`))
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		return
+	}
+	if _, err := a.file.Write(append(data, '\n')); err != nil {
+		slog.Error("Error writing audit log", "path", a.file.Name(), "err", err)
+	}
+}
+
+// close closes the audit file; later writes are dropped
+func (a *auditLog) close() {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		return
+	}
+	a.closed = true
+	if err := a.file.Close(); err != nil {
+		slog.Error("Error closing audit log", "path", a.file.Name(), "err", err)
+	}
+}
+
+// inputAuditor turns one connection's input, which arrives a few characters at a time, into
+// audit records of whole lines. A line ends at a carriage return, which is what Enter sends, or
+// a newline, or both.
+type inputAuditor struct {
+	audit   *auditLog
+	machine string
+	channel string
+	remote  string
+	line    []byte
+	afterCR bool // The last line ended with a carriage return, so a newline right after it is part of the same break
+}
+
+// record adds input sent to the PTY, writing a record for every line it completes
+func (a *inputAuditor) record(input []byte) {
+	if a.audit == nil {
+		return
+	}
+	for len(input) > 0 {
+		i := bytes.IndexAny(input, "\r\n")
+		if i < 0 {
+			a.line = append(a.line, input...)
+			a.afterCR = false
+			if len(a.line) >= maxAuditLine {
+				a.flush(true)
+			}
+			return
+		}
+		if i == 0 && input[0] == '\n' && a.afterCR && len(a.line) == 0 {
+			a.afterCR = false
+			input = input[1:]
+			continue
+		}
+		a.line = append(a.line, input[:i]...)
+		a.flush(false)
+		a.afterCR = input[i] == '\r'
+		input = input[i+1:]
+	}
+}
+
+// flush records the buffered line, marked partial if it didn't end with a line break. It is called
+// with partial set when the connection ends.
+func (a *inputAuditor) flush(partial bool) {
+	if a.audit == nil || (partial && len(a.line) == 0) {
+		return
+	}
+	a.audit.write(auditRecord{
+		Time:    time.Now(),
+		Machine: a.machine,
+		Channel: a.channel,
+		Source:  "ws",
+		Remote:  a.remote,
+		Input:   string(a.line),
+		Partial: partial,
+	})
+	a.line = a.line[:0]
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// authToken is the bearer token required on every request except for the page itself and the
+// readiness probe, set with -auth-token. Empty disables authentication.
+var authToken string
+
+// unauthenticatedPaths are served without a token
+var unauthenticatedPaths = map[string]bool{"/": true, "/healthz": true}
+
+// requireAuth wraps the server's handler so requests must carry authToken, either in an
+// "Authorization: Bearer" header or, for browsers, which can't set headers on WebSockets or
+// beacons, in the token query parameter. The page at / carries no data and is always served so
+// a browser can load it before it has a token, and /healthz is left open for orchestrator probes,
+// which can't be configured with a token everywhere.
+func requireAuth(next http.Handler) http.Handler {
+	if authToken == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if unauthenticatedPaths[r.URL.Path] || validAuthToken(requestToken(r)) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		requestLogger(r.Context()).Warn("Rejected unauthenticated request", "path", r.URL.Path, "remote", r.RemoteAddr)
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeJSONError(w, http.StatusUnauthorized, errUnauthorized, "Unauthorized")
+	})
+}
+
+// requestToken returns the token a request was sent with, "" if none
+func requestToken(r *http.Request) string {
+	if header := r.Header.Get("Authorization"); header != "" {
+		scheme, token, ok := strings.Cut(header, " ")
+		if ok && strings.EqualFold(scheme, "Bearer") {
+			return strings.TrimSpace(token)
+		}
+		return ""
+	}
+	return r.URL.Query().Get("token")
+}
+
+// validAuthToken compares token with authToken in constant time
+func validAuthToken(token string) bool {
+	return subtle.ConstantTimeCompare([]byte(token), []byte(authToken)) == 1
+}
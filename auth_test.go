@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequireAuth(t *testing.T) {
+	authToken = "secret"
+	t.Cleanup(func() { authToken = "" })
+	handler := requireAuth(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {}))
+
+	tests := []struct {
+		target string
+		header string
+		want   int
+	}{
+		{"/", "", http.StatusOK},
+		{"/healthz", "", http.StatusOK},
+		{"/metrics", "", http.StatusUnauthorized},
+		{"/metrics", "Bearer secret", http.StatusOK},
+		{"/sessions", "Bearer wrong", http.StatusUnauthorized},
+		{"/ws?token=secret", "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, tt.target, nil)
+		if tt.header != "" {
+			r.Header.Set("Authorization", tt.header)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != tt.want {
+			t.Errorf("%s with %q = %d, want %d", tt.target, tt.header, w.Code, tt.want)
+		}
+	}
+}
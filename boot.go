@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const (
+	bootReadyMarker = "login:"        // Console text that marks a machine as booted
+	bootWaitTimeout = 3 * time.Minute // Default and maximum time create_session?wait=true blocks
+)
+
+// waitForSessionBoot runs the boot probe on every machine of the session in parallel and
+// returns the ready state per machine ID once all probes finish or the deadline passes.
+func waitForSessionBoot(session *Session, deadline time.Time) map[string]bool {
+	// A recycle may replace machines while we wait, so probe a snapshot of the consoles
+	sessionsMu.RLock()
+	consoles := make(map[string]*consoleStream, len(session.ptyFiles))
+	for id := range session.ptyFiles {
+		consoles[id] = session.consoles[id]
+	}
+	sessionsMu.RUnlock()
+
+	var wg sync.WaitGroup
+	for id, console := range consoles {
+		wg.Add(1)
+		go func(id string, console *consoleStream) {
+			defer wg.Done()
+			ready := probeBoot(console, deadline)
+
+			sessionsMu.Lock()
+			session.bootReady[id] = session.bootReady[id] || ready
+			sessionsMu.Unlock()
+
+			slog.Info("Boot probe finished", "session", session.hash, "machine", id, "ready", ready)
+		}(id, console)
+	}
+	wg.Wait()
+
+	sessionsMu.RLock()
+	defer sessionsMu.RUnlock()
+	ready := make(map[string]bool, len(session.ptyFiles))
+	for id := range session.ptyFiles {
+		ready[id] = session.bootReady[id]
+	}
+	return ready
+}
+
+// probeBoot watches the console until the login prompt appears or the deadline passes.
+// It only observes the output, which is still replayed to the first client.
+func probeBoot(console *consoleStream, deadline time.Time) bool {
+	sub, output := console.subscribe(false)
+	defer console.unsubscribe(sub)
+	if bytes.Contains(output, []byte(bootReadyMarker)) {
+		return true
+	}
+
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	for {
+		select {
+		case chunk, ok := <-sub.output:
+			if !ok {
+				return false // The machine went away
+			}
+			output = append(output, chunk...)
+			// Only the tail can contain a marker that was split across chunks
+			if bytes.Contains(output[max(0, len(output)-len(chunk)-len(bootReadyMarker)):], []byte(bootReadyMarker)) {
+				return true
+			}
+			// Keep just enough to find a marker that straddles the next chunk
+			output = output[max(0, len(output)-len(bootReadyMarker)):]
+		case <-timer.C:
+			return false
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+const cpuMaxPeriod = 100000 // cpu.max period in microseconds
+
+// Resource limits for the VMs of a session, set with the -cgroup-* flags
+var (
+	cgroupParent      string // cgroup v2 directory under which each session gets its own cgroup, empty disables cgroups
+	cgroupMemOverhead = 256  // Memory in MB each VM may use on top of its guest RAM, for QEMU itself
+	cgroupCPUPercent  = 100  // Host CPU time each vCPU may use, in percent of one CPU; 0 for no limit
+)
+
+// setupCgroupParent checks that cgroupParent is a cgroup v2 directory and enables the memory and
+// cpu controllers for the session cgroups below it. The parent must not hold processes itself,
+// since cgroup v2 only lets a cgroup without processes delegate controllers.
+func setupCgroupParent() error {
+	if _, err := os.Stat(filepath.Join(cgroupParent, "cgroup.controllers")); err != nil {
+		return fmt.Errorf("%s is not a cgroup v2 directory: %v", cgroupParent, err)
+	}
+	if err := os.WriteFile(filepath.Join(cgroupParent, "cgroup.subtree_control"), []byte("+memory +cpu"), 0); err != nil {
+		return fmt.Errorf("failed to enable memory and cpu controllers in %s: %v", cgroupParent, err)
+	}
+	return nil
+}
+
+// createSessionCgroup creates the session's cgroup and sets its limits. startMachine starts QEMU
+// directly in the cgroup.
+func createSessionCgroup(session *Session) error {
+	if cgroupParent == "" {
+		return nil
+	}
+	path := filepath.Join(cgroupParent, "vmshell-"+session.hash)
+	if err := os.Mkdir(path, 0o755); err != nil {
+		return fmt.Errorf("failed to create cgroup: %v", err)
+	}
+	session.cgroup = path
+	return setCgroupLimits(session)
+}
+
+// setCgroupLimits sets the limits of the session's cgroup from the session options: memory.max
+// covers every VM's guest RAM plus cgroupMemOverhead, and cpu.max gives each vCPU
+// cgroupCPUPercent of a host CPU.
+func setCgroupLimits(session *Session) error {
+	if session.cgroup == "" {
+		return nil
+	}
+	path := session.cgroup
+	machines := int64(session.opts.machineCount)
+	memoryMax := machines * int64(session.opts.memMB+cgroupMemOverhead) << 20
+	cpuMax := "max"
+	if cgroupCPUPercent > 0 {
+		quota := machines * int64(session.opts.vcpus) * int64(cgroupCPUPercent) * cpuMaxPeriod / 100
+		cpuMax = fmt.Sprintf("%d %d", quota, cpuMaxPeriod)
+	}
+	for _, limit := range [][2]string{
+		{"memory.max", strconv.FormatInt(memoryMax, 10)},
+		{"cpu.max", cpuMax},
+	} {
+		file, value := limit[0], limit[1]
+		if err := os.WriteFile(filepath.Join(path, file), []byte(value), 0); err != nil {
+			return fmt.Errorf("failed to set %s of cgroup %s: %v", file, path, err)
+		}
+	}
+	return nil
+}
+
+// removeSessionCgroup removes the session's cgroup once its VMs are gone
+func removeSessionCgroup(session *Session) {
+	if session.cgroup == "" {
+		return
+	}
+	// A cgroup is removed with rmdir; its control files don't count as contents
+	if err := os.Remove(session.cgroup); err != nil && !errors.Is(err, os.ErrNotExist) {
+		slog.Error("Error removing cgroup", "session", session.hash, "cgroup", session.cgroup, "err", err)
+	}
+}
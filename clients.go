@@ -0,0 +1,310 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	pongWait   = 60 * time.Second  // A connection is considered dead if no pong arrives within this time
+	pingPeriod = pongWait * 9 / 10 // How often pings are sent, leaving time for the pong to arrive
+	writeWait  = 10 * time.Second  // Time allowed to write a control frame
+)
+
+// wsProtocols are the WebSocket subprotocols the server speaks, newest first. Each version fixes
+// how frames are used: vmshell.v1 carries terminal I/O in binary frames and JSON control messages
+// and notifications in text frames. A new control-message format gets a new version.
+var wsProtocols = []string{"vmshell.v1"}
+
+// negotiateProtocol returns the newest subprotocol both the server and the client support, or ""
+func negotiateProtocol(requested []string) string {
+	for _, supported := range wsProtocols {
+		for _, protocol := range requested {
+			if protocol == supported {
+				return supported
+			}
+		}
+	}
+	return ""
+}
+
+// wsCompression enables permessage-deflate for clients that offer it, disabled with -ws-compression=false
+var wsCompression = true
+
+// offersCompression reports whether the client offered permessage-deflate, which the upgrader
+// then negotiates if wsCompression is on
+func offersCompression(r *http.Request) bool {
+	for _, header := range r.Header.Values("Sec-WebSocket-Extensions") {
+		for _, extension := range strings.Split(header, ",") {
+			name, _, _ := strings.Cut(extension, ";")
+			if strings.TrimSpace(name) == "permessage-deflate" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Limits on concurrent WebSocket connections, set with -ws-max-per-session and -ws-max-per-machine.
+// Interactive clients, observers, and the aux channel all count; 0 disables a limit.
+var (
+	maxSessionClients = 64
+	maxMachineClients = 32
+)
+
+// clientLimitReached returns why another connection to the session's machine would exceed a
+// connection limit, or "" if it fits. Must be called with sessionsMu held.
+func clientLimitReached(session *Session, machineID string) string {
+	if maxSessionClients > 0 && len(session.clients) >= maxSessionClients {
+		return fmt.Sprintf("Too many connections to this session (limit %d)", maxSessionClients)
+	}
+	if maxMachineClients > 0 {
+		count := 0
+		for client := range session.clients {
+			if client.machineID == machineID {
+				count++
+			}
+		}
+		if count >= maxMachineClients {
+			return fmt.Sprintf("Too many connections to this machine (limit %d)", maxMachineClients)
+		}
+	}
+	return ""
+}
+
+// Output coalescing, tunable with -ws-flush-interval and -ws-frame-size
+var (
+	coalesceInterval = 16 * time.Millisecond // Output arriving this soon after the previous frame is batched
+	coalesceSize     = 16 * 1024             // Batched output is sent once it reaches this many bytes
+)
+
+// wsClient is a WebSocket attached to one of a session's machines.
+// The connection supports a single concurrent writer, so every write goes through writeMessage.
+type wsClient struct {
+	conn       *websocket.Conn
+	machineID  string
+	channel    string
+	term       string // Terminal type the client reported, "unknown" if it sent none
+	textFrames bool   // PTY output is sent as text frames, so the client can't tell notifications apart
+
+	writeMu   sync.Mutex
+	closeOnce sync.Once
+}
+
+// writeMessage writes a single message to the client's WebSocket
+func (c *wsClient) writeMessage(messageType int, data []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.conn.WriteMessage(messageType, data)
+}
+
+// close closes the client's WebSocket. The handler, the output goroutine, and a newer connection
+// taking over may all do so; only the first call closes the connection, and later calls return nil.
+func (c *wsClient) close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		err = c.conn.Close()
+	})
+	return err
+}
+
+// streamOutput sends console output to the client, starting with the backlog, until the console ends
+// or sub is unsubscribed. Output arriving within coalesceInterval of the previous frame is batched
+// into frames of up to about coalesceSize bytes, so chatty guests produce far fewer frames, while
+// output after a quiet period, such as the echo of a keystroke, is sent right away. A failed write
+// closes the connection, which ends the handler's read loop as well.
+func (c *wsClient) streamOutput(console *consoleStream, sub *consoleSubscriber, backlog []byte, logger *slog.Logger) {
+	var boundary utf8Boundary
+	send := func(data []byte) error {
+		messageType := websocket.BinaryMessage
+		if c.textFrames {
+			// Text frames must be valid UTF-8, so never split a multibyte sequence across frames
+			messageType, data = websocket.TextMessage, boundary.complete(data)
+			if len(data) == 0 {
+				return nil
+			}
+		}
+		return c.writeMessage(messageType, data)
+	}
+
+	if len(backlog) > 0 {
+		if err := send(backlog); err != nil {
+			logger.Error("Error replaying console backlog to WebSocket", "err", err)
+			return
+		}
+	}
+
+	var pending []byte
+	var lastFlush time.Time
+	flushTimer := time.NewTimer(coalesceInterval)
+	flushTimer.Stop()
+	timerArmed := false
+	flush := func() error {
+		if timerArmed {
+			if !flushTimer.Stop() {
+				<-flushTimer.C
+			}
+			timerArmed = false
+		}
+		if len(pending) == 0 {
+			return nil
+		}
+		err := send(pending)
+		pending = nil
+		lastFlush = time.Now()
+		return err
+	}
+	add := func(chunk []byte) error {
+		pending = append(pending, chunk...)
+		if len(pending) >= coalesceSize || (!timerArmed && time.Since(lastFlush) >= coalesceInterval) {
+			return flush()
+		}
+		if !timerArmed && len(pending) > 0 {
+			flushTimer.Reset(coalesceInterval - time.Since(lastFlush))
+			timerArmed = true
+		}
+		return nil
+	}
+	defer flushTimer.Stop()
+
+	for {
+		select {
+		case chunk, ok := <-sub.output:
+			if !ok {
+				// The console ended: the machine exited, was restarted, or the session was cleaned up.
+				// Output that overflowed the queue is still to be sent.
+				data, dropped := console.takeOverflow(sub)
+				if dropped > 0 {
+					if err := c.outputDropped(dropped, flush, &boundary, logger); err != nil {
+						logger.Error("Error writing to WebSocket", "err", err)
+					}
+				}
+				pending = append(pending, data...)
+				if err := flush(); err != nil {
+					logger.Error("Error writing to WebSocket", "err", err)
+				}
+				// A multibyte sequence the guest never finished can't be completed any more
+				if rest := boundary.flush(); len(rest) > 0 {
+					if err := c.writeMessage(websocket.TextMessage, rest); err != nil {
+						logger.Error("Error writing to WebSocket", "err", err)
+					}
+				}
+				closeMessage := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+				if status := console.process.crashStatus(exitStatusWait); status != "" {
+					closeMessage = websocket.FormatCloseMessage(closeMachineExited, "machine exited: "+status)
+				}
+				if err := c.writeMessage(websocket.CloseMessage, closeMessage); err != nil {
+					logger.Error("Error sending close message to WebSocket", "err", err)
+				}
+				return
+			}
+			if err := add(chunk); err != nil {
+				c.abort(console, sub, err, logger)
+				return
+			}
+		case <-sub.wake:
+			// The client fell behind and output overflowed its queue
+			data, dropped := console.takeOverflow(sub)
+			if dropped > 0 {
+				if err := c.outputDropped(dropped, flush, &boundary, logger); err != nil {
+					c.abort(console, sub, err, logger)
+					return
+				}
+			}
+			if err := add(data); err != nil {
+				c.abort(console, sub, err, logger)
+				return
+			}
+		case <-flushTimer.C:
+			timerArmed = false
+			if err := flush(); err != nil {
+				c.abort(console, sub, err, logger)
+				return
+			}
+		case <-sub.done:
+			return // The handler is returning
+		}
+	}
+}
+
+// outputDropped tells the client that output was lost because it read too slowly, after flushing
+// what came before the gap. Clients in text-frame mode get no notification, since text frames carry
+// their terminal output; they only lose any incomplete UTF-8 sequence at the gap.
+func (c *wsClient) outputDropped(dropped int, flush func() error, boundary *utf8Boundary, logger *slog.Logger) error {
+	logger.Warn("Client is reading too slowly, dropped console output", "bytes", dropped)
+	if err := flush(); err != nil {
+		return err
+	}
+	if c.textFrames {
+		*boundary = utf8Boundary{}
+		return nil
+	}
+	data, err := json.Marshal(map[string]any{"type": "output_dropped", "bytes": dropped})
+	if err != nil {
+		return err
+	}
+	return c.writeMessage(websocket.TextMessage, data)
+}
+
+// abort stops streaming after a failed write. The connection is closed right away: otherwise the
+// read loop would keep a connection that no longer gets output open until the next read error.
+func (c *wsClient) abort(console *consoleStream, sub *consoleSubscriber, err error, logger *slog.Logger) {
+	logger.Error("Error writing to WebSocket, closing it", "err", err)
+	console.unsubscribe(sub)
+	if err := c.close(); err != nil && !errors.Is(err, net.ErrClosed) {
+		logger.Error("Error closing WebSocket", "err", err)
+	}
+}
+
+// keepAlive pings the client every pingPeriod until stop is closed. Together with the read deadline
+// that pongs extend, this detects clients that vanished without a close frame.
+func (c *wsClient) keepAlive(stop <-chan struct{}) {
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			// WriteControl may run concurrently with writeMessage
+			if err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait)); err != nil {
+				slog.Warn("Error pinging client", "machine", c.machineID, "term", c.term, "err", err)
+				return
+			}
+		}
+	}
+}
+
+// notifyClients sends a JSON control message as a text frame to every client attached to the
+// session. Clients in text-frame mode are skipped since text frames carry their terminal output.
+func notifyClients(session *Session, message any) {
+	data, err := json.Marshal(message)
+	if err != nil {
+		slog.Error("Error encoding notification", "session", session.hash, "err", err)
+		return
+	}
+
+	sessionsMu.RLock()
+	clients := make([]*wsClient, 0, len(session.clients))
+	for client := range session.clients {
+		if !client.textFrames {
+			clients = append(clients, client)
+		}
+	}
+	sessionsMu.RUnlock()
+
+	for _, client := range clients {
+		if err := client.writeMessage(websocket.TextMessage, data); err != nil {
+			slog.Warn("Error notifying client", "session", session.hash, "machine", client.machineID, "term", client.term, "err", err)
+		}
+	}
+}
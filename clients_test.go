@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// failingListener hands out connections whose writes fail once failWrites is set, while reads keep
+// blocking as usual, so a test can break the server's side of a WebSocket in one direction only
+type failingListener struct {
+	net.Listener
+	failWrites atomic.Bool
+}
+
+func (l *failingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &failingConn{Conn: conn, listener: l}, nil
+}
+
+type failingConn struct {
+	net.Conn
+	listener *failingListener
+}
+
+func (c *failingConn) Write(p []byte) (int, error) {
+	if c.listener.failWrites.Load() {
+		return 0, errors.New("write failed")
+	}
+	return c.Conn.Write(p)
+}
+
+func TestWriteErrorEndsConnectionGoroutines(t *testing.T) {
+	session, guest := newTestSession(t)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(wsHandler))
+	listener := &failingListener{Listener: server.Listener}
+	server.Listener = listener
+	server.Start()
+	t.Cleanup(server.Close)
+	before := runtime.NumGoroutine()
+
+	dialer := websocket.Dialer{Subprotocols: []string{"vmshell.v1"}, HandshakeTimeout: 5 * time.Second}
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws?machine=1&sessionID=" + session.hash
+	conn, resp, err := dialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("dialing %s: %v", url, err)
+	}
+	_ = resp.Body.Close()
+	defer conn.Close()
+
+	// The client never sends anything, so only the failed write can end the read loop
+	listener.failWrites.Store(true)
+	if _, err := guest.Write([]byte("output nobody can receive\r\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		sessionsMu.RLock()
+		attached := len(session.clients)
+		sessionsMu.RUnlock()
+		if attached == 0 && runtime.NumGoroutine() <= before {
+			break
+		}
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<20)
+			t.Fatalf("%d clients still attached and %d goroutines running, %d before connecting:\n%s",
+				attached, runtime.NumGoroutine(), before, buf[:runtime.Stack(buf, true)])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
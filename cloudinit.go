@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// hostnamePattern matches a DNS label short enough to take a "-<machine>" suffix
+var hostnamePattern = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9-]{0,59}[A-Za-z0-9])?$`)
+
+// sshKeyTypes are the public key types accepted by the sshKey option
+var sshKeyTypes = map[string]bool{
+	"ssh-rsa": true, "ssh-ed25519": true,
+	"ecdsa-sha2-nistp256": true, "ecdsa-sha2-nistp384": true, "ecdsa-sha2-nistp521": true,
+	"sk-ssh-ed25519@openssh.com": true, "sk-ecdsa-sha2-nistp256@openssh.com": true,
+}
+
+// validateSSHKey checks that key is a single OpenSSH public key, "<type> <base64> [comment]"
+func validateSSHKey(key string) error {
+	if strings.ContainsAny(key, "\r\n") {
+		return fmt.Errorf("must be a single line")
+	}
+	fields := strings.Fields(key)
+	if len(fields) < 2 || !sshKeyTypes[fields[0]] {
+		return fmt.Errorf("not an OpenSSH public key")
+	}
+	if _, err := base64.StdEncoding.DecodeString(fields[1]); err != nil {
+		return fmt.Errorf("invalid key data: %v", err)
+	}
+	return nil
+}
+
+// machineSeed builds a cloud-init NoCloud seed ISO for a machine from the session's hostname and
+// sshKey options and returns its path, or "" if the session sets neither. Guests find the seed by
+// its "cidata" volume label. Like disk overlays, the ISO lives in the session's working directory,
+// is rebuilt on every start, and is removed with the directory on cleanup.
+func machineSeed(ctx context.Context, session *Session, machineID string) (string, error) {
+	if session.opts.hostname == "" && session.opts.sshKey == "" {
+		return "", nil
+	}
+	hostname := session.opts.hostname
+	if hostname == "" {
+		hostname = "vm"
+	}
+
+	// JSON strings are valid YAML, which sidesteps quoting the values
+	metaData := fmt.Sprintf("instance-id: %s-%s\nlocal-hostname: %s-%s\n", session.hash, machineID, hostname, machineID)
+	userData := "#cloud-config\n"
+	if session.opts.sshKey != "" {
+		key, _ := json.Marshal(session.opts.sshKey)
+		userData += fmt.Sprintf("ssh_authorized_keys:\n  - %s\n", key)
+	}
+
+	dir := filepath.Join(session.workDir, "seed-"+machineID)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", fmt.Errorf("failed to create seed directory for machine %s: %v", machineID, err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir) // Best effort, the working directory goes away on cleanup anyway
+	}()
+	metaPath, userPath := filepath.Join(dir, "meta-data"), filepath.Join(dir, "user-data")
+	for path, content := range map[string]string{metaPath: metaData, userPath: userData} {
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			return "", fmt.Errorf("failed to write cloud-init seed for machine %s: %v", machineID, err)
+		}
+	}
+
+	iso := filepath.Join(session.workDir, fmt.Sprintf("seed-%s.iso", machineID))
+	if err := os.Remove(iso); err != nil && !os.IsNotExist(err) {
+		return "", fmt.Errorf("failed to remove old seed %s: %v", iso, err)
+	}
+	args, err := seedISOCommand(iso, userPath, metaPath)
+	if err != nil {
+		return "", err
+	}
+	if err := runCommandContext(ctx, args...); err != nil {
+		return "", fmt.Errorf("failed to build cloud-init seed for machine %s: %v", machineID, err)
+	}
+	return iso, nil
+}
+
+// seedISOCommand returns the command line building a seed ISO with the first tool available:
+// cloud-localds from cloud-image-utils, or any mkisofs-compatible tool
+func seedISOCommand(iso, userData, metaData string) ([]string, error) {
+	if _, err := exec.LookPath("cloud-localds"); err == nil {
+		return []string{"cloud-localds", iso, userData, metaData}, nil
+	}
+	for _, tool := range []string{"genisoimage", "mkisofs", "xorrisofs"} {
+		if _, err := exec.LookPath(tool); err == nil {
+			return []string{tool, "-output", iso, "-volid", "cidata", "-joliet", "-rock", userData, metaData}, nil
+		}
+	}
+	return nil, fmt.Errorf("no tool to build cloud-init seeds found, install cloud-image-utils or genisoimage")
+}
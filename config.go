@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Config holds the settings read from a -config file. Keys are flag names without the leading
+// dash, so every flag can be set from the file, e.g.
+//
+//	{"max-sessions": 32, "session-timeout": "30m", "accel": "auto",
+//	 "images": {"debian-12": "/srv/images/debian-12.qcow2"}}
+type Config map[string]any
+
+// loadConfig reads a JSON config file
+func loadConfig(path string) (Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config Config
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	return config, nil
+}
+
+// apply sets every flag named in the config that wasn't given on the command line, so flags
+// override the file. Must be called after flag.Parse and before any flag value is used.
+func (c Config) apply(fs *flag.FlagSet) error {
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+
+	names := make([]string, 0, len(c))
+	for name := range c {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if name == "config" || fs.Lookup(name) == nil {
+			return fmt.Errorf("unknown setting %q", name)
+		}
+		if explicit[name] {
+			continue
+		}
+		value, err := configValue(c[name])
+		if err != nil {
+			return fmt.Errorf("invalid %s: %v", name, err)
+		}
+		if err := fs.Set(name, value); err != nil {
+			return fmt.Errorf("invalid %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// configValue converts a JSON value to the string form its flag parses. Lists become comma-separated
+// values and objects comma-separated key=value pairs, matching flags such as -images.
+func configValue(v any) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case []any:
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			s, err := configValue(item)
+			if err != nil {
+				return "", err
+			}
+			items = append(items, s)
+		}
+		return strings.Join(items, ","), nil
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		pairs := make([]string, 0, len(v))
+		for _, key := range keys {
+			s, err := configValue(v[key])
+			if err != nil {
+				return "", err
+			}
+			pairs = append(pairs, key+"="+s)
+		}
+		return strings.Join(pairs, ","), nil
+	default:
+		return "", fmt.Errorf("unsupported value %v", v)
+	}
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// consoleReadSize is the most a console reads from its PTY at a time, set with -pty-read-size.
+// Larger reads mean fewer reads, chunks, and frames when a guest prints a lot of output.
+var consoleReadSize = 32 * 1024
+
+// subscriberQueue is how many chunks a subscriber may fall behind, set with -ws-queue-depth. Beyond
+// that, in-process subscribers hold up the console while WebSocket clients have output coalesced
+// and, past consoleBacklogLimit, dropped.
+var subscriberQueue = 64
+
+const (
+	consoleBacklogLimit = 64 * 1024 // Maximum output kept for replay while no client is attached
+	scrollbackSize      = 64 * 1024 // Most recent output kept per console for /scrollback, attached or not
+	closeReplaced       = 4001      // WebSocket close code sent to a connection replaced by a newer one
+)
+
+// consoleStream reads one of a machine's console PTYs for as long as the machine runs and fans the
+// output out to every subscriber: attached WebSocket clients and observers, the boot probe, and /exec.
+// Output produced while no client is attached is kept, up to consoleBacklogLimit, and replayed
+// to the next client. Input is only accepted from the stream's owner, the newest connection.
+type consoleStream struct {
+	name       string             // Machine ID, with an "/aux" suffix for auxiliary consoles
+	conn       io.ReadWriteCloser // The PTY, or the console socket with -console-socket; only run reads from it
+	consoleLog *os.File           // Receives a copy of the output, nil when logging is off; closed by run
+	process    *machineProcess    // QEMU process behind the console, tells clients why the console ended
+
+	writeMu sync.Mutex // Serializes writes so input from different sources never interleaves
+	execMu  sync.Mutex // Runs /exec commands one at a time so their output can't mix
+
+	mu          sync.Mutex
+	subscribers map[*consoleSubscriber]struct{}
+	clients     int    // Subscribers that are clients
+	backlog     []byte // Output no client has seen yet
+	scrollback  *ringBuffer
+	owner       *wsClient // Connection whose input is accepted
+	ended       bool      // Set once the PTY is gone
+}
+
+// consoleSubscriber receives a copy of everything a console prints after it subscribed
+type consoleSubscriber struct {
+	output chan []byte   // Chunks of output, closed when the console ends
+	done   chan struct{} // Closed by unsubscribe so the stream stops delivering
+	client bool          // Interactive clients take over the backlog; passive subscribers (observers, probes) only watch
+
+	// A lossy subscriber, a WebSocket connection, never holds up the console. Output that doesn't fit
+	// its queue is kept in overflow, up to consoleBacklogLimit bytes, dropping the oldest bytes beyond
+	// that. All three are guarded by the stream's mu.
+	lossy    bool
+	wake     chan struct{} // Signaled when overflow has output, which follows everything in the queue
+	overflow []byte
+	dropped  int // Bytes dropped from overflow since the subscriber last took it
+}
+
+// consoleKey identifies a console of a machine in Session.consoles: the machine ID for the main
+// console, and "<machine>/<channel>" for the aux channel and the tty1 to tty3 serial ports
+func consoleKey(machineID, channel string) string {
+	if channel == "" || channel == "console" {
+		return machineID
+	}
+	return machineID + "/" + channel
+}
+
+// deleteConsoles removes every console a machine of the session may have from Session.consoles.
+// Must be called with sessionsMu held.
+func deleteConsoles(session *Session, machineID string) {
+	delete(session.consoles, machineID)
+	delete(session.consoles, consoleKey(machineID, "aux"))
+	for i := 1; i < maxSerialPorts; i++ {
+		delete(session.consoles, consoleKey(machineID, fmt.Sprintf("tty%d", i)))
+	}
+}
+
+// newConsoleStream returns a stream for ptmx. The caller starts it with go run().
+func newConsoleStream(name string, conn io.ReadWriteCloser, consoleLog *os.File, process *machineProcess) *consoleStream {
+	return &consoleStream{
+		name:        name,
+		conn:        conn,
+		consoleLog:  consoleLog,
+		process:     process,
+		subscribers: make(map[*consoleSubscriber]struct{}),
+		scrollback:  newRingBuffer(scrollbackSize),
+	}
+}
+
+// run reads the PTY until it is closed, e.g. because QEMU exited or the session was cleaned up
+func (c *consoleStream) run() {
+	defer c.end()
+	buf := make([]byte, consoleReadSize)
+	restarts := 0
+	for {
+		n, err := c.conn.Read(buf)
+		if n > 0 {
+			c.publish(append([]byte(nil), buf[:n]...))
+		}
+		if err == nil {
+			restarts = 0
+			continue
+		}
+		// Transient errors don't mean the VM is gone, so resume reading instead of dropping the stream
+		if !isFatalPTYError(err) && restarts < maxReaderRestarts {
+			restarts++
+			ptyReaderRestarts.Add(1)
+			slog.Warn("Recoverable PTY read error, resuming", "console", c.name, "restart", restarts, "maxRestarts", maxReaderRestarts, "err", err)
+			time.Sleep(readerRestartBackoff * time.Duration(restarts))
+			continue
+		}
+		if isFatalPTYError(err) {
+			slog.Info("PTY closed", "console", c.name, "err", err)
+		} else {
+			slog.Error("Error reading from PTY, giving up", "console", c.name, "restarts", restarts, "err", err)
+		}
+		return
+	}
+}
+
+// publish logs a chunk of output and hands it to every subscriber. An in-process subscriber that
+// falls behind holds up the console, and with it the guest, just like a blocked terminal would;
+// a lossy one loses output instead.
+func (c *consoleStream) publish(chunk []byte) {
+	if c.consoleLog != nil {
+		if _, err := c.consoleLog.Write(chunk); err != nil {
+			slog.Error("Error writing console log", "console", c.name, "err", err)
+		}
+	}
+
+	c.mu.Lock()
+	c.scrollback.write(chunk)
+	if c.clients == 0 {
+		c.backlog = append(c.backlog, chunk...)
+		if excess := len(c.backlog) - consoleBacklogLimit; excess > 0 {
+			c.backlog = c.backlog[excess:]
+		}
+	}
+	subscribers := make([]*consoleSubscriber, 0, len(c.subscribers))
+	for sub := range c.subscribers {
+		if sub.lossy {
+			c.offer(sub, chunk)
+			continue
+		}
+		subscribers = append(subscribers, sub)
+	}
+	c.mu.Unlock()
+
+	for _, sub := range subscribers {
+		select {
+		case sub.output <- chunk:
+		case <-sub.done:
+		}
+	}
+}
+
+// offer queues a chunk for a lossy subscriber without waiting. Once the queue is full, output goes
+// to the overflow until the subscriber takes it, so it stays in order. Must be called with mu held.
+func (c *consoleStream) offer(sub *consoleSubscriber, chunk []byte) {
+	if len(sub.overflow) == 0 {
+		select {
+		case sub.output <- chunk:
+			return
+		default:
+		}
+	}
+	sub.overflow = append(sub.overflow, chunk...)
+	if excess := len(sub.overflow) - consoleBacklogLimit; excess > 0 {
+		sub.overflow = sub.overflow[excess:]
+		sub.dropped += excess
+		consoleOutputDropped.Add(float64(excess))
+	}
+	select {
+	case sub.wake <- struct{}{}:
+	default:
+	}
+}
+
+// takeOverflow returns the output a lossy subscriber has queued and overflowed, in order, and how
+// many bytes were dropped before the overflowed part
+func (c *consoleStream) takeOverflow(sub *consoleSubscriber) ([]byte, int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var data []byte
+	for len(sub.overflow) > 0 {
+		select {
+		case chunk, ok := <-sub.output:
+			if ok {
+				data = append(data, chunk...)
+				continue
+			}
+		default:
+		}
+		break
+	}
+	data = append(data, sub.overflow...)
+	dropped := sub.dropped
+	sub.overflow, sub.dropped = nil, 0
+	return data, dropped
+}
+
+// end closes every subscriber's output and the console log once the PTY is gone
+func (c *consoleStream) end() {
+	c.mu.Lock()
+	c.ended = true
+	for sub := range c.subscribers {
+		close(sub.output)
+	}
+	c.subscribers = make(map[*consoleSubscriber]struct{})
+	c.clients = 0
+	c.mu.Unlock()
+
+	if c.consoleLog != nil {
+		if err := c.consoleLog.Close(); err != nil {
+			slog.Error("Error closing console log", "console", c.name, "err", err)
+		}
+	}
+}
+
+// subscribe starts delivering output to a new subscriber and returns the backlog, output printed
+// while no client was attached. A client takes the backlog over and should show it before anything
+// from its output channel; passive subscribers get a copy.
+func (c *consoleStream) subscribe(client bool) (*consoleSubscriber, []byte) {
+	return c.newSubscriber(client, false, false)
+}
+
+// subscribeReplaying subscribes a lossy WebSocket connection. With fromScrollback it returns the
+// scrollback instead of the backlog, so the subscriber sees the console's recent history even if
+// another client saw it first. The scrollback includes the backlog, which a client takes over either way.
+func (c *consoleStream) subscribeReplaying(client, fromScrollback bool) (*consoleSubscriber, []byte) {
+	return c.newSubscriber(client, fromScrollback, true)
+}
+
+func (c *consoleStream) newSubscriber(client, fromScrollback, lossy bool) (*consoleSubscriber, []byte) {
+	sub := &consoleSubscriber{
+		output: make(chan []byte, subscriberQueue),
+		done:   make(chan struct{}),
+		client: client,
+		lossy:  lossy,
+		wake:   make(chan struct{}, 1),
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var replay []byte
+	if fromScrollback {
+		replay = c.scrollback.bytes()
+	}
+	if c.ended {
+		close(sub.output)
+		return sub, replay
+	}
+	switch {
+	case client && fromScrollback:
+		c.backlog = nil
+	case client:
+		replay, c.backlog = c.backlog, nil
+	case !fromScrollback:
+		replay = append([]byte(nil), c.backlog...)
+	}
+	if client {
+		c.clients++
+	}
+	c.subscribers[sub] = struct{}{}
+	return sub, replay
+}
+
+// recentOutput returns a copy of the console's scrollback, the last scrollbackSize bytes it printed
+func (c *consoleStream) recentOutput() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.scrollback.bytes()
+}
+
+// unsubscribe stops delivering output to sub
+func (c *consoleStream) unsubscribe(sub *consoleSubscriber) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.subscribers[sub]; !ok {
+		return // Already removed when the console ended
+	}
+	delete(c.subscribers, sub)
+	close(sub.done)
+	if sub.client {
+		c.clients--
+	}
+}
+
+// takeOwnership makes client the connection whose input is accepted and returns the previous owner
+func (c *consoleStream) takeOwnership(client *wsClient) *wsClient {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	previous := c.owner
+	c.owner = client
+	return previous
+}
+
+// releaseOwnership gives up ownership if client still holds it
+func (c *consoleStream) releaseOwnership(client *wsClient) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.owner == client {
+		c.owner = nil
+	}
+}
+
+// isOwner reports whether client's input is accepted
+func (c *consoleStream) isOwner(client *wsClient) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.owner == client
+}
+
+// write sends input to the console as a single unit, so input from different sources (a connection
+// on its way out, API requests) never interleaves mid-write
+func (c *consoleStream) write(data []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_, err := c.conn.Write(data)
+	return err
+}
+
+// scrollbackHandler returns the most recent output of a machine's console as raw bytes, so
+// clients joining mid-stream can show what they missed
+func scrollbackHandler(w http.ResponseWriter, r *http.Request) {
+	_, _, console, ok := lookupConsole(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if _, err := w.Write(console.recentOutput()); err != nil {
+		requestLogger(r.Context()).Error("Error writing scrollback response", "err", err)
+	}
+}
+
+// ringBuffer keeps the last len(buf) bytes written to it
+type ringBuffer struct {
+	buf   []byte
+	start int // Index of the oldest byte
+	size  int // Number of bytes held
+}
+
+func newRingBuffer(capacity int) *ringBuffer {
+	return &ringBuffer{buf: make([]byte, capacity)}
+}
+
+// write appends p, overwriting the oldest bytes once the buffer is full
+func (r *ringBuffer) write(p []byte) {
+	if len(p) >= len(r.buf) {
+		copy(r.buf, p[len(p)-len(r.buf):])
+		r.start, r.size = 0, len(r.buf)
+		return
+	}
+	end := (r.start + r.size) % len(r.buf)
+	n := copy(r.buf[end:], p)
+	copy(r.buf, p[n:])
+	if r.size += len(p); r.size > len(r.buf) {
+		r.start = (r.start + r.size - len(r.buf)) % len(r.buf)
+		r.size = len(r.buf)
+	}
+}
+
+// bytes returns a copy of the held bytes, oldest first
+func (r *ringBuffer) bytes() []byte {
+	out := make([]byte, 0, r.size)
+	end := r.start + r.size
+	if end <= len(r.buf) {
+		return append(out, r.buf[r.start:end]...)
+	}
+	out = append(out, r.buf[r.start:]...)
+	return append(out, r.buf[:end-len(r.buf)]...)
+}
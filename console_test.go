@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"testing"
+)
+
+// BenchmarkConsoleStream measures how fast guest output is read from the console and fanned out to
+// subscribers, both WebSocket connections, which never hold up the console, and in-process ones
+func BenchmarkConsoleStream(b *testing.B) {
+	out := log.Writer()
+	log.SetOutput(io.Discard) // Each run ends its console, which is logged
+	defer log.SetOutput(out)
+	chunk := bytes.Repeat([]byte("0123456789abcdef\r\n"), 4096/18)
+	for _, lossy := range []bool{true, false} {
+		kind := "websocket"
+		if !lossy {
+			kind = "inprocess"
+		}
+		for _, subscribers := range []int{1, 4, 16, 64} {
+			b.Run(fmt.Sprintf("%s/subscribers=%d", kind, subscribers), func(b *testing.B) {
+				guest, console := net.Pipe()
+				stream := newConsoleStream("1", console, nil, &machineProcess{done: make(chan struct{})})
+				var wg sync.WaitGroup
+				for i := 0; i < subscribers; i++ {
+					sub, _ := stream.newSubscriber(false, false, lossy)
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						for {
+							select {
+							case _, ok := <-sub.output:
+								if !ok {
+									return
+								}
+							case <-sub.wake:
+								stream.takeOverflow(sub)
+							}
+						}
+					}()
+				}
+				go stream.run()
+
+				b.SetBytes(int64(len(chunk)))
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if _, err := guest.Write(chunk); err != nil {
+						b.Fatal(err)
+					}
+				}
+				_ = guest.Close()
+				wg.Wait()
+			})
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"path/filepath"
+	"time"
+)
+
+// consoleSockets puts each machine's main serial port on a Unix socket in the session's working
+// directory instead of QEMU's stdio, set with -console-socket. QEMU keeps writing its own messages
+// to the stdio PTY, which is still read, but the console stream reads the socket.
+var consoleSockets bool
+
+const consoleDialRetry = 10 * time.Millisecond // Output the guest prints before the server connects is lost, so retry quickly
+
+// consoleSocketPath returns where QEMU listens for the console connection of a machine
+func consoleSocketPath(session *Session, machineID string) string {
+	return filepath.Join(session.workDir, fmt.Sprintf("console-%s.sock", machineID))
+}
+
+// dialConsoleSocket connects to a machine's console socket, retrying until QEMU has created it.
+// It returns a nil connection and no error if the process exits first, which leaves reporting
+// why to awaitQEMUStartup.
+func dialConsoleSocket(ctx context.Context, path string, exited <-chan struct{}) (net.Conn, error) {
+	deadline := time.Now().Add(qmpDialTimeout)
+	for {
+		conn, err := net.Dial("unix", path)
+		if err == nil {
+			return conn, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("failed to connect to console socket %s: %v", path, err)
+		}
+		select {
+		case <-exited:
+			return nil, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(consoleDialRetry):
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"os"
+	"syscall"
+	"unsafe"
+
+	"github.com/creack/pty"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	maxControlFrameSize = 512       // Text frames larger than this are never treated as control messages
+	maxInputFrameSize   = 64 * 1024 // Frames larger than this close the connection with 1009 before they are read
+	maxTerminalDim      = 1000      // Upper bound for resize rows and columns
+)
+
+// controlMessage is a JSON text frame sent by the client to control its connection, e.g.
+//
+//	{"type":"resize","cols":120,"rows":40}
+type controlMessage struct {
+	Type string `json:"type"`
+	Cols int    `json:"cols"`
+	Rows int    `json:"rows"`
+}
+
+// knownControlTypes lists the control message types the server understands
+var knownControlTypes = map[string]bool{
+	"resize": true,
+}
+
+// parseControlMessage reports whether a WebSocket message is a control message.
+// Only small text frames holding a JSON object with a known type qualify; anything else,
+// including all binary frames, is raw terminal input. Oversized frames are rejected
+// before any JSON decoding so a client can't force large allocations on this path.
+func parseControlMessage(messageType int, msg []byte) (controlMessage, bool) {
+	if messageType != websocket.TextMessage || len(msg) > maxControlFrameSize {
+		return controlMessage{}, false
+	}
+	trimmed := bytes.TrimSpace(msg)
+	if len(trimmed) == 0 || trimmed[0] != '{' {
+		return controlMessage{}, false
+	}
+	// Declared only now, since it escapes to the heap through Unmarshal
+	var control controlMessage
+	if err := json.Unmarshal(trimmed, &control); err != nil || !knownControlTypes[control.Type] {
+		return control, false
+	}
+	return control, true
+}
+
+// handleControlMessage applies a control message to the connection's console.
+// Malformed messages are logged and ignored so they never tear down the connection.
+func handleControlMessage(conn io.ReadWriteCloser, control controlMessage, machineID, sessionID string) {
+	switch control.Type {
+	case "resize":
+		if control.Cols < 1 || control.Rows < 1 || control.Cols > maxTerminalDim || control.Rows > maxTerminalDim {
+			slog.Warn("Ignoring invalid resize", "session", sessionID, "machine", machineID, "cols", control.Cols, "rows", control.Rows)
+			return
+		}
+		ptmx, ok := conn.(*os.File)
+		if !ok {
+			return // A console socket has no window size
+		}
+		if err := resizePTY(ptmx, control.Rows, control.Cols); err != nil {
+			slog.Error("Error resizing PTY", "session", sessionID, "machine", machineID, "err", err)
+		}
+	}
+}
+
+// resizePTY sets the window size of a PTY. pty.Setsize is not used because it calls Fd(),
+// which would switch a pollable PTY back to blocking mode.
+func resizePTY(f *os.File, rows, cols int) error {
+	rawConn, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	size := pty.Winsize{Rows: uint16(rows), Cols: uint16(cols)}
+	var ioctlErr error
+	if err := rawConn.Control(func(fd uintptr) {
+		_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TIOCSWINSZ, uintptr(unsafe.Pointer(&size)))
+		if errno != 0 {
+			ioctlErr = errno
+		}
+	}); err != nil {
+		return err
+	}
+	return ioctlErr
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestParseControlMessage(t *testing.T) {
+	resize := `{"type":"resize","cols":120,"rows":40}`
+	tests := []struct {
+		name        string
+		messageType int
+		msg         string
+		control     bool
+	}{
+		{"resize", websocket.TextMessage, resize, true},
+		{"surrounding whitespace", websocket.TextMessage, " " + resize + "\n", true},
+		{"binary frame", websocket.BinaryMessage, resize, false},
+		{"unknown type", websocket.TextMessage, `{"type":"reboot"}`, false},
+		{"not an object", websocket.TextMessage, "ls -l\r", false},
+		{"invalid JSON", websocket.TextMessage, `{"type":"resize"`, false},
+		{"at the limit", websocket.TextMessage, resize + strings.Repeat(" ", maxControlFrameSize-len(resize)), true},
+		{"over the limit", websocket.TextMessage, resize + strings.Repeat(" ", maxControlFrameSize-len(resize)+1), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, ok := parseControlMessage(tt.messageType, []byte(tt.msg)); ok != tt.control {
+				t.Errorf("parseControlMessage(%q) = %v, want %v", tt.msg, ok, tt.control)
+			}
+		})
+	}
+}
+
+func TestParseControlMessageOversizedDoesNotAllocate(t *testing.T) {
+	msg := []byte(`{"type":"resize","cols":80,"rows":24,"pad":"` + strings.Repeat("x", 1<<20) + `"}`)
+	allocs := testing.AllocsPerRun(10, func() {
+		if _, ok := parseControlMessage(websocket.TextMessage, msg); ok {
+			t.Fatal("oversized frame parsed as a control message")
+		}
+	})
+	if allocs != 0 {
+		t.Errorf("parseControlMessage allocated %v times for an oversized frame, want 0", allocs)
+	}
+}
+
+func TestOversizedControlFrameClosesConnection(t *testing.T) {
+	session, guest := newTestSession(t)
+	received := make(chan []byte, 1)
+	go func() {
+		var input bytes.Buffer
+		buf := make([]byte, 4096)
+		for {
+			n, err := guest.Read(buf)
+			input.Write(buf[:n])
+			if err != nil {
+				received <- input.Bytes()
+				return
+			}
+		}
+	}()
+
+	conn := dialTestConsole(t, session)
+	frame := `{"type":"resize","cols":80,"rows":24,"pad":"` + strings.Repeat("x", maxInputFrameSize) + `"}`
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(frame)); err != nil {
+		t.Fatalf("writing frame: %v", err)
+	}
+
+	if err := conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		_, _, err := conn.ReadMessage()
+		if err == nil {
+			continue
+		}
+		if !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+			t.Fatalf("connection ended with %v, want close code %d", err, websocket.CloseMessageTooBig)
+		}
+		break
+	}
+
+	// Nothing of the frame may have reached the guest
+	_ = guest.Close()
+	if input := <-received; len(input) > 0 {
+		t.Errorf("guest received %d bytes of the oversized frame", len(input))
+	}
+}
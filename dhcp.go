@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// dnsmasqStopTimeout bounds how long cleanup waits for dnsmasq to exit after SIGTERM
+const dnsmasqStopTimeout = 5 * time.Second
+
+// startDHCP runs a dnsmasq instance on the session bridge that hands every machine a fixed
+// address derived from its MAC. DNS is only served to NAT'd sessions, and only they are told
+// to route through the bridge.
+func startDHCP(session *Session) error {
+	args := []string{"dnsmasq",
+		"--keep-in-foreground",
+		"--conf-file=/dev/null",
+		"--pid-file",
+		"--leasefile-ro",
+		// bind-dynamic keeps serving if the health checker has to recreate the bridge
+		"--bind-dynamic",
+		"--interface=" + session.bridgeName,
+		"--except-interface=lo",
+		fmt.Sprintf("--dhcp-range=%s,static,255.255.255.0,1h", session.subnet.IP),
+	}
+	for _, id := range session.machineIDs() {
+		machineNum, _ := strconv.Atoi(id)
+		args = append(args, fmt.Sprintf("--dhcp-host=%s,%s", machineMAC(session.hash, machineNum, 0), machineAddress(session.subnet, machineNum)))
+	}
+	if !session.opts.nat {
+		// Without an uplink there is nothing to resolve names with or route to
+		args = append(args, "--port=0", "--dhcp-option=3")
+	}
+	if session.netns != "" {
+		args = append([]string{"ip", "netns", "exec", session.netns}, args...)
+	}
+
+	logFile, err := os.OpenFile(filepath.Join(session.workDir, "dnsmasq.log"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to create dnsmasq log: %v", err)
+	}
+	defer logFile.Close()
+
+	slog.Info("Starting DHCP server", "session", session.hash, "bridge", session.bridgeName, "subnet", session.subnet)
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start dnsmasq: %v", err)
+	}
+	session.dnsmasq = cmd
+	return nil
+}
+
+// restartDHCP restarts the session's dnsmasq instance, if it has one, so it serves the addresses
+// of the session's current machines. Must be called with session.lifecycleMu held.
+func restartDHCP(session *Session) {
+	if session.dnsmasq == nil {
+		return
+	}
+	stopDHCP(session)
+	if err := startDHCP(session); err != nil {
+		slog.Error("Error restarting DHCP server", "session", session.hash, "err", err)
+	}
+}
+
+// stopDHCP stops the session's dnsmasq instance, killing it if it doesn't exit in time
+func stopDHCP(session *Session) {
+	cmd := session.dnsmasq
+	if cmd == nil {
+		return
+	}
+	session.dnsmasq = nil
+
+	done := make(chan struct{})
+	go func() {
+		// dnsmasq exits with a non-zero status on SIGTERM, so the error isn't interesting
+		_ = cmd.Wait()
+		close(done)
+	}()
+
+	if err := cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		slog.Error("Error signalling dnsmasq", "session", session.hash, "err", err)
+	}
+	select {
+	case <-done:
+	case <-time.After(dnsmasqStopTimeout):
+		slog.Warn("dnsmasq did not exit after SIGTERM, killing it", "session", session.hash)
+		if err := cmd.Process.Kill(); err != nil {
+			slog.Error("Error killing dnsmasq", "session", session.hash, "err", err)
+		}
+		<-done
+	}
+}
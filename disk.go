@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// machineOverlay creates a fresh qcow2 overlay for a machine, backed by the session image, and
+// returns its path. The base image is never written to. Each machine gets its own overlay, which
+// lives in the session's working directory and is removed with it on cleanup. The overlay is
+// recreated on every start, so a recycled or reset machine begins from the pristine image again.
+func machineOverlay(ctx context.Context, session *Session, machineID string) (string, error) {
+	overlay := overlayPath(session, machineID)
+	if err := os.Remove(overlay); err != nil && !os.IsNotExist(err) {
+		return "", fmt.Errorf("failed to remove old overlay %s: %v", overlay, err)
+	}
+	// qemu-img resolves a relative backing file against the overlay's directory
+	image, err := filepath.Abs(images[session.opts.image])
+	if err != nil {
+		return "", err
+	}
+	if err := runCommandContext(ctx, "qemu-img", "create", "-q", "-f", "qcow2", "-F", "qcow2", "-b", image, overlay); err != nil {
+		return "", fmt.Errorf("failed to create overlay for machine %s: %v", machineID, err)
+	}
+	return overlay, nil
+}
+
+// overlayPath returns where a machine's overlay is kept
+func overlayPath(session *Session, machineID string) string {
+	return filepath.Join(session.workDir, fmt.Sprintf("disk-%s.qcow2", machineID))
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+)
+
+// Stable error codes returned in JSON error bodies so clients can branch on them
+const (
+	errMissingSessionID     = "MISSING_SESSION_ID"
+	errInvalidSessionID     = "INVALID_SESSION_ID"
+	errSessionNotFound      = "SESSION_NOT_FOUND"
+	errSessionAlreadyClosed = "SESSION_CLOSED"
+	errInvalidMachine       = "INVALID_MACHINE"
+	errInvalidTermType      = "INVALID_TERM_TYPE"
+	errInvalidChannel       = "INVALID_CHANNEL"
+	errInvalidTTY           = "INVALID_TTY"
+	errInvalidFrames        = "INVALID_FRAMES"
+	errInvalidMode          = "INVALID_MODE"
+	errInvalidReplay        = "INVALID_REPLAY"
+	errUnsupportedProtocol  = "UNSUPPORTED_PROTOCOL"
+	errInvalidOptions       = "INVALID_OPTIONS"
+	errInvalidWaitTimeout   = "INVALID_WAIT_TIMEOUT"
+	errExportDisabled       = "EXPORT_DISABLED"
+	errExportUnsupported    = "EXPORT_UNSUPPORTED"
+	errExportFailed         = "EXPORT_FAILED"
+	errTooManySessions      = "TOO_MANY_SESSIONS"
+	errInsufficientMemory   = "INSUFFICIENT_MEMORY"
+	errImageLocked          = "IMAGE_LOCKED"
+	errSessionCreate        = "SESSION_CREATE_FAILED"
+	errInvalidPath          = "INVALID_PATH"
+	errInvalidUpload        = "INVALID_UPLOAD"
+	errUploadTooLarge       = "UPLOAD_TOO_LARGE"
+	errInvalidCommand       = "INVALID_COMMAND"
+	errInvalidTimeout       = "INVALID_TIMEOUT"
+	errExecFailed           = "EXEC_FAILED"
+	errInvalidSnapshotName  = "INVALID_SNAPSHOT_NAME"
+	errSnapshotsDisabled    = "SNAPSHOTS_DISABLED"
+	errSnapshotFailed       = "SNAPSHOT_FAILED"
+	errResetFailed          = "RESET_FAILED"
+	errMachineLimit         = "MACHINE_LIMIT"
+	errAddMachineFailed     = "ADD_MACHINE_FAILED"
+	errLastMachine          = "LAST_MACHINE"
+	errMethodNotAllowed     = "METHOD_NOT_ALLOWED"
+	errAdminDisabled        = "ADMIN_DISABLED"
+	errUnauthorized         = "UNAUTHORIZED"
+	errInternal             = "INTERNAL_ERROR"
+)
+
+// errorResponse is the JSON body of every error returned by the HTTP handlers
+type errorResponse struct {
+	Code    string       `json:"code"`
+	Message string       `json:"message"`
+	Fields  []fieldError `json:"fields,omitempty"` // Every invalid option, for INVALID_OPTIONS
+}
+
+// writeJSONError replies with status and a JSON body carrying a stable code and a human-readable message
+func writeJSONError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(errorResponse{Code: code, Message: message}); err != nil {
+		slog.Error("Error encoding JSON error response", "err", err)
+	}
+}
+
+// writeJSONFieldErrors replies like writeJSONError, listing each invalid option in the fields array
+func writeJSONFieldErrors(w http.ResponseWriter, status int, code string, optsErr *optionsError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(errorResponse{Code: code, Message: optsErr.Error(), Fields: optsErr.fields}); err != nil {
+		slog.Error("Error encoding JSON error response", "err", err)
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultExecTimeout  = 10 * time.Second // Time a command may run unless the request sets timeout
+	maxExecTimeout      = 2 * time.Minute  // Upper bound for the timeout parameter
+	maxExecCommandBytes = 4096             // Longest command accepted; it is typed as a single line
+	maxExecOutputBytes  = 1 << 20          // Most output collected before the command is given up on
+)
+
+// execResult is the JSON response of /exec
+type execResult struct {
+	Output   string `json:"output"`
+	ExitCode int    `json:"exitCode"`
+}
+
+// execHandler runs a one-shot command on a machine's console and returns its output.
+// The command is typed into the console, so the console must be at a logged-in shell prompt.
+// The output is delimited by sentinels echoed before and after the command.
+func execHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, errMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	command := r.FormValue("command")
+	if command == "" || len(command) > maxExecCommandBytes || strings.ContainsAny(command, "\r\n") {
+		writeJSONError(w, http.StatusBadRequest, errInvalidCommand, fmt.Sprintf("Invalid command (expected a single line of at most %d bytes)", maxExecCommandBytes))
+		return
+	}
+	timeout := defaultExecTimeout
+	if v := r.FormValue("timeout"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 || d > maxExecTimeout {
+			writeJSONError(w, http.StatusBadRequest, errInvalidTimeout, fmt.Sprintf("Invalid timeout (expected a duration up to %v)", maxExecTimeout))
+			return
+		}
+		timeout = d
+	}
+
+	session, machineID, console, ok := lookupConsole(w, r)
+	if !ok {
+		return
+	}
+
+	logger := requestLogger(r.Context()).With("session", session.hash, "machine", machineID)
+
+	session.touch()
+	session.audit.write(auditRecord{Time: time.Now(), Machine: machineID, Channel: "console", Source: "exec", Remote: r.RemoteAddr, Input: command})
+
+	result, err := runOnConsole(console, command, timeout)
+	if err != nil {
+		logger.Error("Command failed", "err", err)
+		writeJSONError(w, http.StatusGatewayTimeout, errExecFailed, err.Error())
+		return
+	}
+	logger.Info("Ran a command", "exitCode", result.ExitCode)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		logger.Error("Error encoding JSON response", "err", err)
+	}
+}
+
+// runOnConsole types command into the console between two sentinels and collects what is
+// printed between them. Commands on the same console run one at a time so their output
+// can't mix.
+func runOnConsole(console *consoleStream, command string, timeout time.Duration) (execResult, error) {
+	console.execMu.Lock()
+	defer console.execMu.Unlock()
+
+	token, err := generateShortHash(12)
+	if err != nil {
+		return execResult{}, fmt.Errorf("failed to generate sentinel: %v", err)
+	}
+	begin := "VMSHELL_BEGIN_" + token
+	end := "VMSHELL_END_" + token
+	endPattern := regexp.MustCompile(regexp.QuoteMeta(end) + `:(\d+)`)
+
+	// The sentinels are split with quotes so the terminal's echo of the typed line never matches them
+	line := fmt.Sprintf("echo \"VMSHELL\"\"_BEGIN_%s\"; %s\necho \"VMSHELL\"\"_END_%s:$?\"\n", token, command, token)
+
+	// Subscribe before typing so none of the output is missed
+	sub, _ := console.subscribe(false)
+	defer console.unsubscribe(sub)
+	if err := console.write([]byte(line)); err != nil {
+		return execResult{}, fmt.Errorf("error writing to machine console: %v", err)
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	var output []byte
+	for {
+		select {
+		case chunk, ok := <-sub.output:
+			if !ok {
+				return execResult{}, fmt.Errorf("machine console closed while the command was running")
+			}
+			output = append(output, chunk...)
+			if len(output) > maxExecOutputBytes {
+				interruptConsole(console)
+				return execResult{}, fmt.Errorf("command produced more than %d bytes of output", maxExecOutputBytes)
+			}
+			if result, ok := parseExecOutput(output, begin, endPattern); ok {
+				return result, nil
+			}
+		case <-timer.C:
+			// Interrupt the command so the console is usable again
+			interruptConsole(console)
+			return execResult{}, fmt.Errorf("command did not finish within %v", timeout)
+		}
+	}
+}
+
+// parseExecOutput extracts the command output and exit code once both sentinels were printed
+func parseExecOutput(output []byte, begin string, endPattern *regexp.Regexp) (execResult, bool) {
+	start := bytes.Index(output, []byte(begin))
+	if start < 0 {
+		return execResult{}, false
+	}
+	rest := output[start+len(begin):]
+	loc := endPattern.FindSubmatchIndex(rest)
+	if loc == nil {
+		return execResult{}, false
+	}
+	code, err := strconv.Atoi(string(rest[loc[2]:loc[3]]))
+	if err != nil {
+		return execResult{}, false
+	}
+
+	// Drop the line break after the begin sentinel and the echoed end command before the end sentinel
+	text := strings.ReplaceAll(string(rest[:loc[0]]), "\r\n", "\n")
+	text = strings.TrimPrefix(text, "\n")
+	if i := strings.LastIndex(text, "echo \"VMSHELL\"\"_END_"); i >= 0 {
+		text = text[:i]
+		if j := strings.LastIndex(text, "\n"); j >= 0 {
+			text = text[:j+1]
+		} else {
+			text = ""
+		}
+	}
+	return execResult{Output: text, ExitCode: code}, true
+}
+
+// interruptConsole sends Ctrl-C to the console
+func interruptConsole(console *consoleStream) {
+	if err := console.write([]byte{0x03}); err != nil {
+		slog.Error("Error interrupting console", "console", console.name, "err", err)
+	}
+}
@@ -0,0 +1,480 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// exportDir holds the bundles written by /admin/export and read by the import option, set with
+// -export-dir. Empty disables both.
+var exportDir string
+
+const (
+	exportTimeout  = 5 * time.Minute        // Bounds writing the RAM and device state of a session's machines
+	migratePoll    = 100 * time.Millisecond // How often the progress of an export is checked
+	qmpResumeLimit = 10 * time.Second       // How long resuming a machine after an export may take
+	bundleVersion  = 1                      // Format of the bundles this server writes and reads
+)
+
+// bundleManifestFile is the first file of a bundle, which is an uncompressed tar archive. The
+// state and disk of each machine follow it.
+const bundleManifestFile = "manifest.json"
+
+// bundleStateFile names a machine's RAM and device state, in QEMU's migration format, in a bundle
+func bundleStateFile(machineID string) string {
+	return "state-" + machineID
+}
+
+// bundleDiskFile names a machine's overlay, whose backing image is rebased on import, in a bundle
+func bundleDiskFile(machineID string) string {
+	return "disk-" + machineID + ".qcow2"
+}
+
+// bundleNamePattern matches the bundle names exportSession gives out, which are also the only
+// names the import option accepts, so they can't point outside exportDir
+var bundleNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// importOnlyKeys are the /create_session parameters allowed next to import. The session's other
+// options are the exported session's, since the saved state only fits the same virtual hardware.
+var importOnlyKeys = map[string]bool{"import": true, "token": true}
+
+// bundleManifest describes an exported session
+type bundleManifest struct {
+	Version   int        `json:"version"`
+	Session   string     `json:"session"` // ID of the exported session
+	CreatedAt time.Time  `json:"createdAt"`
+	Options   url.Values `json:"options"`  // The /create_session options of the exported session
+	Machines  []string   `json:"machines"` // IDs of the machines whose state and disk are in the bundle
+}
+
+// exportUnsupportedError is returned by exportSession for sessions that can't be exported
+type exportUnsupportedError struct {
+	reason string
+}
+
+func (e *exportUnsupportedError) Error() string {
+	return "session can't be exported: " + e.reason
+}
+
+// exportHandler writes a bundle of a session's machines: their RAM and device state, their disk
+// overlays, and the session's options. The machines are paused while the bundle is written.
+func exportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, errMethodNotAllowed, "Method not allowed")
+		return
+	}
+	if exportDir == "" {
+		writeJSONError(w, http.StatusForbidden, errExportDisabled, "Session export disabled")
+		return
+	}
+	sessionID, ok := sessionIDParam(w, r)
+	if !ok {
+		return
+	}
+	sessionsMu.RLock()
+	session, exists := sessions[sessionID]
+	sessionsMu.RUnlock()
+	if !exists {
+		writeJSONError(w, http.StatusNotFound, errSessionNotFound, "Session not found")
+		return
+	}
+
+	logger := requestLogger(r.Context()).With("session", sessionID)
+	name, resumeErr, err := exportSession(session)
+	// Even a failed export leaves the bundle complete or absent, but a machine that stays paused needs attention
+	if resumeErr != nil {
+		logger.Error("Error resuming machines after export", "err", resumeErr)
+	}
+	var unsupportedErr *exportUnsupportedError
+	switch {
+	case errors.As(err, &unsupportedErr):
+		writeJSONError(w, http.StatusConflict, errExportUnsupported, unsupportedErr.Error())
+		return
+	case errors.Is(err, errSessionClosed):
+		writeJSONError(w, http.StatusNotFound, errSessionNotFound, "Session not found")
+		return
+	case err != nil:
+		logger.Error("Error exporting session", "err", err)
+		writeJSONError(w, http.StatusInternalServerError, errExportFailed, err.Error())
+		return
+	}
+	logger.Info("Session exported", "bundle", name)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]any{"sessionID": sessionID, "bundle": name, "resumed": resumeErr == nil}); err != nil {
+		logger.Error("Error encoding JSON response", "err", err)
+	}
+}
+
+// exportSession pauses the session's machines, has QEMU write their state, bundles that with the
+// disk overlays, and resumes the machines. It returns the bundle's name, and separately the error
+// from resuming, which doesn't make the bundle any less usable.
+func exportSession(session *Session) (name string, resumeErr, err error) {
+	// Restarts and cleanup replace or remove the machines, so they must wait for the export
+	session.lifecycleMu.Lock()
+	defer session.lifecycleMu.Unlock()
+	if session.closed {
+		return "", nil, errSessionClosed
+	}
+	// Only overlays hold the guest's disk changes in a file of their own, and only sessions with
+	// snapshots=on have them along with the QMP control socket
+	if !session.opts.snapshots {
+		return "", nil, &exportUnsupportedError{reason: "it was not created with snapshots=on"}
+	}
+	sessionsMu.RLock()
+	ids := session.machineIDs()
+	sockets := make(map[string]string, len(ids))
+	procs := make(map[string]*machineProcess, len(ids))
+	for _, id := range ids {
+		sockets[id] = session.qmpSockets[id]
+		procs[id] = session.procs[id]
+	}
+	options := session.opts.params
+	sessionsMu.RUnlock()
+
+	// An import creates the machines the options ask for, so machines added or removed since can't be carried over
+	count := defaultMachineCount
+	if v := options.Get("machineCount"); v != "" {
+		count, _ = strconv.Atoi(v) // Validated when the session was created
+	}
+	if len(ids) != count {
+		return "", nil, &exportUnsupportedError{reason: "machines were added or removed after it was created"}
+	}
+	for i, id := range ids {
+		if id != strconv.Itoa(i+1) {
+			return "", nil, &exportUnsupportedError{reason: "machines were added or removed after it was created"}
+		}
+	}
+
+	conns := make(map[string]*qmpConn, len(ids))
+	defer func() {
+		for _, q := range conns {
+			if err := q.conn.Close(); err != nil {
+				slog.Error("Error closing QMP connection", "session", session.hash, "err", err)
+			}
+		}
+	}()
+	for _, id := range ids {
+		if procs[id] == nil || sockets[id] == "" {
+			return "", nil, &exportUnsupportedError{reason: fmt.Sprintf("machine %s is not running", id)}
+		}
+		if exited, _ := procs[id].exited(); exited {
+			return "", nil, &exportUnsupportedError{reason: fmt.Sprintf("machine %s is not running", id)}
+		}
+		q, err := dialQMP(sockets[id])
+		if err != nil {
+			return "", nil, fmt.Errorf("machine %s: %v", id, err)
+		}
+		conns[id] = q
+		if err := q.conn.SetDeadline(time.Now().Add(exportTimeout)); err != nil {
+			return "", nil, err
+		}
+	}
+
+	// Pausing every machine first makes the export a single point in time for the whole session
+	// and each disk consistent with its RAM. Whatever happens afterwards, the machines are resumed.
+	defer func() {
+		for _, id := range ids {
+			q := conns[id]
+			if err := q.conn.SetDeadline(time.Now().Add(qmpResumeLimit)); err != nil {
+				resumeErr = errors.Join(resumeErr, fmt.Errorf("machine %s: %v", id, err))
+				continue
+			}
+			if _, err := q.execute("cont", nil); err != nil {
+				resumeErr = errors.Join(resumeErr, fmt.Errorf("machine %s: %v", id, err))
+			}
+		}
+	}()
+	for _, id := range ids {
+		if _, err := conns[id].execute("stop", nil); err != nil {
+			return "", nil, fmt.Errorf("machine %s: %v", id, err)
+		}
+	}
+
+	files := make([][2]string, 0, 2*len(ids))
+	for _, id := range ids {
+		statePath := filepath.Join(session.workDir, fmt.Sprintf("export-%s.state", id))
+		defer func() {
+			if err := os.Remove(statePath); err != nil && !errors.Is(err, os.ErrNotExist) {
+				slog.Error("Error removing exported state", "session", session.hash, "path", statePath, "err", err)
+			}
+		}()
+		if _, err := conns[id].execute("migrate", map[string]string{"uri": "exec:cat > " + shellQuote(statePath)}); err != nil {
+			return "", nil, fmt.Errorf("machine %s: %v", id, err)
+		}
+		if err := awaitMigration(conns[id]); err != nil {
+			return "", nil, fmt.Errorf("machine %s: %v", id, err)
+		}
+		files = append(files, [2]string{bundleStateFile(id), statePath}, [2]string{bundleDiskFile(id), overlayPath(session, id)})
+	}
+
+	name = fmt.Sprintf("%s-%s", session.hash, time.Now().UTC().Format("20060102T150405"))
+	manifest := bundleManifest{Version: bundleVersion, Session: session.hash, CreatedAt: time.Now(), Options: options, Machines: ids}
+	if err := writeBundle(name, manifest, files); err != nil {
+		return "", nil, err
+	}
+	return name, nil, nil
+}
+
+// awaitMigration waits for the migration started on q to finish, cancelling it after exportTimeout
+func awaitMigration(q *qmpConn) error {
+	deadline := time.Now().Add(exportTimeout)
+	for {
+		result, err := q.execute("query-migrate", nil)
+		if err != nil {
+			return err
+		}
+		var info struct {
+			Status    string `json:"status"`
+			ErrorDesc string `json:"error-desc"`
+		}
+		if err := json.Unmarshal(result, &info); err != nil {
+			return fmt.Errorf("unexpected reply to query-migrate: %v", err)
+		}
+		switch info.Status {
+		case "completed":
+			return nil
+		case "failed", "cancelled":
+			return fmt.Errorf("saving the machine state %s: %s", info.Status, info.ErrorDesc)
+		}
+		if time.Now().After(deadline) {
+			if _, err := q.execute("migrate_cancel", nil); err != nil {
+				slog.Error("Error cancelling export", "err", err)
+			}
+			return fmt.Errorf("saving the machine state did not finish within %v", exportTimeout)
+		}
+		time.Sleep(migratePoll)
+	}
+}
+
+// bundlePath returns where the named bundle is stored
+func bundlePath(name string) string {
+	return filepath.Join(exportDir, name+".tar")
+}
+
+// writeBundle stores the manifest and the files, given as bundle name and path, as a bundle. It is
+// written under a temporary name and renamed when complete, so an import never sees a partial bundle.
+func writeBundle(name string, manifest bundleManifest, files [][2]string) (err error) {
+	path := bundlePath(name)
+	partial := path + ".partial"
+	f, err := os.OpenFile(partial, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to create bundle: %v", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = f.Close()          // Best effort
+			_ = os.Remove(partial) // Best effort
+		}
+	}()
+
+	tw := tar.NewWriter(f)
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	header := &tar.Header{Name: bundleManifestFile, Mode: 0o600, Size: int64(len(data)), ModTime: manifest.CreatedAt}
+	if err := tw.WriteHeader(header); err != nil {
+		return fmt.Errorf("failed to write bundle: %v", err)
+	}
+	if _, err := tw.Write(data); err != nil {
+		return fmt.Errorf("failed to write bundle: %v", err)
+	}
+	for _, file := range files {
+		if err := addBundleFile(tw, file[0], file[1]); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("failed to write bundle: %v", err)
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("failed to write bundle: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to write bundle: %v", err)
+	}
+	if err := os.Rename(partial, path); err != nil {
+		return fmt.Errorf("failed to store bundle: %v", err)
+	}
+	return nil
+}
+
+// addBundleFile copies the file at path into the bundle under name
+func addBundleFile(tw *tar.Writer, name, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open %s for the bundle: %v", name, err)
+	}
+	defer func() {
+		_ = f.Close() // Only read
+	}()
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to open %s for the bundle: %v", name, err)
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0o600, Size: info.Size(), ModTime: info.ModTime()}); err != nil {
+		return fmt.Errorf("failed to write bundle: %v", err)
+	}
+	if _, err := io.Copy(tw, f); err != nil {
+		return fmt.Errorf("failed to write %s to the bundle: %v", name, err)
+	}
+	return nil
+}
+
+// importQuery replaces the options of a /create_session request with import by those recorded in
+// the bundle. Invalid requests and unusable bundles yield an *optionsError.
+func importQuery(query url.Values) (url.Values, error) {
+	name := query.Get("import")
+	errs := &optionsError{}
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if !importOnlyKeys[key] {
+			errs.add(key, "%s can't be combined with import, the session gets the exported session's options", key)
+		}
+	}
+	switch {
+	case exportDir == "":
+		errs.add("import", "session import is not enabled on this server")
+	case !bundleNamePattern.MatchString(name):
+		errs.add("import", "invalid import: %q", name)
+	}
+	if len(errs.fields) > 0 {
+		return nil, errs
+	}
+
+	manifest, err := readBundleManifest(name)
+	if err != nil {
+		errs.add("import", "invalid import: %v", err)
+		return nil, errs
+	}
+	params := url.Values{}
+	for key, values := range manifest.Options {
+		params[key] = values
+	}
+	params.Set("import", name)
+	return params, nil
+}
+
+// readBundleManifest reads the manifest at the start of the named bundle
+func readBundleManifest(name string) (bundleManifest, error) {
+	var manifest bundleManifest
+	f, err := os.Open(bundlePath(name))
+	if errors.Is(err, os.ErrNotExist) {
+		return manifest, fmt.Errorf("bundle %q not found", name)
+	}
+	if err != nil {
+		return manifest, err
+	}
+	defer func() {
+		_ = f.Close() // Only read
+	}()
+
+	tr := tar.NewReader(f)
+	header, err := tr.Next()
+	if err != nil || header.Name != bundleManifestFile {
+		return manifest, fmt.Errorf("bundle %q is not a session bundle", name)
+	}
+	if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
+		return manifest, fmt.Errorf("bundle %q has an invalid manifest: %v", name, err)
+	}
+	if manifest.Version != bundleVersion {
+		return manifest, fmt.Errorf("bundle %q has version %d, this server reads version %d", name, manifest.Version, bundleVersion)
+	}
+	return manifest, nil
+}
+
+// unpackBundle extracts the state and disk of every machine in the session's import bundle into
+// its working directory and rebases the overlays onto this server's copy of the image. startMachine
+// then starts the machines from them instead of booting them.
+func unpackBundle(ctx context.Context, session *Session) error {
+	f, err := os.Open(bundlePath(session.opts.importBundle))
+	if err != nil {
+		return fmt.Errorf("failed to open bundle %s: %v", session.opts.importBundle, err)
+	}
+	defer func() {
+		_ = f.Close() // Only read
+	}()
+
+	ids := session.machineIDs()
+	incoming := make(map[string]string, len(ids))
+	targets := make(map[string]string, 2*len(ids))
+	for _, id := range ids {
+		incoming[id] = filepath.Join(session.workDir, fmt.Sprintf("import-%s.state", id))
+		targets[bundleStateFile(id)] = incoming[id]
+		targets[bundleDiskFile(id)] = overlayPath(session, id)
+	}
+	tr := tar.NewReader(f)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read bundle %s: %v", session.opts.importBundle, err)
+		}
+		path, ok := targets[header.Name]
+		if !ok || header.Typeflag != tar.TypeReg {
+			continue // The manifest was read already
+		}
+		if err := extractBundleFile(tr, path); err != nil {
+			return err
+		}
+		delete(targets, header.Name)
+	}
+	if len(targets) > 0 {
+		return fmt.Errorf("bundle %s is incomplete", session.opts.importBundle)
+	}
+
+	// The overlays still name the exporting server's path of the image
+	image, err := filepath.Abs(images[session.opts.image])
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if err := runCommandContext(ctx, "qemu-img", "rebase", "-u", "-f", "qcow2", "-F", "qcow2", "-b", image, overlayPath(session, id)); err != nil {
+			return fmt.Errorf("failed to rebase imported overlay of machine %s: %v", id, err)
+		}
+	}
+	session.incoming = incoming
+	return nil
+}
+
+// extractBundleFile writes the current entry of a bundle to path
+func extractBundleFile(r io.Reader, path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to unpack bundle: %v", err)
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		_ = f.Close() // Best effort
+		return fmt.Errorf("failed to unpack bundle: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to unpack bundle: %v", err)
+	}
+	return nil
+}
+
+// shellQuote quotes a value for /bin/sh, which runs the commands of QEMU's exec: migration URIs
+func shellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useExportDir points exportDir at a fresh directory for the duration of the test
+func useExportDir(t *testing.T) {
+	t.Helper()
+	previous := exportDir
+	exportDir = t.TempDir()
+	t.Cleanup(func() { exportDir = previous })
+}
+
+// writeTestBundle writes a bundle with placeholder state and disk files for the given machines
+func writeTestBundle(t *testing.T, name string, manifest bundleManifest) {
+	t.Helper()
+	dir := t.TempDir()
+	var files [][2]string
+	for _, id := range manifest.Machines {
+		for _, entry := range []string{bundleStateFile(id), bundleDiskFile(id)} {
+			path := filepath.Join(dir, entry)
+			if err := os.WriteFile(path, []byte(entry), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			files = append(files, [2]string{entry, path})
+		}
+	}
+	if err := writeBundle(name, manifest, files); err != nil {
+		t.Fatalf("writeBundle: %v", err)
+	}
+}
+
+func TestImportQueryTakesOptionsFromBundle(t *testing.T) {
+	useExportDir(t)
+	options := url.Values{"snapshots": {"on"}, "auxConsole": {"serial"}}
+	writeTestBundle(t, "3fa29b-20240101T090000", bundleManifest{
+		Version: bundleVersion, Session: "3fa29b", CreatedAt: time.Now(), Options: options, Machines: []string{"1", "2"},
+	})
+
+	params, err := importQuery(url.Values{"import": {"3fa29b-20240101T090000"}, "token": {"secret"}})
+	if err != nil {
+		t.Fatalf("importQuery: %v", err)
+	}
+	if params.Get("snapshots") != "on" || params.Get("auxConsole") != "serial" || params.Get("import") != "3fa29b-20240101T090000" {
+		t.Errorf("importQuery = %v, want the bundle's options and import", params)
+	}
+	if _, err := os.Stat(bundlePath("3fa29b-20240101T090000") + ".partial"); !os.IsNotExist(err) {
+		t.Errorf("partial bundle left behind: %v", err)
+	}
+}
+
+func TestImportQueryRejects(t *testing.T) {
+	useExportDir(t)
+	writeTestBundle(t, "old", bundleManifest{Version: bundleVersion + 1, Machines: []string{"1"}})
+
+	tests := []struct {
+		name  string
+		query url.Values
+		want  string
+	}{
+		{"other options", url.Values{"import": {"old"}, "snapshots": {"on"}}, "snapshots can't be combined with import"},
+		{"wait", url.Values{"import": {"old"}, "wait": {"true"}}, "wait can't be combined with import"},
+		{"path", url.Values{"import": {"../old"}}, "invalid import"},
+		{"missing bundle", url.Values{"import": {"missing"}}, "not found"},
+		{"other version", url.Values{"import": {"old"}}, "has version"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := importQuery(tt.query); err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("importQuery(%v) = %v, want an error containing %q", tt.query, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	if got, want := shellQuote(`/tmp/it's here`), `'/tmp/it'\''s here'`; got != want {
+		t.Errorf("shellQuote = %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+)
+
+// healthCheck is the outcome of a single readiness check
+type healthCheck struct {
+	Name  string `json:"name"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// healthzHandler reports whether the host can run sessions: the required binaries resolve,
+// every allow-listed image is readable, and KVM is accessible when VMs use it. Returns 503 if any check fails.
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	checks := []healthCheck{
+		runHealthCheck("binary:"+filepath.Base(qemuBinary), func() error {
+			_, err := exec.LookPath(qemuBinary)
+			return err
+		}),
+		runHealthCheck("binary:ip", func() error {
+			_, err := exec.LookPath("ip")
+			return err
+		}),
+	}
+	// TCG emulation doesn't need KVM
+	if qemuAccel == "kvm" {
+		checks = append(checks, runHealthCheck("kvm", func() error {
+			return checkReadableWritable("/dev/kvm")
+		}))
+	}
+
+	names := make([]string, 0, len(images))
+	for name := range images {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		path := images[name]
+		checks = append(checks, runHealthCheck("image:"+name, func() error {
+			return checkImageReadable(path)
+		}))
+	}
+
+	healthy := true
+	for _, check := range checks {
+		healthy = healthy && check.OK
+	}
+
+	status, code := "ok", http.StatusOK
+	if !healthy {
+		status, code = "unavailable", http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(map[string]any{"status": status, "checks": checks}); err != nil {
+		requestLogger(r.Context()).Error("Error encoding JSON response", "err", err)
+	}
+}
+
+// runHealthCheck runs a check and records its outcome
+func runHealthCheck(name string, check func() error) healthCheck {
+	if err := check(); err != nil {
+		return healthCheck{Name: name, Error: err.Error()}
+	}
+	return healthCheck{Name: name, OK: true}
+}
+
+// checkImageReadable verifies that a disk image is a regular file the server can open
+func checkImageReadable(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", path)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// checkReadableWritable verifies that a device can be opened for reading and writing
+func checkReadableWritable(path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// newTestSession registers a session with a single machine whose console is one end of a socket
+// pair and returns it with the other end, which stands in for the guest. Nothing is started on the host.
+func newTestSession(t *testing.T) (*Session, *os.File) {
+	t.Helper()
+	hash, err := generateShortHash(6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Non-blocking descriptors let Close interrupt a pending Read
+	for _, fd := range fds {
+		if err := syscall.SetNonblock(fd, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	console, guest := os.NewFile(uintptr(fds[0]), "console"), os.NewFile(uintptr(fds[1]), "guest")
+	stream := newConsoleStream("1", console, nil, &machineProcess{done: make(chan struct{})})
+	session := &Session{
+		hash:     hash,
+		nics:     map[string][]machineNIC{"1": {{tap: "tap1-" + hash, bridge: "br-" + hash}}},
+		consoles: map[string]*consoleStream{"1": stream},
+		clients:  make(map[*wsClient]struct{}),
+	}
+	go stream.run()
+
+	sessionsMu.Lock()
+	sessions[hash] = session
+	sessionsMu.Unlock()
+	t.Cleanup(func() {
+		sessionsMu.Lock()
+		delete(sessions, hash)
+		sessionsMu.Unlock()
+		_ = guest.Close()
+		_ = console.Close()
+	})
+	return session, guest
+}
+
+// dialTestConsole serves wsHandler and connects to machine 1 of the session over a WebSocket
+func dialTestConsole(t *testing.T, session *Session) *websocket.Conn {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(wsHandler))
+	t.Cleanup(server.Close)
+
+	dialer := websocket.Dialer{Subprotocols: []string{"vmshell.v1"}, HandshakeTimeout: 5 * time.Second}
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws?machine=1&sessionID=" + session.hash
+	conn, resp, err := dialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("dialing %s: %v", url, err)
+	}
+	_ = resp.Body.Close()
+	t.Cleanup(func() { _ = conn.Close() })
+	return conn
+}
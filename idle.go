@@ -0,0 +1,73 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// idleWarningLead is how long before an inactive session is reaped its clients are warned, set
+// with -idle-warning. 0 disables the warning.
+var idleWarningLead = time.Minute
+
+const idleWarningCheck = 5 * time.Second // How often idleWarner looks for sessions about to be reaped
+
+// idleWarner sends an idle_warning notification to the clients of every session that the cleaner
+// will reap within idleWarningLead, so the page can offer to keep it open with /extend_session.
+// Each idle period is warned about once; any activity starts a new one. Sessions about to reach
+// maxLifetime get a lifetime_warning in the same way.
+func idleWarner() {
+	ticker := time.NewTicker(idleWarningCheck)
+	defer ticker.Stop()
+
+	type warning struct {
+		session *Session
+		kind    string // Notification type, idle_warning or lifetime_warning
+		seconds int
+	}
+	for range ticker.C {
+		var warnings []warning
+		sessionsMu.Lock()
+		for _, session := range sessions {
+			if len(session.clients) == 0 {
+				continue
+			}
+			// The end of the session's lifetime is warned about once, as activity can't postpone it
+			if end, ok := sessionLifeEnd(session); ok && !session.lifeWarned && !session.pinned {
+				if remaining := time.Until(end); remaining <= idleWarningLead {
+					session.lifeWarned = true
+					warnings = append(warnings, warning{session, "lifetime_warning", secondsLeft(remaining)})
+				}
+			}
+
+			// Activity doesn't take sessionsMu, so read it once for a consistent view
+			lastActive := session.lastActivity()
+			if session.idleWarned.Equal(lastActive) {
+				continue
+			}
+			info := sessionReapInfo(session)
+			if info.ExpiresIn == nil {
+				continue // Pinned or never reaped
+			}
+			reapAt := lastActive.Add(session.timeout)
+			if info.ReapAt != nil {
+				reapAt = *info.ReapAt
+			}
+			remaining := time.Until(reapAt)
+			if remaining > idleWarningLead {
+				continue
+			}
+			session.idleWarned = lastActive
+			warnings = append(warnings, warning{session, "idle_warning", secondsLeft(remaining)})
+		}
+		sessionsMu.Unlock()
+
+		for _, w := range warnings {
+			notifyClients(w.session, map[string]any{"type": w.kind, "seconds": w.seconds})
+		}
+	}
+}
+
+// secondsLeft rounds a remaining time up to whole seconds, never below zero
+func secondsLeft(remaining time.Duration) int {
+	return int(math.Ceil(math.Max(remaining.Seconds(), 0)))
+}
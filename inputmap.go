@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// inputMapping is a single byte-sequence substitution applied to client input
+type inputMapping struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// loadInputMaps reads named input maps from a JSON file of the form
+//
+//	{"name": [{"from": "\u001b[3~", "to": "\u007f"}, ...]}
+//
+// Substitutions are applied in order within a single WebSocket message, so a sequence
+// only matches when the client sends it in one frame (which terminal emulators do for
+// escape sequences). Plain keystrokes that match no entry pass through unchanged.
+func loadInputMaps(path string) (map[string]*strings.Replacer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var raw map[string][]inputMapping
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+
+	maps := make(map[string]*strings.Replacer, len(raw))
+	for name, mappings := range raw {
+		if name == "" {
+			return nil, fmt.Errorf("input map with empty name in %s", path)
+		}
+		pairs := make([]string, 0, 2*len(mappings))
+		for i, m := range mappings {
+			if m.From == "" {
+				return nil, fmt.Errorf("input map %q entry %d has an empty \"from\" sequence", name, i)
+			}
+			pairs = append(pairs, m.From, m.To)
+		}
+		maps[name] = strings.NewReplacer(pairs...)
+	}
+	return maps, nil
+}
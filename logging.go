@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// setupLogging installs the default slog logger with the given level (debug, info, warn or error)
+// and format (text or json). What is still logged through the log package, such as log.Fatalf
+// on startup errors, is routed through it at info level.
+func setupLogging(level, format string) error {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("invalid log level %q (expected debug, info, warn or error)", level)
+	}
+
+	opts := &slog.HandlerOptions{Level: lvl}
+	var handler slog.Handler
+	switch strings.ToLower(format) {
+	case "text":
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	case "json":
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	default:
+		return fmt.Errorf("invalid log format %q (expected text or json)", format)
+	}
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+)
+
+// machineLimitError is returned by addMachine when the session already has maxMachines machines
+type machineLimitError struct {
+	limit int
+}
+
+func (e *machineLimitError) Error() string {
+	return fmt.Sprintf("the session already has the maximum of %d machines", e.limit)
+}
+
+// errSessionClosed is returned by addMachine, removeMachine and exportSession when the session was
+// closed while the request waited
+var errSessionClosed = errors.New("session closed")
+
+// errPersistentMachine is returned by addMachine for disk=persistent sessions, whose single machine
+// is the only writer of the image
+var errPersistentMachine = errors.New("sessions with disk=persistent have a single machine")
+
+// errRemoveLastMachine is returned by removeMachine for a session's only machine unless forced
+var errRemoveLastMachine = errors.New("refusing to remove the session's last machine")
+
+// addMachine adds a machine with the lowest free ID to a running session. It gets a NIC on the
+// session's first bridge only, like every machine in a session without the networks option.
+func addMachine(ctx context.Context, session *Session) (string, error) {
+	session.lifecycleMu.Lock()
+	defer session.lifecycleMu.Unlock()
+	if session.closed {
+		return "", errSessionClosed
+	}
+
+	if session.opts.diskPersistent {
+		return "", errPersistentMachine
+	}
+	if len(session.nics) >= maxMachines {
+		return "", &machineLimitError{limit: maxMachines}
+	}
+	// IDs freed by removeMachine are reused, so they stay single digits
+	machineNum := 1
+	for session.nics[strconv.Itoa(machineNum)] != nil {
+		machineNum++
+	}
+	opts := session.opts
+	opts.machineCount = 1
+	if err := checkHostMemory(opts); err != nil {
+		return "", err
+	}
+
+	machineID := strconv.Itoa(machineNum)
+	nic := primaryNIC(session.hash, machineID, session.opts)
+	if len(nic.tap) > 15 {
+		return "", fmt.Errorf("interface name too long: %s", nic.tap)
+	}
+	if err := createTAP(ctx, session, nic); err != nil {
+		removeTAP(session, nic)
+		return "", err
+	}
+
+	sessionsMu.Lock()
+	session.nics[machineID] = []machineNIC{nic}
+	session.opts.machineCount = len(session.nics)
+	sessionsMu.Unlock()
+	// Undoes the above if the machine doesn't come up
+	rollback := func() {
+		sessionsMu.Lock()
+		delete(session.nics, machineID)
+		session.opts.machineCount = len(session.nics)
+		sessionsMu.Unlock()
+		removeTAP(session, nic)
+		if err := setCgroupLimits(session); err != nil {
+			slog.Error("Error restoring cgroup limits", "session", session.hash, "err", err)
+		}
+	}
+
+	if err := setCgroupLimits(session); err != nil {
+		rollback()
+		return "", err
+	}
+	if !noVMs {
+		if err := startMachine(ctx, session, machineID); err != nil {
+			vmStartFailures.Inc()
+			rollback()
+			return "", err
+		}
+	}
+	saveSessionState(session)
+
+	restartDHCP(session)
+	if session.opts.recycleAfter > 0 && !noVMs {
+		scheduleRecycle(session, machineID)
+	}
+	return machineID, nil
+}
+
+// removeMachine stops a machine and removes it and its TAP devices from the session, leaving the
+// bridges and the other machines running. The session's last machine is only removed with force.
+func removeMachine(session *Session, machineID string, force bool) error {
+	session.lifecycleMu.Lock()
+	defer session.lifecycleMu.Unlock()
+	if session.closed {
+		return errSessionClosed
+	}
+	nics, ok := session.nics[machineID]
+	if !ok {
+		return fmt.Errorf("unknown machine %s", machineID)
+	}
+	if len(session.nics) == 1 && !force {
+		return errRemoveLastMachine
+	}
+
+	if timer := session.recycleTimers[machineID]; timer != nil {
+		timer.Stop()
+		delete(session.recycleTimers, machineID)
+	}
+	// Tell clients before their connections to the machine close
+	notifyClients(session, map[string]any{"type": "machine_removed", "machine": machineID})
+	stopMachine(session, machineID)
+	for _, nic := range nics {
+		removeTAP(session, nic)
+	}
+
+	sessionsMu.Lock()
+	delete(session.nics, machineID)
+	delete(session.procs, machineID)
+	delete(session.ptyFiles, machineID)
+	delete(session.auxPtys, machineID)
+	delete(session.serialPtys, machineID)
+	delete(session.consoleConns, machineID)
+	deleteConsoles(session, machineID)
+	delete(session.bootReady, machineID)
+	delete(session.qmpSockets, machineID)
+	session.opts.machineCount = len(session.nics)
+	sessionsMu.Unlock()
+
+	if err := setCgroupLimits(session); err != nil {
+		slog.Error("Error lowering cgroup limits", "session", session.hash, "machine", machineID, "err", err)
+	}
+	saveSessionState(session)
+	restartDHCP(session)
+	return nil
+}
+
+// removeTAP deletes a TAP device, ignoring one that doesn't exist
+func removeTAP(session *Session, nic machineNIC) {
+	if err := runCommand(session.ip("link", "delete", nic.tap)...); err != nil {
+		var cmdErr *commandError
+		if !errors.As(err, &cmdErr) || !cmdErr.deviceMissing() {
+			slog.Error("Error deleting TAP device", "session", session.hash, "tap", nic.tap, "err", err)
+		}
+	}
+}
+
+// removeMachineHandler removes a machine from an existing session. Removing the last one
+// requires force=true and leaves an empty session.
+func removeMachineHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, errMethodNotAllowed, "Method not allowed")
+		return
+	}
+	sessionID, ok := sessionIDParam(w, r)
+	if !ok {
+		return
+	}
+	machineID := r.URL.Query().Get("machine")
+	force := r.URL.Query().Get("force") == "true"
+
+	sessionsMu.RLock()
+	session := sessions[sessionID]
+	var known bool
+	if session != nil {
+		_, known = session.nics[machineID]
+	}
+	sessionsMu.RUnlock()
+	if session == nil {
+		writeJSONError(w, http.StatusNotFound, errSessionNotFound, "Session not found")
+		return
+	}
+	if !known {
+		writeJSONError(w, http.StatusBadRequest, errInvalidMachine, "Invalid machine ID")
+		return
+	}
+
+	err := removeMachine(session, machineID, force)
+	switch {
+	case errors.Is(err, errSessionClosed):
+		writeJSONError(w, http.StatusNotFound, errSessionNotFound, "Session not found")
+		return
+	case errors.Is(err, errRemoveLastMachine):
+		writeJSONError(w, http.StatusConflict, errLastMachine, "Refusing to remove the session's last machine without force=true")
+		return
+	case err != nil:
+		// Another request removed the machine in the meantime
+		writeJSONError(w, http.StatusBadRequest, errInvalidMachine, "Invalid machine ID")
+		return
+	}
+
+	requestLogger(r.Context()).Info("Machine removed", "session", sessionID, "machine", machineID)
+	w.WriteHeader(http.StatusOK)
+}
+
+// addMachineHandler adds a machine to an existing session and returns its ID. Clients already
+// attached to the session are told about it with a machine_added notification.
+func addMachineHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, errMethodNotAllowed, "Method not allowed")
+		return
+	}
+	sessionID, ok := sessionIDParam(w, r)
+	if !ok {
+		return
+	}
+	logger := requestLogger(r.Context()).With("session", sessionID)
+
+	sessionsMu.RLock()
+	session := sessions[sessionID]
+	sessionsMu.RUnlock()
+	if session == nil {
+		writeJSONError(w, http.StatusNotFound, errSessionNotFound, "Session not found")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), vmStartupTimeout)
+	defer cancel()
+	machineID, err := addMachine(ctx, session)
+	var limitErr *machineLimitError
+	var memErr *memoryPressureError
+	var startErr *machineStartError
+	switch {
+	case errors.Is(err, errSessionClosed):
+		writeJSONError(w, http.StatusNotFound, errSessionNotFound, "Session not found")
+		return
+	case errors.As(err, &limitErr):
+		writeJSONError(w, http.StatusConflict, errMachineLimit, limitErr.Error())
+		return
+	case errors.Is(err, errPersistentMachine):
+		writeJSONError(w, http.StatusConflict, errMachineLimit, "Sessions with disk=persistent have a single machine")
+		return
+	case errors.As(err, &memErr):
+		logger.Warn("Rejected adding a machine", "err", err)
+		writeJSONError(w, http.StatusServiceUnavailable, errInsufficientMemory, memErr.Error())
+		return
+	case errors.As(err, &startErr):
+		logger.Error("Error adding machine", "err", err)
+		writeJSONError(w, http.StatusInternalServerError, errAddMachineFailed, startErr.Error())
+		return
+	case err != nil:
+		logger.Error("Error adding machine", "err", err)
+		writeJSONError(w, http.StatusInternalServerError, errAddMachineFailed, "Error adding machine")
+		return
+	}
+
+	logger.Info("Machine added", "machine", machineID)
+	notifyClients(session, map[string]any{"type": "machine_added", "machine": machineID})
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]string{"machine": machineID}); err != nil {
+		logger.Error("Error encoding JSON response", "err", err)
+	}
+}
@@ -1,123 +1,840 @@
 package main
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
+	"log/slog"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode/utf8"
 
 	"github.com/creack/pty"
 	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-// Session represents the session structure
+// Session represents the session structure.
+//
+// Locking: the per-machine maps and client bookkeeping are guarded by sessionsMu. Anything that
+// replaces machines or tears down resources (restarts, network repairs, cleanup) also holds
+// lifecycleMu, taken before sessionsMu, so those operations never overlap. Map writers hold both
+// locks, sessionsMu for writing; readers hold either, and a read lock on sessionsMu is enough for
+// them. Each PTY is read only by its consoleStream, and everything else
+// goes through the stream. PTYs are non-blocking, so a Close from cleanup safely wakes the
+// stream with an error instead of leaving the descriptor open to reuse.
 type Session struct {
-	hash       string
-	bridgeName string
-	tapNames   map[string]string // Key - Machine ID, Value - TAP name
-	ptyFiles   map[string]*os.File
-	cmds       map[string]*exec.Cmd
-	lastActive time.Time // Last activity time
+	hash         string
+	bridgeName   string                  // First bridge, which every machine is on and which carries the address, NAT, DHCP, and VXLAN
+	bridges      []string                // Every bridge of the session, bridgeName first
+	netns        string                  // Network namespace holding the session's interfaces and VMs, "" for the host namespace
+	vxlanName    string                  // VXLAN interface enslaved to the bridge, "" when the session is host-local
+	subnet       *net.IPNet              // Subnet of the bridge address, nil when the bridge has no address
+	natRules     []iptablesRule          // iptables rules added for NAT, removed on cleanup
+	dnsmasq      *exec.Cmd               // DHCP server on the bridge, nil when DHCP is off
+	workDir      string                  // Per-session directory for temporary artifacts, removed on cleanup
+	nics         map[string][]machineNIC // Key - Machine ID, Value - its NICs in the order the guest sees them
+	ptyFiles     map[string]*os.File
+	auxPtys      map[string]*os.File        // Key - Machine ID, Value - PTY of the auxiliary console
+	serialPtys   map[string][]*os.File      // Key - Machine ID, Value - PTYs of the serial ports after the first, in order
+	consoleConns map[string]net.Conn        // Key - Machine ID, Value - connection to the console socket, only with -console-socket
+	consoles     map[string]*consoleStream  // Key - consoleKey, Value - output stream of that console
+	procs        map[string]*machineProcess // Key - Machine ID, Value - QEMU process
+	bootReady    map[string]bool            // Machines whose console reached the login prompt
+	clients      map[*wsClient]struct{}     // WebSockets currently attached to the session's machines
+	qmpSockets   map[string]string          // Key - Machine ID, Value - QMP control socket, only with the snapshots option or in the warm pool
+	incoming     map[string]string          // Key - Machine ID, Value - saved state it starts from instead of booting, only with the import option
+	pooled       bool                       // Started for the warm pool, whose sessions are paused until they are handed out
+	cgroup       string                     // cgroup v2 directory limiting the session's VMs, "" when cgroups are off
+	audit        *auditLog                  // Record of client input, nil when auditing is off
+	netRepairs   int                        // Network repairs attempted by the health checker in the current window
+	repairsSince time.Time                  // Start of the current repair window
+
+	lifecycleMu   sync.Mutex             // Serializes machine restarts with session cleanup
+	closed        bool                   // Set by cleanupSession, guarded by lifecycleMu
+	recycleTimers map[string]*time.Timer // Pending automatic recycles per machine, guarded by lifecycleMu
+	createdAt     time.Time              // Time the session was handed to its client, never updated afterwards
+	lastActive    atomic.Int64           // Last activity time in Unix nanoseconds, set with touch and read with lastActivity
+	idleWarned    time.Time              // lastActive of the idle period clients were last warned about
+	lifeWarned    bool                   // Clients were warned that the session reaches maxLifetime
+	timeout       time.Duration          // Inactivity timeout of this session, 0 disables reaping
+	pinned        bool                   // Pinned sessions are never reaped by the cleaner
+	opts          sessionOptions
+}
+
+// touch records activity on the session, which postpones reaping it
+func (s *Session) touch() {
+	s.lastActive.Store(time.Now().UnixNano())
+}
+
+// lastActivity returns the time of the session's last activity
+func (s *Session) lastActivity() time.Time {
+	return time.Unix(0, s.lastActive.Load())
+}
+
+// sessionOptions holds the per-session settings requested by the client
+type sessionOptions struct {
+	machineCount int        // Number of VMs in the session
+	memMB        int        // Guest memory size of each VM in megabytes
+	vcpus        int        // Number of virtual CPUs of each VM
+	image        string     // Name of the guest disk image in the images allow-list
+	memBacking   string     // "" for anonymous memory, "hugepages" for hugetlbfs-backed memory
+	numaNode     int        // Host NUMA node to bind guest memory to, -1 for no binding
+	auxConsole   string     // "" for none, "serial" for a second serial port, "virtio" for a virtio console
+	serialPorts  int        // Serial ports of each VM, the first being the main console; the others are the tty1 to tty3 channels
+	inputMap     string     // Name of the input map applied to client input, "" for none
+	template     string     // Name of the machine template adjusting the QEMU invocation, "" for none
+	hostname     string     // Hostname prefix given to the guests through cloud-init, "" for none
+	sshKey       string     // Public key authorized in the guests through cloud-init, "" for none
+	rtc          rtcOptions // Guest clock settings, defaulting to -rtc
+
+	// Bridge parameters, -1 keeps the kernel default
+	bridgeStp           int // STP state, 0 or 1
+	bridgeForwardDelay  int // STP forward delay in seconds
+	bridgeAgeingTime    int // FDB ageing time in seconds, 0 disables MAC learning
+	bridgeVlanFiltering int // VLAN filtering, 0 or 1
+
+	networks       [][]string      // Additional networks, each the IDs of the machines with a NIC on it
+	isolated       map[string]bool // Machines whose bridge ports are isolated from each other
+	vxlanID        int             // VXLAN network identifier joining the bridge to an overlay, 0 for none
+	vxlanRemote    string          // Unicast VXLAN peer, "" to use the -vxlan-group multicast group
+	nat            bool            // Give the bridge an address and NAT it out of -nat-uplink
+	dhcp           bool            // Give the bridge an address and run a DHCP server on it
+	diskOverlay    bool            // Give each machine its own qcow2 overlay file instead of running it with -snapshot
+	diskPersistent bool            // Write to the image itself, which is locked to the session; only with a single machine
+	snapshots      bool            // A QMP control socket so /snapshot can save and restore VM state; implies diskOverlay
+	importBundle   string          // Export bundle the machines are started from, "" to boot them
+
+	recycleAfter time.Duration // Uptime after which each VM is restarted from the pristine image, 0 disables
+	timeout      time.Duration // Inactivity timeout, defaults to -session-timeout
+
+	params url.Values // The options as requested, recorded in export bundles; nil when all are defaults
 }
 
 var (
 	sessions   = make(map[string]*Session)
-	sessionsMu sync.Mutex
-	upgrader   = websocket.Upgrader{
-		CheckOrigin: func(r *http.Request) bool { return true }, // Consider tightening in production
+	sessionsMu sync.RWMutex // Guards sessions and the per-session state documented on Session; read-only paths take RLock
+	// IDs of sessions being created but not yet in the map, guarded by sessionsMu
+	pendingSessions = make(map[string]struct{})
+	// IDs of recently closed sessions and when they were closed, guarded by sessionsMu
+	closedSessions = make(map[string]time.Time)
+	upgrader       = websocket.Upgrader{
+		CheckOrigin:  checkOrigin,
+		Subprotocols: wsProtocols,
 	}
-	sessionTimeout = 10 * time.Minute // Session timeout duration
+	sessionTimeout    = 10 * time.Minute // Session timeout duration
+	maxLifetime       time.Duration      // Age at which sessions are closed however active they are, 0 disables
+	maxSessionTimeout = 4 * time.Hour    // Upper bound for the per-session timeout option
+	hugepagesPath     = "/dev/hugepages" // hugetlbfs mount used for hugepage-backed guest memory
+	adminToken        string             // Shared secret for the /admin endpoints, empty disables them
+	allowedOrigins    []string           // Origins allowed to open WebSockets, empty means same host only
+	maxSessions       = 16               // Maximum number of concurrent sessions, 0 for no limit
+	maxMachines       = 8                // Upper bound for machineCount; machine IDs are single digits
+	minMemoryMB       = 128              // Lower bound for memMB
+	maxMemoryMB       = 4096             // Upper bound for memMB
+	maxVCPUs          = 4                // Upper bound for vcpus, further limited by the host's CPU count
+	maxSerialPorts    = 4                // Upper bound for serialPorts, the number of ISA serial ports QEMU emulates on x86
+
+	vmGracePeriod   = 10 * time.Second // How long QEMU may take to exit after SIGTERM before it is killed
+	cleanerInterval = 5 * time.Minute  // How often sessionCleaner looks for inactive sessions
+	cleanerNextRun  time.Time          // Time of the next sessionCleaner pass, guarded by sessionsMu
+
+	qemuBinary = "qemu-system-x86_64" // QEMU executable, looked up in PATH unless it contains a slash
+	qemuAccel  string                 // Accelerator passed to -accel, resolved from -accel at startup
+	noVMs      bool                   // Dry run: sessions get their networks but no VMs, for testing the plumbing without QEMU
+
+	vmStartupTimeout = 2 * time.Minute  // Longest /create_session may take to bring up a session's VMs
+	commandTimeout   = 10 * time.Second // Longest a host command run by runCommand, e.g. ip or iptables, may take
+
+	images       map[string]string // Allow-list of guest disk images, name -> path, loaded at startup and read-only afterwards
+	defaultImage = "debian-12"     // Image used when a session does not pick one
+
+	inputMaps = make(map[string]*strings.Replacer)           // Named input maps loaded at startup, read-only afterwards
+	templates = make(map[string]machineTemplate)             // Named machine templates loaded at startup, read-only afterwards
+	workRoot  = filepath.Join(os.TempDir(), "vm-web-shells") // Parent of the per-session working directories
+
+	consoleLogDir string // Directory receiving <session>-<machine>.log console copies, empty disables logging
+
+	useNetns   bool   // Give every session its own network namespace
+	vxlanDev   string // Uplink interface for VXLAN overlays, empty disables them
+	vxlanGroup string // Default multicast group for VXLAN overlays
+	vxlanPort  = 4789 // UDP destination port for VXLAN traffic
+)
+
+const (
+	shutdownTimeout      = 30 * time.Second       // Upper bound for cleaning up all sessions on shutdown
+	closedSessionMemory  = time.Hour              // How long /close_session reports a closed session as closed rather than unknown
+	sessionIDLength      = 6                      // Hex digits in a session ID
+	maxSessionIDAttempts = 16                     // Session IDs drawn before giving up on finding an unused one
+	minSessionTimeout    = time.Minute            // Lower bound for the per-session timeout option
+	defaultMachineCount  = 2                      // Number of VMs in a session unless machineCount is given
+	defaultMemoryMB      = 256                    // Guest memory size in megabytes unless memMB is given
+	maxReaderRestarts    = 5                      // Consecutive recoverable PTY read errors tolerated before giving up
+	readerRestartBackoff = 100 * time.Millisecond // Base delay before resuming a PTY read after a recoverable error
 )
 
+// ptyReaderRestarts counts PTY reads resumed after a recoverable error, reported by /admin/metrics and /metrics
+var ptyReaderRestarts atomic.Int64
+
 func main() {
+	addr := flag.String("addr", ":8080", "Address to listen on, e.g. 127.0.0.1:8080")
+	tlsCert := flag.String("tls-cert", "", "TLS certificate file, serves HTTPS when set together with -tls-key")
+	tlsKey := flag.String("tls-key", "", "TLS private key file, serves HTTPS when set together with -tls-cert")
+	flag.StringVar(&authToken, "auth-token", os.Getenv("AUTH_TOKEN"), "Bearer token required on every endpoint except the page itself (defaults to $AUTH_TOKEN, disabled when empty)")
+	flag.StringVar(&adminToken, "admin-token", "", "Shared secret required in the X-Admin-Token header for /admin endpoints (disabled when empty)")
+	flag.BoolVar(&crashTeardown, "crash-teardown", false, "Tear down a whole session when one of its VMs exits unexpectedly")
+	flag.DurationVar(&vmGracePeriod, "vm-grace-period", vmGracePeriod, "How long a VM may take to exit after SIGTERM before it is killed")
+	flag.IntVar(&maxSessions, "max-sessions", maxSessions, "Maximum number of concurrent sessions (0 for no limit)")
+	flag.IntVar(&warmPoolSize, "warm-pool", 0, "Number of sessions with the default options started ahead of time and handed out by /create_session without waiting for VMs to start (0 disables the pool)")
+	flag.IntVar(&maxMachines, "max-machines", maxMachines, "Maximum number of VMs per session (1-9)")
+	flag.IntVar(&minMemoryMB, "min-mem", minMemoryMB, "Minimum guest memory in MB a session may request")
+	flag.IntVar(&maxMemoryMB, "max-mem", maxMemoryMB, "Maximum guest memory in MB a session may request")
+	flag.IntVar(&memoryReserveMB, "memory-reserve", memoryReserveMB, "Host memory in MB that must stay available after a new session's guest memory is accounted for; sessions that would cut into it are refused (0 disables the check)")
+	flag.IntVar(&maxVCPUs, "max-vcpus", maxVCPUs, "Maximum number of vCPUs per VM a session may request")
+	flag.DurationVar(&sessionTimeout, "session-timeout", sessionTimeout, "Inactivity timeout after which sessions are reaped (0 disables inactivity reaping)")
+	flag.DurationVar(&maxLifetime, "max-lifetime", maxLifetime, "Age at which sessions are closed even if they are in use, e.g. 4h (0 disables)")
+	flag.DurationVar(&idleWarningLead, "idle-warning", idleWarningLead, "How long before an inactive session is reaped its clients get an idle_warning notification (0 disables the warning)")
+	flag.DurationVar(&maxSessionTimeout, "max-session-timeout", maxSessionTimeout, "Longest inactivity timeout a session may request with the timeout option")
+	originList := flag.String("allowed-origins", os.Getenv("ALLOWED_ORIGINS"), "Comma-separated origins allowed to open WebSockets, e.g. https://lab.example.com (defaults to $ALLOWED_ORIGINS, same host only when empty)")
+	flag.Int64Var(&maxUploadSize, "max-upload-size", maxUploadSize, "Maximum size in bytes of a file accepted by /upload")
+	flag.StringVar(&workRoot, "workdir", workRoot, "Directory under which each session gets its own working directory")
+	flag.StringVar(&stateDir, "state-dir", stateDir, "Directory for session records used to reclaim orphaned sessions after a crash (disabled when empty)")
+	flag.BoolVar(&reclaimInterfaces, "reclaim-interfaces", false, "At startup, delete bridges and TAP devices named like a session's that belong to no known session")
+	flag.StringVar(&cgroupParent, "cgroup-parent", "", "cgroup v2 directory under which each session's VMs get a cgroup with memory and CPU limits, e.g. /sys/fs/cgroup/vm-web-shells (disabled when empty)")
+	flag.IntVar(&cgroupMemOverhead, "cgroup-mem-overhead", cgroupMemOverhead, "Memory in MB each VM may use beyond its guest RAM before the session's cgroup limit applies")
+	flag.IntVar(&cgroupCPUPercent, "cgroup-cpu", cgroupCPUPercent, "Host CPU time each vCPU may use, in percent of one CPU (0 for no limit)")
+	flag.StringVar(&vxlanDev, "vxlan-dev", "", "Uplink interface for sessions that join a VXLAN overlay (disabled when empty)")
+	flag.StringVar(&vxlanGroup, "vxlan-group", "", "Multicast group used by VXLAN overlays without an explicit vxlanRemote")
+	flag.IntVar(&vxlanPort, "vxlan-port", vxlanPort, "UDP destination port for VXLAN traffic")
+	flag.StringVar(&natUplink, "nat-uplink", "", "Host interface that sessions with nat=on masquerade out of, e.g. eth0 (disabled when empty)")
+	flag.BoolVar(&useNetns, "netns", false, "Run each session's bridge, TAP devices, and VMs inside a dedicated network namespace")
+	flag.BoolVar(&qmpEvents, "qmp-events", false, "Attach a QMP socket to every VM and forward its state-change events to WebSocket clients")
+	flag.StringVar(&exportDir, "export-dir", "", "Directory for the session bundles written by /admin/export and read by the import option (disabled when empty)")
+	flag.DurationVar(&netHealthInterval, "net-health-interval", 0, "How often to verify and repair session networks (0 disables the health check)")
+	flag.IntVar(&maxNetRepairs, "net-max-repairs", maxNetRepairs, "Maximum network repairs attempted per session within -net-repair-window")
+	flag.DurationVar(&netRepairWindow, "net-repair-window", netRepairWindow, "Period over which -net-max-repairs is counted")
+	imageList := flag.String("images", "debian-12=debian-12-nocloud-amd64.qcow2", "Comma-separated allow-list of guest images as name=path")
+	persistentList := flag.String("persistent-images", "", "Comma-separated names of images that sessions may open writable with disk=persistent")
+	flag.StringVar(&defaultImage, "default-image", defaultImage, "Name of the image used when a session does not pick one")
+	rtcSpec := flag.String("rtc", "", "Default guest clock settings as QEMU -rtc keys, e.g. base=2024-01-01,clock=vm (empty keeps QEMU's defaults)")
+	flag.BoolVar(&consoleSockets, "console-socket", consoleSockets, "Connect each VM's main serial port to a Unix socket the server dials instead of QEMU's stdio")
+	flag.IntVar(&consoleReadSize, "pty-read-size", consoleReadSize, "Bytes read from a VM console PTY at a time")
+	flag.DurationVar(&coalesceInterval, "ws-flush-interval", coalesceInterval, "How long console output is batched into one WebSocket frame after the previous frame (0 sends every read right away)")
+	flag.IntVar(&coalesceSize, "ws-frame-size", coalesceSize, "Batched console output is sent once it reaches this many bytes")
+	flag.IntVar(&subscriberQueue, "ws-queue-depth", subscriberQueue, "Console output chunks queued per WebSocket connection before output for a slow client is coalesced and eventually dropped")
+	flag.BoolVar(&wsCompression, "ws-compression", wsCompression, "Compress WebSocket messages with permessage-deflate for clients that support it")
+	flag.IntVar(&maxSessionClients, "ws-max-per-session", maxSessionClients, "Maximum concurrent WebSocket connections to one session (0 for no limit)")
+	flag.IntVar(&maxMachineClients, "ws-max-per-machine", maxMachineClients, "Maximum concurrent WebSocket connections to one machine (0 for no limit)")
+	flag.StringVar(&qemuBinary, "qemu-binary", qemuBinary, "QEMU executable used to run the VMs")
+	flag.BoolVar(&noVMs, "no-vm", false, "Dry run: set up each session's network but don't start its VMs, e.g. to test the network plumbing on hosts without QEMU or KVM")
+	flag.DurationVar(&vmStartupTimeout, "startup-timeout", vmStartupTimeout, "How long session creation may take before it is aborted and its resources reclaimed")
+	flag.DurationVar(&commandTimeout, "command-timeout", commandTimeout, "How long a host command such as ip or iptables may run before it is killed")
+	accel := flag.String("accel", "kvm", "QEMU accelerator: kvm, tcg, or auto to use KVM when /dev/kvm is accessible and TCG otherwise")
+	flag.StringVar(&consoleLogDir, "console-log-dir", "", "Directory to record each VM's console output to (disabled when empty)")
+	flag.StringVar(&auditDir, "audit-dir", "", "Directory to record the input clients send to each session's VMs to (disabled when empty)")
+	inputMapsFile := flag.String("input-maps", "", "JSON file with named input maps that sessions can select via inputMap")
+	templatesFile := flag.String("machine-templates", "", "JSON file with named machine templates of extra QEMU options that sessions can select via template")
+	logLevel := flag.String("log-level", "info", "Minimum level of log messages: debug, info, warn or error")
+	logFormat := flag.String("log-format", "text", "Log output format: text, or json for log aggregation")
+	configFile := flag.String("config", "", "JSON file of settings keyed by flag name; flags given on the command line take precedence")
+	flag.Parse()
+
+	if *configFile != "" {
+		config, err := loadConfig(*configFile)
+		if err != nil {
+			log.Fatalf("Failed to load config: %v", err)
+		}
+		if err := config.apply(flag.CommandLine); err != nil {
+			log.Fatalf("Invalid config %s: %v", *configFile, err)
+		}
+	}
+
+	if err := setupLogging(*logLevel, *logFormat); err != nil {
+		log.Fatalf("Invalid logging flags: %v", err)
+	}
+
+	if consoleLogDir != "" {
+		if err := os.MkdirAll(consoleLogDir, 0o700); err != nil {
+			log.Fatalf("Failed to create console log directory: %v", err)
+		}
+	}
+	if auditDir != "" {
+		if err := os.MkdirAll(auditDir, 0o700); err != nil {
+			log.Fatalf("Failed to create audit directory: %v", err)
+		}
+	}
+
+	var err error
+	if images, err = parseImageList(*imageList); err != nil {
+		log.Fatalf("Invalid -images: %v", err)
+	}
+	if _, ok := images[defaultImage]; !ok {
+		log.Fatalf("Default image %q is not in the -images allow-list", defaultImage)
+	}
+	if defaultRTC, err = parseRTC(*rtcSpec); err != nil {
+		log.Fatalf("Invalid -rtc %q: %v", *rtcSpec, err)
+	}
+	if persistentImages, err = parsePersistentImages(*persistentList); err != nil {
+		log.Fatalf("Invalid -persistent-images: %v", err)
+	}
+	// Catch a missing or unreadable image now rather than when the first session using it fails.
+	// Without the default image most sessions can't start; the others only affect sessions that
+	// ask for them, and may yet appear, so they only get a warning. Dry runs use no images.
+	if !noVMs {
+		for name, path := range images {
+			if err := checkImageReadable(path); err != nil {
+				if name == defaultImage {
+					log.Fatalf("Default image %q is unusable: %v", name, err)
+				}
+				slog.Warn("Image is unusable, sessions using it will fail", "image", name, "err", err)
+			}
+		}
+	}
+
+	if allowedOrigins, err = parseOriginList(*originList); err != nil {
+		log.Fatalf("Invalid -allowed-origins: %v", err)
+	}
+
+	upgrader.EnableCompression = wsCompression
+
+	if (*tlsCert == "") != (*tlsKey == "") {
+		log.Fatalf("-tls-cert and -tls-key must be given together")
+	}
+	useTLS := *tlsCert != ""
+
+	if noVMs {
+		slog.Info("Dry run: sessions get their networks but no VMs are started")
+	} else {
+		if qemuAccel, err = resolveAccel(*accel); err != nil {
+			log.Fatalf("Invalid -accel: %v", err)
+		}
+		slog.Info("Running VMs", "qemu", qemuBinary, "accel", qemuAccel)
+	}
+
+	if maxMachines < 1 || maxMachines > 9 {
+		log.Fatalf("Invalid -max-machines %d: must be between 1 and 9", maxMachines)
+	}
+	if minMemoryMB < 1 || minMemoryMB > defaultMemoryMB || maxMemoryMB < defaultMemoryMB {
+		log.Fatalf("Invalid memory limits -min-mem %d / -max-mem %d: the default of %d MB must lie within them", minMemoryMB, maxMemoryMB, defaultMemoryMB)
+	}
+	if sessionTimeout < 0 {
+		log.Fatalf("Invalid -session-timeout %v: must be zero or positive", sessionTimeout)
+	}
+	if consoleReadSize < 1 {
+		log.Fatalf("Invalid -pty-read-size %d: must be positive", consoleReadSize)
+	}
+	if coalesceInterval < 0 || coalesceSize < 1 {
+		log.Fatalf("Invalid -ws-flush-interval %v / -ws-frame-size %d: the interval must not be negative and the size must be positive", coalesceInterval, coalesceSize)
+	}
+	if subscriberQueue < 1 {
+		log.Fatalf("Invalid -ws-queue-depth %d: must be positive", subscriberQueue)
+	}
+	if vmStartupTimeout <= 0 {
+		log.Fatalf("Invalid -startup-timeout %v: must be positive", vmStartupTimeout)
+	}
+	if commandTimeout <= 0 {
+		log.Fatalf("Invalid -command-timeout %v: must be positive", commandTimeout)
+	}
+	if maxSessionTimeout <= 0 {
+		log.Fatalf("Invalid -max-session-timeout %v: must be positive", maxSessionTimeout)
+	}
+	if maxLifetime < 0 {
+		log.Fatalf("Invalid -max-lifetime %v: must be zero or positive", maxLifetime)
+	}
+	if netRepairWindow <= 0 {
+		log.Fatalf("Invalid -net-repair-window %v: must be positive", netRepairWindow)
+	}
+	if sessionTimeout == 0 {
+		slog.Info("Inactivity reaping disabled; sessions end only when closed explicitly")
+	}
+
+	if exportDir != "" {
+		if err := os.MkdirAll(exportDir, 0o700); err != nil {
+			log.Fatalf("Failed to create export directory: %v", err)
+		}
+	}
+
+	if natUplink != "" {
+		if _, err := net.InterfaceByName(natUplink); err != nil {
+			log.Fatalf("Invalid -nat-uplink %q: %v", natUplink, err)
+		}
+		if err := checkIPForwarding(); err != nil {
+			log.Fatalf("NAT requires IP forwarding: %v", err)
+		}
+	}
+
+	if *inputMapsFile != "" {
+		maps, err := loadInputMaps(*inputMapsFile)
+		if err != nil {
+			log.Fatalf("Failed to load input maps: %v", err)
+		}
+		inputMaps = maps
+		slog.Info("Loaded input maps", "count", len(maps), "path", *inputMapsFile)
+	}
+
+	if *templatesFile != "" {
+		loaded, err := loadMachineTemplates(*templatesFile)
+		if err != nil {
+			log.Fatalf("Failed to load machine templates: %v", err)
+		}
+		templates = loaded
+		slog.Info("Loaded machine templates", "count", len(loaded), "path", *templatesFile)
+	}
+
+	if cgroupParent != "" {
+		if cgroupMemOverhead < 0 || cgroupCPUPercent < 0 {
+			log.Fatalf("-cgroup-mem-overhead and -cgroup-cpu must not be negative")
+		}
+		if err := setupCgroupParent(); err != nil {
+			log.Fatalf("Invalid -cgroup-parent: %v", err)
+		}
+	}
+
+	// Reclaim bridges and TAPs of sessions a crashed predecessor left behind before creating new ones
+	if err := recoverSessions(); err != nil {
+		log.Fatalf("Failed to recover sessions: %v", err)
+	}
+	// Interfaces without a record, e.g. from a run without -state-dir, are only reclaimed on request,
+	// since on a shared host they might belong to someone else
+	if reclaimInterfaces {
+		if err := reclaimOrphanInterfaces(); err != nil {
+			log.Fatalf("Failed to reclaim orphaned interfaces: %v", err)
+		}
+	}
+
 	http.HandleFunc("/", indexHandler)
 	http.HandleFunc("/ws", wsHandler)
 	http.HandleFunc("/create_session", createSessionHandler)
 	http.HandleFunc("/close_session", closeSessionHandler)
+	http.HandleFunc("/extend_session", extendSessionHandler)
+	http.HandleFunc("/upload", uploadHandler)
+	http.HandleFunc("/exec", execHandler)
+	http.HandleFunc("/scrollback", scrollbackHandler)
+	http.HandleFunc("/stats", statsHandler)
+	http.HandleFunc("/reset", resetHandler)
+	http.HandleFunc("/add_machine", addMachineHandler)
+	http.HandleFunc("/remove_machine", removeMachineHandler)
+	http.HandleFunc("/snapshot/save", snapshotHandler(true))
+	http.HandleFunc("/snapshot/restore", snapshotHandler(false))
+	http.HandleFunc("/healthz", healthzHandler)
+	http.Handle("/metrics", promhttp.Handler())
+	http.HandleFunc("/sessions", requireAdmin(listSessionsHandler))
+	http.HandleFunc("/session/info", sessionInfoHandler)
+	http.HandleFunc("/admin/sessions", requireAdmin(adminSessionsHandler))
+	http.HandleFunc("/admin/metrics", requireAdmin(adminMetricsHandler))
+	http.HandleFunc("/admin/pin", requireAdmin(adminPinHandler(true)))
+	http.HandleFunc("/admin/unpin", requireAdmin(adminPinHandler(false)))
+	http.HandleFunc("/admin/kill", requireAdmin(adminKillHandler))
+	http.HandleFunc("/admin/export", requireAdmin(exportHandler))
 
 	// Start a goroutine for periodic cleanup of inactive sessions
 	go sessionCleaner()
 
-	fmt.Println("Server started on port :8080")
-	if err := http.ListenAndServe(":8080", nil); err != nil {
+	if idleWarningLead > 0 {
+		go idleWarner()
+	}
+
+	if netHealthInterval > 0 {
+		go networkHealthChecker(netHealthInterval)
+	}
+
+	if warmPoolSize < 0 {
+		log.Fatalf("Invalid -warm-pool %d: must not be negative", warmPoolSize)
+	}
+	if warmPoolSize > 0 {
+		if warmPoolOptions, err = defaultSessionOptions(); err != nil {
+			log.Fatalf("Invalid default session options for the warm pool: %v", err)
+		}
+		go maintainWarmPool()
+	}
+
+	// Listen before serving so the resolved address (e.g. for port 0) can be reported
+	listener, err := net.Listen("tcp", *addr)
+	if err != nil {
 		log.Fatalf("Server failed to start: %v", err)
 	}
+	server := &http.Server{Addr: *addr, Handler: withRequestID(requireAuth(http.DefaultServeMux))}
+	go func() {
+		var err error
+		if useTLS {
+			fmt.Printf("Server started on %s (TLS enabled)\n", listener.Addr())
+			err = server.ServeTLS(listener, *tlsCert, *tlsKey)
+		} else {
+			fmt.Printf("Server started on %s (TLS disabled)\n", listener.Addr())
+			err = server.Serve(listener)
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("Server failed: %v", err)
+		}
+	}()
+
+	// Wait for a termination signal, then release every session's VMs and interfaces
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-stop
+	slog.Info("Shutting down", "signal", sig)
+	shutdown(server)
+}
+
+// shutdown stops accepting requests and cleans up all sessions, bounded by shutdownTimeout
+// so a stuck QEMU process can't block the exit forever
+func shutdown(server *http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	if err := server.Shutdown(ctx); err != nil {
+		slog.Error("Error shutting down HTTP server", "err", err)
+	}
+
+	sessionsMu.Lock()
+	remaining := make([]*Session, 0, len(sessions))
+	for _, session := range sessions {
+		remaining = append(remaining, session)
+		removeSession(session)
+	}
+	sessionsMu.Unlock()
+	remaining = append(remaining, drainWarmPool()...)
+
+	done := make(chan struct{})
+	go func() {
+		var wg sync.WaitGroup
+		for _, session := range remaining {
+			wg.Add(1)
+			go func(session *Session) {
+				defer wg.Done()
+				cleanupSession(session)
+				sessionsClosed.WithLabelValues(closeReasonShutdown).Inc()
+			}(session)
+		}
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		slog.Info("All sessions cleaned up", "count", len(remaining))
+	case <-ctx.Done():
+		slog.Warn("Timed out cleaning up sessions, exiting anyway", "timeout", shutdownTimeout)
+	}
 }
 
 // indexHandler handles the root route and returns the HTML page
-func indexHandler(w http.ResponseWriter, _ *http.Request) {
+func indexHandler(w http.ResponseWriter, r *http.Request) {
 	html, err := os.ReadFile("index.html")
 	if err != nil {
-		http.Error(w, "Error reading HTML file", http.StatusInternalServerError)
-		log.Printf("Error reading index.html: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, errInternal, "Error reading HTML file")
+		requestLogger(r.Context()).Error("Error reading index.html", "err", err)
 		return
 	}
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 	if _, err := w.Write(html); err != nil {
-		log.Printf("Error writing HTML response: %v", err)
+		requestLogger(r.Context()).Error("Error writing HTML response", "err", err)
 	}
 }
 
-// createSessionHandler creates a new session and returns the sessionID
-func createSessionHandler(w http.ResponseWriter, _ *http.Request) {
-	session, err := createSession()
+// createSessionHandler creates a new session and returns the sessionID. Options come from a JSON
+// CreateSessionRequest body or, without one, from the query parameters.
+func createSessionHandler(w http.ResponseWriter, r *http.Request) {
+	var opts sessionOptions
+	query, err := createSessionParams(w, r)
+	// Bundles hold the memory of someone else's session, so only admins may import them
+	if err == nil && query.Get("import") != "" {
+		if !adminAuthorized(w, r) {
+			return
+		}
+		query, err = importQuery(query)
+	}
+	if err == nil {
+		opts, err = parseSessionOptions(query)
+	}
+	var optsErr *optionsError
+	if errors.As(err, &optsErr) {
+		writeJSONFieldErrors(w, http.StatusBadRequest, errInvalidOptions, optsErr)
+		return
+	}
+
+	wait := query.Get("wait") == "true"
+	waitTimeout := bootWaitTimeout
+	if v := query.Get("waitTimeout"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 || d > bootWaitTimeout {
+			writeJSONError(w, http.StatusBadRequest, errInvalidWaitTimeout, fmt.Sprintf("Invalid waitTimeout (expected a duration up to %v)", bootWaitTimeout))
+			return
+		}
+		waitTimeout = d
+	}
+
+	logger := requestLogger(r.Context())
+
+	// Creation is abandoned, and everything started so far torn down, when the client goes away
+	// or startup takes longer than vmStartupTimeout
+	ctx, cancel := context.WithTimeout(r.Context(), vmStartupTimeout)
+	defer cancel()
+	session, err := createSession(ctx, opts)
+	var limitErr *sessionLimitError
+	if errors.As(err, &limitErr) {
+		logger.Warn("Rejected session creation", "err", err)
+		writeJSONError(w, http.StatusTooManyRequests, errTooManySessions, limitErr.Error())
+		return
+	}
+	var memErr *memoryPressureError
+	if errors.As(err, &memErr) {
+		logger.Warn("Rejected session creation", "err", err)
+		writeJSONError(w, http.StatusServiceUnavailable, errInsufficientMemory, memErr.Error())
+		return
+	}
+	var lockErr *imageLockedError
+	if errors.As(err, &lockErr) {
+		logger.Warn("Rejected session creation", "err", err)
+		writeJSONError(w, http.StatusConflict, errImageLocked, lockErr.Error())
+		return
+	}
+	// QEMU's reason for failing to start is sanitized and worth showing; other errors may reveal host details
+	var startErr *machineStartError
+	if errors.As(err, &startErr) {
+		logger.Error("Error creating session", "err", err)
+		writeJSONError(w, http.StatusInternalServerError, errSessionCreate, startErr.Error())
+		return
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		logger.Error("Error creating session", "err", err)
+		writeJSONError(w, http.StatusGatewayTimeout, errSessionCreate, fmt.Sprintf("Session startup did not finish within %v", vmStartupTimeout))
+		return
+	}
 	if err != nil {
-		log.Printf("Error creating session: %v", err)
-		http.Error(w, "Error creating session", http.StatusInternalServerError)
+		logger.Error("Error creating session", "err", err)
+		writeJSONError(w, http.StatusInternalServerError, errSessionCreate, "Error creating session")
 		return
 	}
+
+	// List the machines so clients don't have to assume how many there are
+	sessionsMu.RLock()
+	machines := make([]string, 0, len(session.ptyFiles))
+	for id := range session.ptyFiles {
+		machines = append(machines, id)
+	}
+	sessionsMu.RUnlock()
+	sort.Strings(machines)
+
+	response := map[string]any{"sessionID": session.hash, "machines": machines}
+	if wait {
+		// Block until every machine shows its login prompt, returning the session anyway on timeout
+		ready := waitForSessionBoot(session, time.Now().Add(waitTimeout))
+		allReady := true
+		for _, ok := range ready {
+			allReady = allReady && ok
+		}
+		response["ready"] = allReady
+		response["bootReady"] = ready
+	}
+
 	// Return sessionID in JSON response
 	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(map[string]string{"sessionID": session.hash}); err != nil {
-		log.Printf("Error encoding JSON response: %v", err)
-		http.Error(w, "Error creating session", http.StatusInternalServerError)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		logger.Error("Error encoding JSON response", "err", err)
+		writeJSONError(w, http.StatusInternalServerError, errSessionCreate, "Error creating session")
 	}
 }
 
 // closeSessionHandler terminates the session and cleans up resources
 func closeSessionHandler(w http.ResponseWriter, r *http.Request) {
-	sessionID := r.URL.Query().Get("sessionID")
-	if sessionID == "" {
-		http.Error(w, "Missing sessionID", http.StatusBadRequest)
+	sessionID, ok := sessionIDParam(w, r)
+	if !ok {
 		return
 	}
 
 	sessionsMu.Lock()
 	session, exists := sessions[sessionID]
 	if !exists {
+		_, closed := closedSessions[sessionID]
 		sessionsMu.Unlock()
-		http.Error(w, "Session not found", http.StatusNotFound)
+		// Tell a client that lost a race with another close, or with the cleaner, that the session did exist
+		if closed {
+			writeJSONError(w, http.StatusConflict, errSessionAlreadyClosed, "Session already closed")
+			return
+		}
+		writeJSONError(w, http.StatusNotFound, errSessionNotFound, "Session not found")
 		return
 	}
-	delete(sessions, sessionID)
+	removeSession(session)
 	sessionsMu.Unlock()
 
 	// Clean up session resources
 	cleanupSession(session)
-	log.Printf("Session %s terminated by client request", sessionID)
+	sessionsClosed.WithLabelValues(closeReasonClient).Inc()
+	requestLogger(r.Context()).Info("Session terminated by client request", "session", sessionID)
 	w.WriteHeader(http.StatusOK)
 }
 
+// extendSessionHandler marks a session as active so clients that only watch output aren't reaped
+func extendSessionHandler(w http.ResponseWriter, r *http.Request) {
+	sessionID, ok := sessionIDParam(w, r)
+	if !ok {
+		return
+	}
+
+	sessionsMu.Lock()
+	session, exists := sessions[sessionID]
+	if !exists {
+		sessionsMu.Unlock()
+		writeJSONError(w, http.StatusNotFound, errSessionNotFound, "Session not found")
+		return
+	}
+	session.touch()
+	info := sessionReapInfo(session)
+	sessionsMu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(info); err != nil {
+		requestLogger(r.Context()).Error("Error encoding JSON response", "err", err)
+	}
+}
+
+// sessionSummary is the public description of a session returned by /sessions
+type sessionSummary struct {
+	SessionID  string            `json:"sessionID"`
+	BridgeName string            `json:"bridgeName"`
+	Bridges    []string          `json:"bridges"` // Every bridge, bridgeName first
+	Machines   []string          `json:"machines"`
+	Exited     map[string]string `json:"exited,omitempty"`  // Exit status of machines whose QEMU process is gone
+	Gateway    string            `json:"gateway,omitempty"` // Bridge address in CIDR notation, for guests to configure
+	CreatedAt  time.Time         `json:"createdAt"`
+	Uptime     float64           `json:"uptime"` // Seconds since the session was created
+	LastActive time.Time         `json:"lastActive"`
+}
+
+// listSessionsHandler returns all active sessions as a JSON array
+func listSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	// Copy what we need under the lock and encode after releasing it
+	sessionsMu.RLock()
+	summaries := make([]sessionSummary, 0, len(sessions))
+	for _, session := range sessions {
+		machines := session.machineIDs()
+		summary := sessionSummary{
+			SessionID:  session.hash,
+			BridgeName: session.bridgeName,
+			Bridges:    session.bridges,
+			Machines:   machines,
+			CreatedAt:  session.createdAt,
+			Uptime:     time.Since(session.createdAt).Seconds(),
+			LastActive: session.lastActivity(),
+		}
+		for _, id := range machines {
+			exited, status := true, "not running" // A machine that failed to restart has no process
+			if proc, ok := session.procs[id]; ok {
+				exited, status = proc.exited()
+			}
+			if exited {
+				if summary.Exited == nil {
+					summary.Exited = make(map[string]string)
+				}
+				summary.Exited[id] = status
+			}
+		}
+		if session.subnet != nil {
+			summary.Gateway = gatewayAddress(session.subnet)
+		}
+		summaries = append(summaries, summary)
+	}
+	sessionsMu.RUnlock()
+
+	sort.Slice(summaries, func(i, j int) bool { return summaries[i].SessionID < summaries[j].SessionID })
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(summaries); err != nil {
+		requestLogger(r.Context()).Error("Error encoding JSON response", "err", err)
+	}
+}
+
 // wsHandler handles WebSocket connections
 func wsHandler(w http.ResponseWriter, r *http.Request) {
-	sessionID := r.URL.Query().Get("sessionID")
+	sessionID, ok := sessionIDParam(w, r)
+	if !ok {
+		return
+	}
 	machineID := r.URL.Query().Get("machine")
+	frames := r.URL.Query().Get("frames")
+	channel := r.URL.Query().Get("channel")
+	termType := r.URL.Query().Get("term")
+	mode := r.URL.Query().Get("mode")
+	replay := r.URL.Query().Get("replay")
 
-	if sessionID == "" {
-		http.Error(w, "Missing sessionID", http.StatusBadRequest)
+	if machineID == "" {
+		writeJSONError(w, http.StatusBadRequest, errInvalidMachine, "Invalid machine ID")
+		return
+	}
+
+	if termType != "" && !isValidTermType(termType) {
+		writeJSONError(w, http.StatusBadRequest, errInvalidTermType, "Invalid terminal type")
+		return
+	}
+
+	// Clients must ask for a framing version the server speaks, via Sec-WebSocket-Protocol
+	protocol := negotiateProtocol(websocket.Subprotocols(r))
+	if protocol == "" {
+		writeJSONError(w, http.StatusBadRequest, errUnsupportedProtocol, fmt.Sprintf("Unsupported WebSocket subprotocol (expected one of %s)", strings.Join(wsProtocols, ", ")))
+		return
+	}
+
+	if channel != "" && channel != "console" && channel != "aux" {
+		writeJSONError(w, http.StatusBadRequest, errInvalidChannel, "Invalid channel")
 		return
 	}
 
-	if machineID != "1" && machineID != "2" {
-		http.Error(w, "Invalid machine ID", http.StatusBadRequest)
+	// tty picks a serial port of a session with the serialPorts option, 0 being the main console.
+	// The other ports are channels of their own.
+	if tty := r.URL.Query().Get("tty"); tty != "" && tty != "0" {
+		n, err := strconv.Atoi(tty)
+		if err != nil || n < 1 || n >= maxSerialPorts || channel == "aux" {
+			writeJSONError(w, http.StatusBadRequest, errInvalidTTY, fmt.Sprintf("Invalid tty (expected 0 to %d, and no channel=aux)", maxSerialPorts-1))
+			return
+		}
+		channel = fmt.Sprintf("tty%d", n)
+	}
+
+	// Observers watch the console without being able to type into it
+	observe := false
+	switch mode {
+	case "", "interact":
+	case "observe":
+		observe = true
+	default:
+		writeJSONError(w, http.StatusBadRequest, errInvalidMode, "Invalid mode")
+		return
+	}
+
+	if replay != "" && replay != "backlog" && replay != "scrollback" {
+		writeJSONError(w, http.StatusBadRequest, errInvalidReplay, "Invalid replay")
+		return
+	}
+
+	// PTY output is sent as binary frames unless the client asks for text frames
+	textFrames := false
+	switch frames {
+	case "", "binary":
+	case "text":
+		textFrames = true
+	default:
+		writeJSONError(w, http.StatusBadRequest, errInvalidFrames, "Invalid frames mode")
 		return
 	}
 
@@ -125,182 +842,947 @@ func wsHandler(w http.ResponseWriter, r *http.Request) {
 	session := sessions[sessionID]
 	if session == nil {
 		sessionsMu.Unlock()
-		http.Error(w, "Session not found", http.StatusNotFound)
+		writeJSONError(w, http.StatusNotFound, errSessionNotFound, "Session not found")
+		return
+	}
+	if _, ok := session.nics[machineID]; !ok {
+		sessionsMu.Unlock()
+		writeJSONError(w, http.StatusBadRequest, errInvalidMachine, "Invalid machine ID")
 		return
 	}
 	// Update the last activity time of the session
-	session.lastActive = time.Now()
+	session.touch()
 	sessionsMu.Unlock()
 
+	if termType == "" {
+		termType = "unknown"
+	}
+	compression := wsCompression && offersCompression(r)
+	logger := requestLogger(r.Context()).With("session", sessionID, "machine", machineID, "term", termType, "protocol", protocol, "compression", compression)
+	if channel != "" && channel != "console" {
+		logger = logger.With("channel", channel)
+	}
+	logger.Info("Client attaching", "remote", r.RemoteAddr, "observe", observe)
+
 	// Establish WebSocket connection
 	wsConn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Printf("Error upgrading to WebSocket: %v", err)
+		logger.Error("Error upgrading to WebSocket", "err", err)
 		return
 	}
+	// Console output is mostly repeated escape sequences and whitespace, which deflate shrinks well
+	wsConn.EnableWriteCompression(compression)
+	// The frame header gives the size, so an oversized frame is refused without buffering it
+	wsConn.SetReadLimit(maxInputFrameSize)
+
+	// All writes go through the client so server notifications don't interleave with PTY output
+	client := &wsClient{conn: wsConn, machineID: machineID, channel: channel, term: termType, textFrames: textFrames}
 	defer func() {
-		if err := wsConn.Close(); err != nil {
-			log.Printf("Error closing WebSocket: %v", err)
+		if err := client.close(); err != nil && !errors.Is(err, net.ErrClosed) {
+			logger.Error("Error closing WebSocket", "err", err)
 		}
 	}()
+	// The limits are checked when the client is registered, so concurrent upgrades can't overshoot
+	// them. A rejected client gets a close frame explaining why, since the upgrade already happened.
+	sessionsMu.Lock()
+	limitReason := clientLimitReached(session, machineID)
+	if limitReason == "" {
+		session.clients[client] = struct{}{}
+	}
+	sessionsMu.Unlock()
+	if limitReason != "" {
+		logger.Warn("Rejecting WebSocket connection", "reason", limitReason)
+		wsRejected.Inc()
+		if err := client.writeMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, limitReason)); err != nil {
+			logger.Error("Error sending close message to rejected WebSocket", "err", err)
+		}
+		return
+	}
+	wsConnections.Inc()
+	defer func() {
+		sessionsMu.Lock()
+		delete(session.clients, client)
+		sessionsMu.Unlock()
+		wsConnections.Dec()
+	}()
 
-	ptmx, ok := session.ptyFiles[machineID]
-	if !ok {
-		log.Printf("Invalid machine ID: %s", machineID)
-		if err := wsConn.WriteMessage(websocket.TextMessage, []byte("Invalid machine ID")); err != nil {
-			log.Printf("Error sending invalid machine ID message: %v", err)
+	sessionsMu.RLock()
+	console := session.consoles[consoleKey(machineID, channel)]
+	sessionsMu.RUnlock()
+	if console == nil {
+		logger.Warn("Invalid machine ID or channel")
+		if err := client.writeMessage(websocket.TextMessage, []byte("Invalid machine ID or channel")); err != nil {
+			logger.Error("Error sending invalid machine ID message", "err", err)
 		}
 		return
 	}
 
-	// Read from PTY and send to WebSocket
-	go func() {
-		buf := make([]byte, 1024)
-		for {
-			n, err := ptmx.Read(buf)
-			if err != nil {
-				if errors.Is(err, os.ErrClosed) || strings.Contains(err.Error(), "use of closed network connection") {
-					// PTY closed, exit gracefully
-					log.Printf("PTY closed for machine %s: %v", machineID, err)
-				} else {
-					log.Printf("Error reading from PTY: %v", err)
-				}
-				if err := wsConn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")); err != nil {
-					log.Printf("Error sending close message to WebSocket: %v", err)
-				}
-				break
+	// The newest interactive connection owns the console's input. A reconnecting client, e.g. after
+	// a page reload, replaces its previous connection, which may not have noticed it is gone yet.
+	// Any number of observers watch alongside it.
+	if !observe {
+		if previous := console.takeOwnership(client); previous != nil {
+			logger.Info("Handing console over to a new connection")
+			if err := previous.writeMessage(websocket.CloseMessage, websocket.FormatCloseMessage(closeReplaced, "Replaced by a newer connection")); err != nil {
+				logger.Error("Error sending close message to replaced WebSocket", "err", err)
 			}
-			if err := wsConn.WriteMessage(websocket.BinaryMessage, buf[:n]); err != nil {
-				log.Printf("Error writing to WebSocket: %v", err)
-				break
+			if err := previous.close(); err != nil {
+				logger.Error("Error closing replaced WebSocket", "err", err)
 			}
 		}
+		defer console.releaseOwnership(client)
+	}
+
+	// Send console output to the WebSocket, starting with whatever was printed while no client was
+	// attached. Observers get a copy of that backlog and leave it for the next interactive client.
+	// With replay=scrollback the connection starts with the console's recent history instead.
+	sub, backlog := console.subscribeReplaying(!observe, replay == "scrollback")
+	outputDone := make(chan struct{})
+	go func() {
+		defer close(outputDone)
+		client.streamOutput(console, sub, backlog, logger)
+	}()
+	// Whichever side fails first, both stop: a failed write closes the connection, which ends the
+	// read loop, and the end of the read loop stops the output and waits for it, so neither
+	// goroutine outlives the handler
+	defer func() {
+		console.unsubscribe(sub)
+		if err := client.close(); err != nil && !errors.Is(err, net.ErrClosed) {
+			logger.Error("Error closing WebSocket", "err", err)
+		}
+		<-outputDone
 	}()
 
+	// Optional session-scoped rewriting of client input before it reaches the guest
+	inputMap := inputMaps[session.opts.inputMap]
+	// Input is audited line by line as the guest receives it; a line still being typed when the
+	// connection ends is recorded as partial
+	auditor := &inputAuditor{audit: session.audit, machine: machineID, channel: "console", remote: r.RemoteAddr}
+	if channel != "" {
+		auditor.channel = channel
+	}
+	defer auditor.flush(true)
+
+	// Drop the connection if the client stops answering pings, e.g. after a network cut
+	if err := wsConn.SetReadDeadline(time.Now().Add(pongWait)); err != nil {
+		logger.Error("Error setting WebSocket read deadline", "err", err)
+	}
+	wsConn.SetPongHandler(func(string) error {
+		return wsConn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+	stopPings := make(chan struct{})
+	defer close(stopPings)
+	go client.keepAlive(stopPings)
+
 	// Read from WebSocket and write to PTY
 	for {
 		messageType, msg, err := wsConn.ReadMessage()
 		if err != nil {
-			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				log.Printf("Unexpected WebSocket close: %v", err)
+			if errors.Is(err, websocket.ErrReadLimit) {
+				logger.Warn("Closing WebSocket after an oversized frame", "limit", maxInputFrameSize)
+			} else if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure, closeMachineExited) {
+				logger.Warn("Unexpected WebSocket close", "err", err)
 			} else {
-				log.Printf("WebSocket read error: %v", err)
+				logger.Info("WebSocket closed", "err", err)
 			}
 			break
 		}
-		if messageType == websocket.BinaryMessage || messageType == websocket.TextMessage {
-			if _, err := ptmx.Write(msg); err != nil {
-				log.Printf("Error writing to machine PTY: %v", err)
+		if observe {
+			continue // Observers can't type, resize, or keep the session alive
+		}
+		if control, ok := parseControlMessage(messageType, msg); ok {
+			// Control messages configure the connection and never reach the guest
+			handleControlMessage(console.conn, control, machineID, sessionID)
+		} else if messageType == websocket.BinaryMessage || messageType == websocket.TextMessage {
+			if !console.isOwner(client) {
+				break // Replaced by a newer connection, which now owns the input
+			}
+			if inputMap != nil {
+				msg = []byte(inputMap.Replace(string(msg)))
+			}
+			if err := console.write(msg); err != nil {
+				logger.Error("Error writing to machine PTY", "err", err)
 				break
 			}
+			auditor.record(msg)
 		}
 
-		// Update the last activity time of the session
-		sessionsMu.Lock()
-		session.lastActive = time.Now()
-		sessionsMu.Unlock()
+		// Update the last activity time of the session, without a lock since this runs on every keystroke
+		session.touch()
 	}
 }
 
-// createSession creates a new session: generates a hash, sets up the network, and starts VMs
-func createSession() (*Session, error) {
-	hash, err := generateShortHash(6)
-	if err != nil {
-		return nil, fmt.Errorf("failed to generate hash: %v", err)
+// parseSessionOptions validates the optional session settings, given as /create_session query
+// parameters or converted from a CreateSessionRequest. Every invalid option is reported in the
+// returned *optionsError; options that others depend on being invalid skips the dependent checks.
+func parseSessionOptions(query url.Values) (sessionOptions, error) {
+	opts := sessionOptions{
+		machineCount:        defaultMachineCount,
+		memMB:               defaultMemoryMB,
+		vcpus:               1,
+		image:               defaultImage,
+		numaNode:            -1,
+		serialPorts:         1,
+		bridgeStp:           -1,
+		bridgeForwardDelay:  -1,
+		bridgeAgeingTime:    -1,
+		bridgeVlanFiltering: -1,
+		timeout:             sessionTimeout,
 	}
+	errs := &optionsError{}
 
-	bridgeName := fmt.Sprintf("br-%s", hash)
-	tap1Name := fmt.Sprintf("tap1-%s", hash)
-	tap2Name := fmt.Sprintf("tap2-%s", hash)
+	if count := query.Get("machineCount"); count != "" {
+		n, err := strconv.Atoi(count)
+		if err != nil || n < 1 || n > maxMachines {
+			errs.add("machineCount", "invalid machineCount: %q (expected 1 to %d)", count, maxMachines)
+		} else {
+			opts.machineCount = n
+		}
+	}
 
-	// Ensure the names do not exceed the length limit
-	if len(bridgeName) > 15 || len(tap1Name) > 15 || len(tap2Name) > 15 {
-		return nil, fmt.Errorf("interface name too long: %s, %s, %s", bridgeName, tap1Name, tap2Name)
+	if mem := query.Get("memMB"); mem != "" {
+		n, err := strconv.Atoi(mem)
+		if err != nil || n < minMemoryMB || n > maxMemoryMB {
+			errs.add("memMB", "invalid memMB: %q (expected %d to %d)", mem, minMemoryMB, maxMemoryMB)
+		} else {
+			opts.memMB = n
+		}
 	}
 
-	session := &Session{
-		hash:       hash,
-		bridgeName: bridgeName,
-		tapNames:   map[string]string{"1": tap1Name, "2": tap2Name},
-		ptyFiles:   make(map[string]*os.File),
-		cmds:       make(map[string]*exec.Cmd),
-		lastActive: time.Now(), // Set the session creation time
+	if v := query.Get("vcpus"); v != "" {
+		// Never hand a guest more vCPUs than the host has cores
+		limit := min(maxVCPUs, runtime.NumCPU())
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > limit {
+			errs.add("vcpus", "invalid vcpus: %q (expected 1 to %d)", v, limit)
+		} else {
+			opts.vcpus = n
+		}
 	}
 
-	// Set up the network for the session
-	if err := setupNetwork(session); err != nil {
-		return nil, fmt.Errorf("failed to set up network: %v", err)
+	if image := query.Get("image"); image != "" {
+		if _, ok := images[image]; !ok {
+			errs.add("image", "unknown image: %q", image)
+		} else {
+			opts.image = image
+		}
 	}
 
-	// Start virtual machines
-	if err := startMachine(session, "1", tap1Name); err != nil {
-		err := cleanupNetwork(session)
-		if err != nil {
-			return nil, err
+	switch backing := query.Get("memBacking"); backing {
+	case "", "anonymous":
+	case "hugepages":
+		mounted, err := hugetlbfsMounted(hugepagesPath)
+		switch {
+		case err != nil:
+			errs.add("memBacking", "failed to check hugepages mount: %v", err)
+		case !mounted:
+			errs.add("memBacking", "hugepages requested but no hugetlbfs is mounted at %s", hugepagesPath)
+		default:
+			opts.memBacking = backing
 		}
-		return nil, fmt.Errorf("failed to start machine 1: %v", err)
+	default:
+		errs.add("memBacking", "invalid memBacking: %q (expected \"anonymous\" or \"hugepages\")", backing)
 	}
-	if err := startMachine(session, "2", tap2Name); err != nil {
-		err := cleanupNetwork(session)
-		if err != nil {
-			return nil, err
+
+	if node := query.Get("numaNode"); node != "" {
+		n, err := strconv.Atoi(node)
+		if err != nil || n < 0 {
+			errs.add("numaNode", "invalid numaNode: %q", node)
+		} else if _, err := os.Stat(fmt.Sprintf("/sys/devices/system/node/node%d", n)); err != nil {
+			errs.add("numaNode", "NUMA node %d does not exist on this host", n)
+		} else {
+			opts.numaNode = n
 		}
-		return nil, fmt.Errorf("failed to start machine 2: %v", err)
 	}
 
-	// Add the session to the global map
-	sessionsMu.Lock()
-	sessions[hash] = session
-	sessionsMu.Unlock()
+	switch aux := query.Get("auxConsole"); aux {
+	case "", "none":
+	case "serial", "virtio":
+		opts.auxConsole = aux
+	default:
+		errs.add("auxConsole", "invalid auxConsole: %q (expected \"none\", \"serial\" or \"virtio\")", aux)
+	}
 
-	log.Printf("Session %s created\n", hash)
-	return session, nil
-}
+	if v := query.Get("serialPorts"); v != "" {
+		n, err := strconv.Atoi(v)
+		switch {
+		case err != nil || n < 1 || n > maxSerialPorts:
+			errs.add("serialPorts", "invalid serialPorts: %q (expected 1 to %d)", v, maxSerialPorts)
+		case n > 1 && opts.auxConsole == "serial":
+			// Both would claim the second serial port
+			errs.add("serialPorts", "serialPorts can't be combined with auxConsole=serial, whose port is tty1 with serialPorts=2")
+		default:
+			opts.serialPorts = n
+		}
+	}
 
-// cleanupSession cleans up session resources: terminates VMs and removes interfaces
-func cleanupSession(session *Session) {
-	// Terminate virtual machines
-	for id, cmd := range session.cmds {
-		if cmd != nil && cmd.Process != nil {
-			if err := cmd.Process.Kill(); err != nil {
-				log.Printf("Error terminating machine %s: %v", id, err)
+	if name := query.Get("inputMap"); name != "" {
+		if _, ok := inputMaps[name]; !ok {
+			errs.add("inputMap", "unknown inputMap: %q", name)
+		} else {
+			opts.inputMap = name
+		}
+	}
+
+	if name := query.Get("template"); name != "" {
+		if _, ok := templates[name]; !ok {
+			errs.add("template", "unknown template: %q", name)
+		} else {
+			opts.template = name
+		}
+	}
+
+	// The rtc options override -rtc key by key; a template with its own -rtc option replaces both
+	opts.rtc = defaultRTC
+	rtcParams := []struct {
+		param, key string
+		field      *string
+	}{
+		{"rtcBase", "base", &opts.rtc.base},
+		{"rtcClock", "clock", &opts.rtc.clock},
+		{"rtcDriftfix", "driftfix", &opts.rtc.driftfix},
+	}
+	for _, p := range rtcParams {
+		v := query.Get(p.param)
+		switch {
+		case v == "":
+		case templateSetsRTC(opts.template):
+			errs.add(p.param, "%s can't be combined with template %q, which sets -rtc", p.param, opts.template)
+		default:
+			if err := validateRTC(p.key, v); err != nil {
+				errs.add(p.param, "invalid %s: %v", p.param, err)
+			} else {
+				*p.field = v
+			}
+		}
+	}
+	if templateSetsRTC(opts.template) {
+		opts.rtc = rtcOptions{}
+	}
+
+	if hostname := query.Get("hostname"); hostname != "" {
+		if !hostnamePattern.MatchString(hostname) {
+			errs.add("hostname", "invalid hostname: %q", hostname)
+		} else {
+			opts.hostname = hostname
+		}
+	}
+
+	if key := query.Get("sshKey"); key != "" {
+		if err := validateSSHKey(key); err != nil {
+			errs.add("sshKey", "invalid sshKey: %v", err)
+		} else {
+			opts.sshKey = key
+		}
+	}
+
+	var err error
+	if opts.bridgeStp, err = parseToggle(query.Get("bridgeStp")); err != nil {
+		errs.add("bridgeStp", "invalid bridgeStp: %v", err)
+	}
+	if opts.bridgeVlanFiltering, err = parseToggle(query.Get("bridgeVlanFiltering")); err != nil {
+		errs.add("bridgeVlanFiltering", "invalid bridgeVlanFiltering: %v", err)
+	}
+	// The kernel only accepts forward delays of 2-30 seconds while STP is running
+	if opts.bridgeForwardDelay, err = parseBoundedInt(query.Get("bridgeForwardDelay"), 2, 30); err != nil {
+		errs.add("bridgeForwardDelay", "invalid bridgeForwardDelay: %v", err)
+	}
+	if opts.bridgeAgeingTime, err = parseBoundedInt(query.Get("bridgeAgeingTime"), 0, 1000000); err != nil {
+		errs.add("bridgeAgeingTime", "invalid bridgeAgeingTime: %v", err)
+	}
+
+	if v := query.Get("timeout"); v != "" {
+		// Sessions may ask for a different timeout, but never an unbounded one
+		d, err := time.ParseDuration(v)
+		if err != nil || d < minSessionTimeout || d > maxSessionTimeout {
+			errs.add("timeout", "invalid timeout: %q (expected a duration from %v to %v)", v, minSessionTimeout, maxSessionTimeout)
+		} else {
+			opts.timeout = d
+		}
+	}
+
+	if v := query.Get("recycleAfter"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < minRecycleAfter {
+			errs.add("recycleAfter", "invalid recycleAfter: %q (expected a duration of at least %v)", v, minRecycleAfter)
+		} else {
+			opts.recycleAfter = d
+		}
+	}
+
+	nat, err := parseToggle(query.Get("nat"))
+	switch {
+	case err != nil:
+		errs.add("nat", "invalid nat: %v", err)
+	case nat != 1:
+	case natUplink == "":
+		errs.add("nat", "NAT is not enabled on this server")
+	case useNetns:
+		// The bridge of a namespaced session has no route to the host's uplink
+		errs.add("nat", "NAT is not supported together with -netns")
+	default:
+		opts.nat = true
+	}
+
+	dhcp, err := parseToggle(query.Get("dhcp"))
+	if err != nil {
+		errs.add("dhcp", "invalid dhcp: %v", err)
+	}
+	opts.dhcp = dhcp == 1
+
+	snapshots, err := parseToggle(query.Get("snapshots"))
+	if err != nil {
+		errs.add("snapshots", "invalid snapshots: %v", err)
+	}
+	opts.snapshots = snapshots == 1
+
+	switch disk := query.Get("disk"); disk {
+	case "", "snapshot":
+		// savevm stores VM state in the disk image, which -snapshot keeps read-only
+		if disk == "snapshot" && opts.snapshots {
+			errs.add("disk", "snapshots=on requires disk=overlay")
+		}
+		opts.diskOverlay = opts.snapshots
+	case "overlay":
+		opts.diskOverlay = true
+	case "persistent":
+		// Guest changes go straight to the image, so it takes one writer and nothing may discard them
+		switch {
+		case errs.has("image", "machineCount", "snapshots", "recycleAfter"):
+		case !persistentImages[opts.image]:
+			errs.add("disk", "image %q can't be used with disk=persistent on this server", opts.image)
+		case opts.machineCount != 1:
+			errs.add("disk", "disk=persistent requires machineCount=1, since every machine would write to the image")
+		case opts.snapshots:
+			errs.add("disk", "snapshots=on requires disk=overlay")
+		case opts.recycleAfter > 0:
+			errs.add("disk", "recycleAfter can't be used with disk=persistent, which keeps guest changes")
+		default:
+			opts.diskPersistent = true
+		}
+	default:
+		errs.add("disk", "invalid disk: %q (expected \"snapshot\", \"overlay\" or \"persistent\")", disk)
+	}
+
+	// Machine lists are checked against machineCount, which has to be valid for that
+	if !errs.has("machineCount") {
+		if opts.networks, err = parseNetworks(query.Get("networks"), opts.machineCount); err != nil {
+			errs.add("networks", "invalid networks: %v", err)
+		}
+
+		if isolated := query.Get("isolated"); isolated != "" {
+			machines, err := parseMachineList(isolated, opts.machineCount)
+			if err != nil {
+				errs.add("isolated", "invalid isolated: %v", err)
 			} else {
-				log.Printf("Machine %s in session %s terminated", id, session.hash)
+				opts.isolated = make(map[string]bool, len(machines))
+				for _, id := range machines {
+					opts.isolated[id] = true
+				}
 			}
 		}
 	}
 
-	// Close PTYs
-	for _, pt := range session.ptyFiles {
-		if pt != nil {
-			if err := pt.Close(); err != nil {
-				log.Printf("Error closing PTY: %v", err)
+	if vni := query.Get("vxlanID"); vni != "" {
+		// VNIs are 24 bits wide; the value is coordinated between hosts by the caller
+		if vxlanDev == "" {
+			errs.add("vxlanID", "VXLAN overlays are not enabled on this server")
+		} else if opts.vxlanID, err = parseBoundedInt(vni, 1, 1<<24-1); err != nil {
+			errs.add("vxlanID", "invalid vxlanID: %v", err)
+		}
+		if remote := query.Get("vxlanRemote"); remote != "" {
+			if net.ParseIP(remote) == nil {
+				errs.add("vxlanRemote", "invalid vxlanRemote: %q", remote)
+			} else {
+				opts.vxlanRemote = remote
 			}
+		} else if vxlanGroup == "" && vxlanDev != "" {
+			errs.add("vxlanRemote", "vxlanRemote is required when no -vxlan-group is configured")
 		}
 	}
 
+	if name := query.Get("import"); name != "" {
+		// importQuery took the options from the bundle, but they are checked again here
+		if !opts.snapshots {
+			errs.add("import", "bundle %q is not of a session with snapshots=on", name)
+		} else {
+			opts.importBundle = name
+		}
+	}
+
+	// Export bundles record the options, so an import recreates the same virtual hardware
+	for key, values := range query {
+		if !nonOptionKeys[key] {
+			if opts.params == nil {
+				opts.params = url.Values{}
+			}
+			opts.params[key] = values
+		}
+	}
+
+	if len(errs.fields) > 0 {
+		return opts, errs
+	}
+	return opts, nil
+}
+
+// nonOptionKeys are the /create_session parameters that don't describe the session itself
+var nonOptionKeys = map[string]bool{"wait": true, "waitTimeout": true, "token": true, "import": true}
+
+// parseToggle parses an "on"/"off" option into 1/0, returning -1 when the option is unset
+func parseToggle(value string) (int, error) {
+	switch value {
+	case "":
+		return -1, nil
+	case "on", "1", "true":
+		return 1, nil
+	case "off", "0", "false":
+		return 0, nil
+	}
+	return -1, fmt.Errorf("%q (expected \"on\" or \"off\")", value)
+}
+
+// parseBoundedInt parses an integer option within [minValue, maxValue], returning -1 when the option is unset
+func parseBoundedInt(value string, minValue, maxValue int) (int, error) {
+	if value == "" {
+		return -1, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < minValue || n > maxValue {
+		return -1, fmt.Errorf("%q (expected an integer between %d and %d)", value, minValue, maxValue)
+	}
+	return n, nil
+}
+
+// hugetlbfsMounted reports whether a hugetlbfs filesystem is mounted at the given path
+func hugetlbfsMounted(path string) (bool, error) {
+	mounts, err := os.ReadFile("/proc/mounts")
+	if err != nil {
+		return false, err
+	}
+	for _, line := range strings.Split(string(mounts), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 3 && fields[1] == path && fields[2] == "hugetlbfs" {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// isValidTermType reports whether a client-supplied TERM value looks like a terminfo name
+func isValidTermType(term string) bool {
+	if len(term) > 64 {
+		return false
+	}
+	for _, c := range term {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("._+-", c)) {
+			return false
+		}
+	}
+	return true
+}
+
+// isFatalPTYError reports whether a PTY read error means the PTY or its VM is gone for good
+func isFatalPTYError(err error) bool {
+	return errors.Is(err, os.ErrClosed) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, syscall.EIO) || // The slave side closed: QEMU exited
+		strings.Contains(err.Error(), "use of closed network connection")
+}
+
+// utf8Boundary holds back an incomplete trailing UTF-8 sequence until the next PTY read completes it
+type utf8Boundary struct {
+	pending []byte
+}
+
+// complete returns the valid UTF-8 prefix of the pending bytes plus chunk, keeping any
+// incomplete trailing sequence for the next call. Invalid bytes are replaced with U+FFFD.
+func (b *utf8Boundary) complete(chunk []byte) []byte {
+	data := append(b.pending, chunk...)
+	b.pending = nil
+
+	// A UTF-8 sequence is at most utf8.UTFMax bytes, so only the tail needs inspecting
+	for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax; i-- {
+		if !utf8.RuneStart(data[i]) {
+			continue
+		}
+		if !utf8.FullRune(data[i:]) {
+			b.pending = append([]byte(nil), data[i:]...)
+			data = data[:i]
+		}
+		break
+	}
+
+	if !utf8.Valid(data) {
+		return []byte(strings.ToValidUTF8(string(data), "\uFFFD"))
+	}
+	return data
+}
+
+// flush returns the incomplete sequence kept back by complete, as U+FFFD, for when no more input
+// follows. It returns nil if nothing is pending.
+func (b *utf8Boundary) flush() []byte {
+	if len(b.pending) == 0 {
+		return nil
+	}
+	b.pending = nil
+	return []byte("\uFFFD")
+}
+
+// sessionLimitError is returned by createSession when maxSessions sessions already exist
+type sessionLimitError struct {
+	count int
+	limit int
+}
+
+func (e *sessionLimitError) Error() string {
+	return fmt.Sprintf("too many sessions: %d of %d in use, try again later", e.count, e.limit)
+}
+
+// createSession creates a new session: generates a hash, sets up the network, and starts VMs.
+// If ctx ends before the VMs are up, the partial session is cleaned up and ctx's error returned.
+// Requests for the default options are served from the warm pool when it has a session ready.
+func createSession(ctx context.Context, opts sessionOptions) (*Session, error) {
+	logger := requestLogger(ctx)
+	if session := takeWarmSession(opts); session != nil {
+		activateSession(session)
+		logger.Info("Session created from the warm pool", "session", session.hash)
+		return session, nil
+	}
+	session, err := startSession(ctx, opts, false)
+	if err != nil {
+		return nil, err
+	}
+	activateSession(session)
+	logger.Info("Session created", "session", session.hash)
+	return session, nil
+}
+
+// startSession sets up a session's network and starts its VMs. The session's ID stays reserved
+// in pendingSessions until activateSession makes the session available to clients. pooled sessions
+// are started for the warm pool.
+func startSession(ctx context.Context, opts sessionOptions, pooled bool) (*Session, error) {
+	if err := checkHostMemory(opts); err != nil {
+		return nil, err
+	}
+
+	// Reserve a slot and an unused ID up front so concurrent creations can't overshoot the limit
+	// while VMs boot, and can't end up with the same ID and therefore the same interface names
+	sessionsMu.Lock()
+	if inUse := len(sessions) + len(pendingSessions); maxSessions > 0 && inUse >= maxSessions {
+		sessionsMu.Unlock()
+		return nil, &sessionLimitError{count: inUse, limit: maxSessions}
+	}
+	hash, err := generateSessionID()
+	if err != nil {
+		sessionsMu.Unlock()
+		return nil, err
+	}
+	// A writable image is claimed along with the ID, so two sessions can never both open it
+	if err := lockImage(hash, opts); err != nil {
+		sessionsMu.Unlock()
+		return nil, err
+	}
+	pendingSessions[hash] = struct{}{}
+	sessionsMu.Unlock()
+	started := false
+	defer func() {
+		if !started {
+			unlockImage(hash, opts)
+			sessionsMu.Lock()
+			delete(pendingSessions, hash)
+			sessionsMu.Unlock()
+		}
+	}()
+
+	bridges, nics := sessionTopology(hash, opts)
+
+	var vxlanName string
+	if opts.vxlanID != 0 {
+		vxlanName = fmt.Sprintf("vx-%s", hash)
+	}
+
+	session := &Session{
+		hash:         hash,
+		bridgeName:   bridges[0],
+		bridges:      bridges,
+		vxlanName:    vxlanName,
+		workDir:      filepath.Join(workRoot, hash),
+		nics:         nics,
+		ptyFiles:     make(map[string]*os.File),
+		auxPtys:      make(map[string]*os.File),
+		serialPtys:   make(map[string][]*os.File),
+		consoleConns: make(map[string]net.Conn),
+		consoles:     make(map[string]*consoleStream),
+		procs:        make(map[string]*machineProcess),
+		bootReady:    make(map[string]bool),
+		clients:      make(map[*wsClient]struct{}),
+		qmpSockets:   make(map[string]string),
+		pooled:       pooled,
+
+		recycleTimers: make(map[string]*time.Timer),
+		timeout:       opts.timeout,
+		opts:          opts,
+	}
+
+	// Ensure the names do not exceed the length limit
+	for _, name := range append(append(session.taps(), session.bridges...), session.vxlanName) {
+		if len(name) > 15 {
+			return nil, fmt.Errorf("interface name too long: %s", name)
+		}
+	}
+
+	if useNetns {
+		session.netns = fmt.Sprintf("vmshell-%s", hash)
+	}
+
+	// All per-session files (sockets, overlays, logs) live in the session's working directory
+	if err := os.MkdirAll(session.workDir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create working directory: %v", err)
+	}
+	if opts.importBundle != "" {
+		if err := unpackBundle(ctx, session); err != nil {
+			removeWorkDir(session)
+			return nil, err
+		}
+	}
+
+	// Set up the network for the session
+	if err := setupNetwork(ctx, session); err != nil {
+		removeWorkDir(session)
+		// Reclaim whatever was created before the failure, including the namespace. Cleanup deletes
+		// the session's interfaces by name, so it must not run when one of them is someone else's.
+		var ownedErr *bridgeOwnedError
+		if errors.As(err, &ownedErr) {
+			releaseSubnet(session)
+		} else if cleanupErr := cleanupNetwork(ctx, session); cleanupErr != nil {
+			requestLogger(ctx).Error("Error cleaning up network", "session", session.hash, "err", cleanupErr)
+		}
+		return nil, fmt.Errorf("failed to set up network: %w", err)
+	}
+	if err := createSessionCgroup(session); err != nil {
+		cleanupSession(session)
+		return nil, err
+	}
+	if err := openAuditLog(session); err != nil {
+		cleanupSession(session)
+		return nil, err
+	}
+	saveSessionState(session)
+
+	// Start virtual machines, unless this is a dry run that only sets up the network
+	for i := 1; i <= opts.machineCount && !noVMs; i++ {
+		machineID := strconv.Itoa(i)
+		err := ctx.Err()
+		if err == nil {
+			err = startMachine(ctx, session, machineID)
+		}
+		if err != nil {
+			// Tear down the machines that did start along with the network and working directory
+			cleanupSession(session)
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return nil, fmt.Errorf("session creation aborted before machine %s was up: %w", machineID, ctxErr)
+			}
+			vmStartFailures.Inc()
+			var startErr *machineStartError
+			if errors.As(err, &startErr) {
+				return nil, startErr
+			}
+			return nil, fmt.Errorf("failed to start machine %s: %v", machineID, err)
+		}
+	}
+	saveSessionState(session)
+	started = true
+	return session, nil
+}
+
+// activateSession adds a session started by startSession to the global map, which makes it
+// available to clients. Its creation and activity times count from now, since a session from the
+// warm pool may have been started a while ago.
+func activateSession(session *Session) {
+	sessionsMu.Lock()
+	delete(pendingSessions, session.hash)
+	session.createdAt = time.Now()
+	session.touch()
+	sessions[session.hash] = session
+	sessionsMu.Unlock()
+	sessionsCreated.Inc()
+
+	if session.opts.recycleAfter > 0 && !noVMs {
+		session.lifecycleMu.Lock()
+		for id := range session.nics {
+			scheduleRecycle(session, id)
+		}
+		session.lifecycleMu.Unlock()
+	}
+}
+
+// removeSession takes a session out of the sessions map before it is cleaned up, and remembers
+// its ID for closedSessionMemory. Must be called with sessionsMu held.
+func removeSession(session *Session) {
+	delete(sessions, session.hash)
+	closedSessions[session.hash] = time.Now()
+}
+
+// cleanupSession cleans up session resources: terminates VMs and removes interfaces. Only the
+// first call does anything, so a session removed on two paths at once is torn down once.
+func cleanupSession(session *Session) {
+	session.lifecycleMu.Lock()
+	defer session.lifecycleMu.Unlock()
+	if session.closed {
+		return
+	}
+	session.closed = true
+	logger := slog.With("session", session.hash)
+	for _, timer := range session.recycleTimers {
+		timer.Stop()
+	}
+
+	// Stop virtual machines in parallel so the grace periods don't add up
+	var wg sync.WaitGroup
+	for _, id := range session.machineIDs() {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			stopMachine(session, id)
+		}(id)
+	}
+	wg.Wait()
+	// Only now that QEMU is gone can another session open the writable image
+	unlockImage(session.hash, session.opts)
+	session.audit.close()
+
+	removeSessionCgroup(session)
+
 	// Clean up the network
-	if err := cleanupNetwork(session); err != nil {
-		log.Printf("Error cleaning up network for session %s: %v", session.hash, err)
+	if err := cleanupNetwork(context.Background(), session); err != nil {
+		logger.Error("Error cleaning up network", "err", err)
 	} else {
-		log.Printf("Network for session %s cleaned up", session.hash)
+		logger.Info("Network cleaned up")
+	}
+
+	removeWorkDir(session)
+	removeSessionState(session)
+
+	logger.Info("Session removed")
+}
+
+// stopMachine terminates a machine's QEMU process and closes its PTYs and console socket, which ends its console
+// streams and disconnects attached clients. The session's maps are left as they are. Must be
+// called with session.lifecycleMu held.
+func stopMachine(session *Session, machineID string) {
+	logger := slog.With("session", session.hash, "machine", machineID)
+	if proc := session.procs[machineID]; proc != nil {
+		if err := terminateMachine(proc); err != nil {
+			logger.Error("Error terminating machine", "err", err)
+		} else {
+			logger.Info("Machine terminated")
+		}
+	}
+	if pt := session.ptyFiles[machineID]; pt != nil {
+		if err := pt.Close(); err != nil {
+			logger.Error("Error closing PTY", "err", err)
+		}
+	}
+	if pt := session.auxPtys[machineID]; pt != nil {
+		if err := pt.Close(); err != nil {
+			logger.Error("Error closing auxiliary PTY", "err", err)
+		}
+	}
+	for _, pt := range session.serialPtys[machineID] {
+		if err := pt.Close(); err != nil {
+			logger.Error("Error closing serial port PTY", "err", err)
+		}
+	}
+	if conn := session.consoleConns[machineID]; conn != nil {
+		if err := conn.Close(); err != nil {
+			logger.Error("Error closing console socket", "err", err)
+		}
+	}
+}
+
+// terminateMachine asks QEMU to exit with SIGTERM, which lets it flush its disks, and
+// falls back to SIGKILL if the process is still running after vmGracePeriod. Both go to QEMU's
+// process group, which pty.Start made it the leader of, so helper processes it spawned don't
+// outlive it; the reaper kills any still there once QEMU has exited.
+func terminateMachine(proc *machineProcess) error {
+	proc.stopping.Store(true)
+	pid := proc.cmd.Process.Pid
+
+	if err := proc.signalGroup(syscall.SIGTERM); err != nil {
+		slog.Error("Error sending SIGTERM to QEMU process group", "pid", pid, "err", err)
+	}
+
+	select {
+	case <-proc.done:
+		return nil
+	case <-time.After(vmGracePeriod):
 	}
 
-	log.Printf("Session %s removed\n", session.hash)
+	slog.Warn("QEMU process did not exit in time, killing its process group", "pid", pid, "grace", vmGracePeriod)
+	if err := proc.signalGroup(syscall.SIGKILL); err != nil {
+		return err
+	}
+	<-proc.done
+	return nil
+}
+
+// killProcessGroup kills what is left of the process group of an exited QEMU process. It must run
+// before QEMU is reaped: until then the group keeps QEMU's PID as its ID, so it can't be another
+// process's.
+func killProcessGroup(pgid int) {
+	if err := syscall.Kill(-pgid, syscall.SIGKILL); err != nil && !errors.Is(err, syscall.ESRCH) {
+		slog.Error("Error killing process group", "pgid", pgid, "err", err)
+	}
 }
 
-// sessionCleaner periodically checks and cleans up inactive sessions
+// removeWorkDir deletes the session's working directory and everything in it
+func removeWorkDir(session *Session) {
+	if session.workDir == "" {
+		return
+	}
+	if err := os.RemoveAll(session.workDir); err != nil {
+		slog.Error("Error removing working directory", "session", session.hash, "path", session.workDir, "err", err)
+	}
+}
+
+// sessionCleaner periodically cleans up inactive sessions and forgets long-closed ones
 func sessionCleaner() {
-	ticker := time.NewTicker(5 * time.Minute)
+	ticker := time.NewTicker(cleanerInterval)
 	defer ticker.Stop()
 
+	sessionsMu.Lock()
+	cleanerNextRun = time.Now().Add(cleanerInterval)
+	sessionsMu.Unlock()
+
 	for range ticker.C {
 		sessionsMu.Lock()
+		cleanerNextRun = time.Now().Add(cleanerInterval)
 		for id, session := range sessions {
-			if time.Since(session.lastActive) > sessionTimeout {
-				log.Printf("Session %s inactive for more than %v and will be removed", id, sessionTimeout)
-				delete(sessions, id)
+			if session.pinned {
+				continue
+			}
+			if maxLifetime > 0 && !session.createdAt.IsZero() && time.Since(session.createdAt) > maxLifetime {
+				slog.Info("Session reached the maximum lifetime and will be removed", "session", id, "lifetime", maxLifetime)
+				removeSession(session)
 				go cleanupSession(session)
+				sessionsClosed.WithLabelValues(closeReasonLifetime).Inc()
+				continue
+			}
+			// A zero timeout disables inactivity reaping, but the cleaner keeps running for its other duties
+			if session.timeout == 0 {
+				continue
+			}
+			if time.Since(session.lastActivity()) > session.timeout {
+				slog.Info("Session inactive and will be removed", "session", id, "timeout", session.timeout)
+				removeSession(session)
+				go cleanupSession(session)
+				sessionsClosed.WithLabelValues(closeReasonTimeout).Inc()
+			}
+		}
+		for id, closedAt := range closedSessions {
+			if time.Since(closedAt) > closedSessionMemory {
+				delete(closedSessions, id)
 			}
 		}
 		sessionsMu.Unlock()
@@ -319,139 +1801,909 @@ func generateShortHash(length int) (string, error) {
 	return hex.EncodeToString(bytes), nil
 }
 
+// generateSessionID returns a session ID that no live, pending, or recorded session uses. IDs are
+// short, so collisions are possible, and a colliding session would share interface names with the
+// existing one. Must be called with sessionsMu held.
+func generateSessionID() (string, error) {
+	for attempt := 0; attempt < maxSessionIDAttempts; attempt++ {
+		hash, err := generateShortHash(sessionIDLength)
+		if err != nil {
+			return "", fmt.Errorf("failed to generate hash: %v", err)
+		}
+		if _, live := sessions[hash]; live {
+			continue
+		}
+		if _, pending := pendingSessions[hash]; pending {
+			continue
+		}
+		// Keep recently closed IDs distinct, so a late close can't hit a new session
+		if _, closed := closedSessions[hash]; closed {
+			continue
+		}
+		// A session a previous run left running still owns its interfaces
+		if hasSessionState(hash) {
+			continue
+		}
+		return hash, nil
+	}
+	return "", fmt.Errorf("failed to find an unused session ID after %d attempts", maxSessionIDAttempts)
+}
+
+// isValidSessionID reports whether id has the form of a session ID produced by generateShortHash
+func isValidSessionID(id string) bool {
+	if len(id) != sessionIDLength {
+		return false
+	}
+	for _, c := range id {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// sessionIDParam returns the sessionID query parameter, writing a JSON error and returning false
+// if it is missing or malformed. Malformed IDs are rejected before they reach a map lookup or a log line.
+func sessionIDParam(w http.ResponseWriter, r *http.Request) (string, bool) {
+	sessionID := r.URL.Query().Get("sessionID")
+	if sessionID == "" {
+		writeJSONError(w, http.StatusBadRequest, errMissingSessionID, "Missing sessionID")
+		return "", false
+	}
+	if !isValidSessionID(sessionID) {
+		writeJSONError(w, http.StatusBadRequest, errInvalidSessionID, "Invalid sessionID")
+		return "", false
+	}
+	return sessionID, true
+}
+
 // setupNetwork configures network interfaces for the session
-func setupNetwork(session *Session) error {
-	exists, err := interfaceExists(session.bridgeName)
-	if err != nil {
-		return fmt.Errorf("error checking existence of bridge %s: %v", session.bridgeName, err)
+func setupNetwork(ctx context.Context, session *Session) error {
+	logger := requestLogger(ctx).With("session", session.hash)
+	if session.opts.nat || session.opts.dhcp {
+		if err := allocateSubnet(session); err != nil {
+			return err
+		}
 	}
-	if exists {
-		log.Printf("Bridge %s already exists. Deleting...", session.bridgeName)
-		if err := runCommand("ip", "link", "delete", session.bridgeName, "type", "bridge"); err != nil {
-			return fmt.Errorf("failed to delete bridge %s: %v", session.bridgeName, err)
+
+	if session.netns != "" {
+		logger.Debug("Creating network namespace", "netns", session.netns)
+		if err := runCommandContext(ctx, "ip", "netns", "add", session.netns); err != nil {
+			return fmt.Errorf("failed to create network namespace %s: %v", session.netns, err)
+		}
+		if err := runCommandContext(ctx, session.ip("link", "set", "lo", "up")...); err != nil {
+			return fmt.Errorf("failed to bring up loopback in namespace %s: %v", session.netns, err)
 		}
 	}
 
-	log.Printf("Creating bridge %s...", session.bridgeName)
-	if err := runCommand("ip", "link", "add", session.bridgeName, "type", "bridge"); err != nil {
-		return fmt.Errorf("failed to create bridge %s: %v", session.bridgeName, err)
+	for _, bridge := range session.bridges {
+		exists, err := interfaceExists(session.netns, bridge)
+		if err != nil {
+			return fmt.Errorf("error checking existence of bridge %s: %v", bridge, err)
+		}
+		if exists {
+			// The session ID is unique among tracked and recorded sessions, so the bridge is a leftover
+			// nobody owns. Refuse to touch it if that assumption is ever broken.
+			if owner := bridgeOwner(session, bridge); owner != "" {
+				return &bridgeOwnedError{bridge: bridge, owner: owner}
+			}
+			logger.Warn("Orphaned bridge already exists, deleting it", "bridge", bridge)
+			if err := runCommandContext(ctx, session.ip("link", "delete", bridge, "type", "bridge")...); err != nil {
+				return fmt.Errorf("failed to delete bridge %s: %v", bridge, err)
+			}
+		}
+
+		if err := createBridge(ctx, session, bridge); err != nil {
+			return err
+		}
 	}
 
-	log.Printf("Bringing up bridge %s...", session.bridgeName)
-	if err := runCommand("ip", "link", "set", session.bridgeName, "up"); err != nil {
-		return fmt.Errorf("failed to bring up bridge %s: %v", session.bridgeName, err)
+	for _, id := range session.machineIDs() {
+		for _, nic := range session.nics[id] {
+			if err := createTAP(ctx, session, nic); err != nil {
+				return err
+			}
+		}
 	}
 
-	for _, tap := range session.tapNames {
-		log.Printf("Creating TAP device %s...", tap)
-		if err := runCommand("ip", "tuntap", "add", "mode", "tap", tap); err != nil {
-			return fmt.Errorf("failed to create TAP device %s: %v", tap, err)
+	if session.vxlanName != "" {
+		if err := setupVXLAN(ctx, session); err != nil {
+			return err
 		}
+	}
 
-		log.Printf("Attaching TAP device %s to bridge %s...", tap, session.bridgeName)
-		if err := runCommand("ip", "link", "set", tap, "master", session.bridgeName); err != nil {
-			return fmt.Errorf("failed to attach TAP device %s to bridge %s: %v", tap, session.bridgeName, err)
+	if session.opts.nat {
+		if err := setupNAT(session); err != nil {
+			return err
 		}
+	}
 
-		log.Printf("Bringing up TAP device %s...", tap)
-		if err := runCommand("ip", "link", "set", tap, "up"); err != nil {
-			return fmt.Errorf("failed to bring up TAP device %s: %v", tap, err)
+	if session.opts.dhcp {
+		if err := startDHCP(session); err != nil {
+			return err
 		}
 	}
 
-	log.Printf("Network setup for session %s completed successfully.", session.hash)
+	logger.Info("Network setup completed", "bridges", strings.Join(session.bridges, ","))
+	return nil
+}
+
+// createTAP creates a NIC's TAP device, enslaves it to its bridge, and brings it up
+func createTAP(ctx context.Context, session *Session, nic machineNIC) error {
+	logger := requestLogger(ctx).With("session", session.hash)
+	logger.Debug("Creating TAP device", "tap", nic.tap)
+	if err := runCommandContext(ctx, session.ip("tuntap", "add", "mode", "tap", nic.tap)...); err != nil {
+		return fmt.Errorf("failed to create TAP device %s: %v", nic.tap, err)
+	}
+
+	logger.Debug("Attaching TAP device to bridge", "tap", nic.tap, "bridge", nic.bridge)
+	if err := runCommandContext(ctx, session.ip("link", "set", nic.tap, "master", nic.bridge)...); err != nil {
+		return fmt.Errorf("failed to attach TAP device %s to bridge %s: %v", nic.tap, nic.bridge, err)
+	}
+	if err := isolateNIC(session, nic); err != nil {
+		return err
+	}
+
+	logger.Debug("Bringing up TAP device", "tap", nic.tap)
+	if err := runCommandContext(ctx, session.ip("link", "set", nic.tap, "up")...); err != nil {
+		return fmt.Errorf("failed to bring up TAP device %s: %v", nic.tap, err)
+	}
+	return nil
+}
+
+// createBridge creates, configures, and brings up one of the session's bridges. Only the first
+// bridge gets the session's address.
+func createBridge(ctx context.Context, session *Session, bridge string) error {
+	logger := requestLogger(ctx).With("session", session.hash)
+	logger.Info("Creating bridge", "bridge", bridge)
+	if err := runCommandContext(ctx, session.ip("link", "add", bridge, "type", "bridge")...); err != nil {
+		return fmt.Errorf("failed to create bridge %s: %v", bridge, err)
+	}
+
+	if params := bridgeParams(session.opts); len(params) > 0 {
+		logger.Info("Configuring bridge", "bridge", bridge, "params", strings.Join(params, " "))
+		args := append([]string{"link", "set", bridge, "type", "bridge"}, params...)
+		if err := runCommandContext(ctx, session.ip(args...)...); err != nil {
+			return fmt.Errorf("failed to configure bridge %s: %v", bridge, err)
+		}
+	}
+
+	logger.Info("Bringing up bridge", "bridge", bridge)
+	if err := runCommandContext(ctx, session.ip("link", "set", bridge, "up")...); err != nil {
+		return fmt.Errorf("failed to bring up bridge %s: %v", bridge, err)
+	}
+
+	if session.subnet != nil && bridge == session.bridgeName {
+		address := gatewayAddress(session.subnet)
+		logger.Info("Assigning address to bridge", "address", address, "bridge", session.bridgeName)
+		if err := runCommandContext(ctx, session.ip("addr", "add", address, "dev", session.bridgeName)...); err != nil {
+			return fmt.Errorf("failed to assign address %s to bridge %s: %v", address, session.bridgeName, err)
+		}
+	}
+	return nil
+}
+
+// setupVXLAN creates the session's VXLAN interface on the uplink and enslaves it to the
+// session bridge, so VMs on other hosts using the same VNI share the L2 segment
+func setupVXLAN(ctx context.Context, session *Session) error {
+	logger := requestLogger(ctx).With("session", session.hash, "vxlan", session.vxlanName)
+	// The VXLAN interface is created in the host namespace, where the uplink lives. Moved into a
+	// session namespace it keeps its UDP socket in the host namespace, so the overlay still works.
+	args := []string{"ip", "link", "add", session.vxlanName, "type", "vxlan",
+		"id", strconv.Itoa(session.opts.vxlanID), "dev", vxlanDev, "dstport", strconv.Itoa(vxlanPort)}
+	if session.opts.vxlanRemote != "" {
+		args = append(args, "remote", session.opts.vxlanRemote)
+	} else {
+		args = append(args, "group", vxlanGroup)
+	}
+
+	logger.Info("Creating VXLAN interface", "vni", session.opts.vxlanID)
+	if err := runCommandContext(ctx, args...); err != nil {
+		return fmt.Errorf("failed to create VXLAN interface %s: %v", session.vxlanName, err)
+	}
+
+	if session.netns != "" {
+		logger.Info("Moving VXLAN interface into namespace", "netns", session.netns)
+		if err := runCommandContext(ctx, "ip", "link", "set", session.vxlanName, "netns", session.netns); err != nil {
+			_ = runCommand("ip", "link", "delete", session.vxlanName) // Best effort
+			return fmt.Errorf("failed to move VXLAN interface %s into namespace %s: %v", session.vxlanName, session.netns, err)
+		}
+	}
+
+	logger.Info("Attaching VXLAN interface to bridge", "bridge", session.bridgeName)
+	if err := runCommandContext(ctx, session.ip("link", "set", session.vxlanName, "master", session.bridgeName)...); err != nil {
+		return fmt.Errorf("failed to attach VXLAN interface %s to bridge %s: %v", session.vxlanName, session.bridgeName, err)
+	}
+
+	logger.Info("Bringing up VXLAN interface")
+	if err := runCommandContext(ctx, session.ip("link", "set", session.vxlanName, "up")...); err != nil {
+		return fmt.Errorf("failed to bring up VXLAN interface %s: %v", session.vxlanName, err)
+	}
 	return nil
 }
 
-// cleanupNetwork removes the session's network interfaces
-func cleanupNetwork(session *Session) error {
-	commands := [][]string{
-		{"ip", "link", "set", session.bridgeName, "down"},
-		{"ip", "link", "delete", session.bridgeName, "type", "bridge"},
+// bridgeParams returns the "ip link set ... type bridge" parameters requested for the session.
+// Time values are given to the kernel in centiseconds.
+func bridgeParams(opts sessionOptions) []string {
+	var params []string
+	if opts.bridgeStp >= 0 {
+		params = append(params, "stp_state", strconv.Itoa(opts.bridgeStp))
+	}
+	if opts.bridgeForwardDelay >= 0 {
+		params = append(params, "forward_delay", strconv.Itoa(opts.bridgeForwardDelay*100))
+	}
+	if opts.bridgeAgeingTime >= 0 {
+		params = append(params, "ageing_time", strconv.Itoa(opts.bridgeAgeingTime*100))
+	}
+	if opts.bridgeVlanFiltering >= 0 {
+		params = append(params, "vlan_filtering", strconv.Itoa(opts.bridgeVlanFiltering))
+	}
+	return params
+}
+
+// bridgeOwner describes what else holds a bridge name: another tracked or pooled session with a
+// bridge of that name, or a session recorded by a previous run. It returns "" when the name is free
+// to reclaim.
+func bridgeOwner(session *Session, bridge string) string {
+	sessionsMu.RLock()
+	defer sessionsMu.RUnlock()
+	for id, other := range sessions {
+		if other != session && hasBridge(other, bridge) {
+			return "session " + id
+		}
+	}
+	for _, other := range warmPool {
+		if other != session && hasBridge(other, bridge) {
+			return "pooled session " + other.hash
+		}
+	}
+	if hasSessionState(session.hash) {
+		return "a session recorded by a previous run"
+	}
+	return ""
+}
+
+// hasBridge reports whether bridge is one of the session's bridges
+func hasBridge(session *Session, bridge string) bool {
+	for _, b := range session.bridges {
+		if b == bridge {
+			return true
+		}
+	}
+	return false
+}
+
+// bridgeOwnedError is returned by setupNetwork when one of the session's bridges already exists
+// and belongs to someone else. Nothing of the other owner's may be cleaned up after it.
+type bridgeOwnedError struct {
+	bridge string
+	owner  string
+}
+
+func (e *bridgeOwnedError) Error() string {
+	return fmt.Sprintf("bridge %s already exists and belongs to %s", e.bridge, e.owner)
+}
+
+// cleanupNetwork removes the session's network interfaces, DHCP server, NAT rules, and subnet reservation
+func cleanupNetwork(ctx context.Context, session *Session) error {
+	logger := requestLogger(ctx).With("session", session.hash)
+	stopDHCP(session)
+	cleanupNAT(session)
+	defer releaseSubnet(session)
+
+	// Bridge members are detached and deleted before the bridge itself, in a fixed order,
+	// so the kernel never has to tear down a bridge that still has ports
+	members := session.taps()
+	if session.vxlanName != "" {
+		members = append(members, session.vxlanName)
 	}
 
-	for _, tap := range session.tapNames {
-		commands = append(commands, []string{"ip", "link", "set", tap, "down"})
-		commands = append(commands, []string{"ip", "link", "delete", tap})
+	var commands [][]string
+	for _, member := range members {
+		commands = append(commands,
+			session.ip("link", "set", member, "nomaster"),
+			session.ip("link", "set", member, "down"),
+			session.ip("link", "delete", member),
+		)
+	}
+	for _, bridge := range session.bridges {
+		commands = append(commands,
+			session.ip("link", "set", bridge, "down"),
+			session.ip("link", "delete", bridge, "type", "bridge"),
+		)
+	}
+
+	// Deleting the namespace also destroys any virtual interface that is still inside it
+	if session.netns != "" {
+		commands = append(commands, []string{"ip", "netns", "delete", session.netns})
 	}
 
 	for _, cmdArgs := range commands {
 		if err := runCommand(cmdArgs...); err != nil {
-			if strings.Contains(err.Error(), "Cannot find device") || strings.Contains(err.Error(), "No such device") {
-				continue // Device already removed or does not exist
+			var cmdErr *commandError
+			if errors.As(err, &cmdErr) && cmdErr.deviceMissing() {
+				continue // Device or namespace already removed or does not exist
 			}
-			log.Printf("Error executing cleanup command %v: %v", cmdArgs, err)
+			logger.Error("Error executing cleanup command", "command", strings.Join(cmdArgs, " "), "err", err)
 		} else {
-			log.Printf("Successfully executed cleanup command: %v", cmdArgs)
+			logger.Info("Executed cleanup command", "command", strings.Join(cmdArgs, " "))
 		}
 	}
 
 	return nil
 }
 
-// interfaceExists checks if a network interface with the given name exists
-func interfaceExists(name string) (bool, error) {
-	cmd := exec.Command("ip", "link", "show", name)
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		if strings.Contains(string(output), "does not exist") ||
-			strings.Contains(string(output), "Cannot find device") ||
-			strings.Contains(string(output), "No such device") {
+// interfaceExists checks if a network interface with the given name exists,
+// looking inside the given network namespace unless it is empty
+func interfaceExists(netns, name string) (bool, error) {
+	args := []string{"link", "show", name}
+	if netns != "" {
+		args = append([]string{"-n", netns}, args...)
+	}
+	if err := runCommand(append([]string{"ip"}, args...)...); err != nil {
+		var cmdErr *commandError
+		if errors.As(err, &cmdErr) && cmdErr.deviceMissing() {
 			return false, nil
 		}
-		return false, fmt.Errorf("error executing 'ip link show %s': %v, output: %s", name, err, string(output))
+		return false, err
 	}
 	return true, nil // Interface exists
 }
 
+// ip returns an "ip" command line that operates inside the session's network namespace, if it has one
+func (s *Session) ip(args ...string) []string {
+	if s.netns != "" {
+		return append([]string{"ip", "-n", s.netns}, args...)
+	}
+	return append([]string{"ip"}, args...)
+}
+
+// commandError is returned by runCommand when a command fails, so callers can tell failures apart
+type commandError struct {
+	args     []string
+	exitCode int    // -1 if the command didn't exit on its own, e.g. because it timed out
+	stdout   string // Output is kept separately since tools like ip print their diagnostics to stderr
+	stderr   string
+	err      error
+}
+
+func (e *commandError) Error() string {
+	msg := fmt.Sprintf("command '%s' failed: %v", strings.Join(e.args, " "), e.err)
+	if e.stderr != "" {
+		msg += ", stderr: " + e.stderr
+	}
+	if e.stdout != "" {
+		msg += ", stdout: " + e.stdout
+	}
+	return msg
+}
+
+func (e *commandError) Unwrap() error {
+	return e.err
+}
+
+// deviceMissing reports whether the command failed because the device or namespace it was given
+// doesn't exist
+func (e *commandError) deviceMissing() bool {
+	for _, msg := range []string{"does not exist", "Cannot find device", "No such device", "Cannot open network namespace"} {
+		if strings.Contains(e.stderr, msg) {
+			return true
+		}
+	}
+	return false
+}
+
 // runCommand executes a system command and returns an error if it occurred
 func runCommand(args ...string) error {
+	return runCommandContext(context.Background(), args...)
+}
+
+// runCommandContext is runCommand with a context that kills the command when it ends. Either way
+// a command is killed after commandTimeout, so a hung ip or iptables can't block its caller forever.
+func runCommandContext(ctx context.Context, args ...string) error {
+	_, err := runCommandOutput(ctx, args...)
+	return err
+}
+
+// runCommandOutput is runCommandContext for commands whose standard output the caller parses
+func runCommandOutput(ctx context.Context, args ...string) (string, error) {
 	if len(args) == 0 {
-		return fmt.Errorf("no command provided")
+		return "", fmt.Errorf("no command provided")
 	}
+	return commandRunner(ctx, args...)
+}
 
-	cmd := exec.Command(args[0], args[1:]...)
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("command '%s' failed: %v, output: %s", strings.Join(args, " "), err, string(output))
+// commandRunner runs the host commands issued through runCommand and runCommandOutput, which
+// covers all of the network setup and cleanup. Tests can swap it out to record the exact command
+// sequence without root, and to fake failures such as a *commandError whose stderr reports
+// "Cannot find device".
+var commandRunner = execCommand
+
+// execCommand runs a command on the host and returns its standard output, or a *commandError if
+// it fails
+func execCommand(ctx context.Context, args ...string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, commandTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	var stdout, stderr strings.Builder
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	// Don't wait for output from children that outlive a killed command
+	cmd.WaitDelay = time.Second
+	err := cmd.Run()
+	if err == nil {
+		return stdout.String(), nil
+	}
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		if errors.Is(ctxErr, context.DeadlineExceeded) {
+			err = fmt.Errorf("timed out after %v", commandTimeout)
+		} else {
+			err = ctxErr
+		}
+	}
+	exitCode := -1
+	if cmd.ProcessState != nil {
+		exitCode = cmd.ProcessState.ExitCode()
+	}
+	return "", &commandError{
+		args:     args,
+		exitCode: exitCode,
+		stdout:   strings.TrimSpace(stdout.String()),
+		stderr:   strings.TrimSpace(stderr.String()),
+		err:      err,
 	}
-	return nil
 }
 
-// startMachine launches a virtual machine and connects it to the TAP device
-func startMachine(session *Session, machineID string, tapDevice string) error {
-	netDevID := fmt.Sprintf("net%s", machineID)
-
+// startMachine launches a virtual machine and connects it to its TAP devices
+func startMachine(ctx context.Context, session *Session, machineID string) error {
 	// Ensure machineID is a valid digit and convert to integer
 	if len(machineID) != 1 || machineID[0] < '0' || machineID[0] > '9' {
 		return fmt.Errorf("invalid machine ID: %s", machineID)
 	}
 	machineNum := int(machineID[0] - '0') // Convert '1' -> 1, '2' -> 2, etc.
+	logger := requestLogger(ctx).With("session", session.hash, "machine", machineID)
 
-	macSuffix := 100 + machineNum // Example: 1 -> 101, 2 -> 102
+	// Guest writes go to QEMU's temporary -snapshot overlay unless the machine gets its own overlay
+	// file or, with disk=persistent, writes to the image itself
+	disk := images[session.opts.image]
+	sessionsMu.RLock()
+	incoming := session.incoming[machineID]
+	sessionsMu.RUnlock()
+	if incoming != "" {
+		disk = overlayPath(session, machineID) // Unpacked from the import bundle, matching the saved state
+	} else if session.opts.diskOverlay {
+		var err error
+		if disk, err = machineOverlay(ctx, session, machineID); err != nil {
+			return err
+		}
+	}
 
-	cmd := exec.Command("qemu-system-x86_64",
-		"-accel", "kvm",
-		"-drive", fmt.Sprintf("file=debian-12-nocloud-amd64.qcow2,format=qcow2,if=virtio"),
+	// Boot-time settings such as the hostname reach the guest on a cloud-init seed drive
+	seed, err := machineSeed(ctx, session, machineID)
+	if err != nil {
+		return err
+	}
+
+	// The main serial port is QEMU's stdio, or with -console-socket a socket the server connects to
+	consoleChardev := "stdio,id=char0,signal=off"
+	var socketPath string
+	if consoleSockets {
+		socketPath = consoleSocketPath(session, machineID)
+		if err := os.Remove(socketPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			logger.Error("Error removing stale console socket", "path", socketPath, "err", err)
+		}
+		consoleChardev = fmt.Sprintf("socket,id=char0,path=%s,server=on,wait=off", qemuEscape(socketPath))
+	}
+
+	args := []string{
+		"-accel", qemuAccel,
+		"-drive", fmt.Sprintf("file=%s,format=qcow2,if=virtio", qemuEscape(disk)),
 		"-display", "none",
-		"-netdev", fmt.Sprintf("tap,ifname=%s,id=%s,script=no,downscript=no", tapDevice, netDevID),
-		"-device", fmt.Sprintf("virtio-net-pci,netdev=%s,mac=e6:c8:ff:09:76:%02x", netDevID, macSuffix),
-		"-chardev", "stdio,id=char0,signal=off",
+		"-chardev", consoleChardev,
 		"-serial", "chardev:char0",
-		"-m", "256",
-		"-snapshot",
+		"-m", strconv.Itoa(session.opts.memMB),
+		"-smp", strconv.Itoa(session.opts.vcpus),
 		"-sandbox", "on",
-	)
+	}
+	if seed != "" {
+		args = append(args, "-drive", fmt.Sprintf("file=%s,format=raw,if=virtio,readonly=on", qemuEscape(seed)))
+	}
+	// One NIC per network the machine is on, in order, so the guest names them predictably
+	template := templates[session.opts.template]
+	nicModel := "virtio-net-pci"
+	if template.NICModel != "" {
+		nicModel = template.NICModel
+	}
+	for i, nic := range session.nics[machineID] {
+		netDevID := fmt.Sprintf("net%s-%d", machineID, i)
+		args = append(args,
+			"-netdev", fmt.Sprintf("tap,ifname=%s,id=%s,script=no,downscript=no", nic.tap, netDevID),
+			"-device", fmt.Sprintf("%s,netdev=%s,mac=%s", nicModel, netDevID, machineMAC(session.hash, machineNum, i)))
+	}
+	if !session.opts.diskOverlay && !session.opts.diskPersistent {
+		args = append(args, "-snapshot")
+	}
+	args = append(args, memoryBackingArgs(session.opts)...)
+	args = append(args, session.opts.rtc.args()...)
+	args = append(args, template.Args...)
+	if incoming != "" {
+		// QEMU loads the exported RAM and device state and then resumes the guest where it was.
+		// It reads the file after starting, so the file stays until the working directory is removed.
+		args = append(args, "-incoming", "exec:cat "+shellQuote(incoming))
+	}
+
+	// QEMU starts right inside the session's cgroup, so it is never briefly unlimited
+	var cgroupDir *os.File
+	if session.cgroup != "" {
+		var err error
+		if cgroupDir, err = os.Open(session.cgroup); err != nil {
+			return fmt.Errorf("error opening cgroup for machine %s: %v", machineID, err)
+		}
+		defer func() {
+			if err := cgroupDir.Close(); err != nil {
+				logger.Error("Error closing cgroup directory", "err", err)
+			}
+		}()
+	}
+
+	// The auxiliary console and the serial ports after the first get their own PTYs which QEMU opens
+	// by path. They are closed along with the main PTY if the machine doesn't come up.
+	var secondaryPtys []*os.File
+	closeSecondaryPtys := func() {
+		for _, f := range secondaryPtys {
+			_ = f.Close() // Best effort
+		}
+	}
+	var auxPty, auxTty *os.File
+	if session.opts.auxConsole != "" {
+		var err error
+		auxPty, auxTty, err = pty.Open()
+		if err != nil {
+			return fmt.Errorf("error opening auxiliary PTY for machine %s: %v", machineID, err)
+		}
+		secondaryPtys = append(secondaryPtys, auxPty)
+		defer func() {
+			if err := auxTty.Close(); err != nil {
+				logger.Error("Error closing auxiliary TTY", "err", err)
+			}
+		}()
+		args = append(args, "-chardev", fmt.Sprintf("serial,id=aux0,path=%s", auxTty.Name()))
+		if session.opts.auxConsole == "virtio" {
+			args = append(args, "-device", "virtio-serial-pci", "-device", "virtconsole,chardev=aux0")
+		} else {
+			args = append(args, "-serial", "chardev:aux0")
+		}
+	}
+	var serialPtys []*os.File
+	for i := 1; i < session.opts.serialPorts; i++ {
+		serialPty, serialTty, err := pty.Open()
+		if err != nil {
+			closeSecondaryPtys()
+			return fmt.Errorf("error opening PTY of serial port %d for machine %s: %v", i, machineID, err)
+		}
+		defer func() {
+			if err := serialTty.Close(); err != nil {
+				logger.Error("Error closing serial port TTY", "err", err)
+			}
+		}()
+		secondaryPtys = append(secondaryPtys, serialPty)
+		serialPtys = append(serialPtys, serialPty)
+		chardev := fmt.Sprintf("serial%d", i)
+		args = append(args, "-chardev", fmt.Sprintf("serial,id=%s,path=%s", chardev, serialTty.Name()), "-serial", "chardev:"+chardev)
+	}
+
+	// Advanced mode: expose QMP so the server can forward VM state changes to clients
+	var qmpPath string
+	if qmpEvents {
+		qmpPath = filepath.Join(session.workDir, fmt.Sprintf("qmp-%s.sock", machineID))
+		if err := os.Remove(qmpPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			logger.Error("Error removing stale QMP socket", "path", qmpPath, "err", err)
+		}
+		args = append(args, "-qmp", fmt.Sprintf("unix:%s,server=on,wait=off", qmpPath))
+	}
+	// A second QMP monitor for commands, since the event watcher keeps the first one busy. Pooled
+	// sessions use it to pause their machines while they wait.
+	var qmpControlPath string
+	if session.opts.snapshots || session.pooled {
+		qmpControlPath = filepath.Join(session.workDir, fmt.Sprintf("qmp-ctl-%s.sock", machineID))
+		if err := os.Remove(qmpControlPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			logger.Error("Error removing stale QMP socket", "path", qmpControlPath, "err", err)
+		}
+		args = append(args, "-qmp", fmt.Sprintf("unix:%s,server=on,wait=off", qmpControlPath))
+	}
+
+	var consoleLog *os.File
+	if consoleLogDir != "" {
+		// Appending keeps the earlier output when a machine is restarted
+		path := filepath.Join(consoleLogDir, fmt.Sprintf("%s-%s.log", session.hash, machineID))
+		var err error
+		if consoleLog, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600); err != nil {
+			closeSecondaryPtys()
+			return fmt.Errorf("error opening console log for machine %s: %v", machineID, err)
+		}
+	}
+
+	cmd := exec.Command(qemuBinary, args...)
+	if session.netns != "" {
+		// ip netns exec execs QEMU in place, so the process (and its PID) is still QEMU
+		cmd = exec.Command("ip", append([]string{"netns", "exec", session.netns, qemuBinary}, args...)...)
+	}
+	if cgroupDir != nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{UseCgroupFD: true, CgroupFD: int(cgroupDir.Fd())}
+	}
+	// pty.Start runs QEMU in a new session, which also makes it the leader of a new process group
+	// that terminateMachine signals as a whole. Setpgid must not be set on top: setsid fails for a
+	// process that already leads a group.
 
 	// Start QEMU and get the PTY connected to its stdin/stdout
 	ptmx, err := pty.Start(cmd)
 	if err != nil {
+		closeSecondaryPtys()
+		if consoleLog != nil {
+			_ = consoleLog.Close() // Best effort
+		}
 		return fmt.Errorf("error starting QEMU machine %s: %v", machineID, err)
 	}
+	proc := reapMachine(cmd)
+	if ptmx, err = pollablePTY(ptmx); err != nil {
+		logger.Warn("Error making PTY pollable", "err", err)
+	}
 
+	// The streams read the consoles from now on, whether or not a client is attached. With
+	// -console-socket, the stream of the PTY only carries QEMU's own messages.
+	stdioLog := consoleLog
+	if consoleSockets {
+		stdioLog = nil
+	}
+	stdio := newConsoleStream(machineID, ptmx, stdioLog, proc)
+	var auxConsole *consoleStream
+	if auxPty != nil {
+		auxConsole = newConsoleStream(consoleKey(machineID, "aux"), auxPty, nil, proc)
+	}
+	serialConsoles := make([]*consoleStream, len(serialPtys))
+	for i, serialPty := range serialPtys {
+		serialConsoles[i] = newConsoleStream(consoleKey(machineID, fmt.Sprintf("tty%d", i+1)), serialPty, nil, proc)
+	}
+	startup, _ := stdio.subscribe(false)
+	go stdio.run()
+	if auxConsole != nil {
+		go auxConsole.run()
+	}
+	for _, serialConsole := range serialConsoles {
+		go serialConsole.run()
+	}
+
+	// Connect before the startup grace period, since QEMU drops what the guest prints meanwhile
+	var consoleConn net.Conn
+	if consoleSockets {
+		if consoleConn, err = dialConsoleSocket(ctx, socketPath, proc.done); err != nil {
+			if err := terminateMachine(proc); err != nil {
+				logger.Error("Error terminating machine without console socket", "err", err)
+			}
+			_ = ptmx.Close() // Best effort
+			closeSecondaryPtys()
+			if consoleLog != nil {
+				_ = consoleLog.Close() // Best effort
+			}
+			return fmt.Errorf("startup of machine %s aborted: %w", machineID, err)
+		}
+	}
+	closeConsoleSocket := func() {
+		if consoleConn != nil {
+			_ = consoleConn.Close() // Best effort
+		}
+		if consoleSockets && consoleLog != nil {
+			_ = consoleLog.Close() // Best effort
+		}
+	}
+
+	// QEMU exits right away on errors such as a missing image or unusable KVM. The process is
+	// long-lived, so ctx only governs this startup phase rather than being bound to it with
+	// exec.CommandContext, which would kill the VM once the request ends.
+	exited, output, err := awaitQEMUStartup(ctx, stdio, startup)
+	if err != nil {
+		if err := terminateMachine(proc); err != nil {
+			logger.Error("Error terminating machine after aborted startup", "err", err)
+		}
+		_ = ptmx.Close() // Best effort
+		closeSecondaryPtys()
+		closeConsoleSocket()
+		return fmt.Errorf("startup of machine %s aborted: %w", machineID, err)
+	}
+	if exited {
+		<-proc.done      // The exit status adds nothing to QEMU's messages
+		_ = ptmx.Close() // Best effort
+		closeSecondaryPtys()
+		closeConsoleSocket()
+		startErr := &machineStartError{machineID: machineID, reason: qemuStartupReason(output)}
+		logger.Error("QEMU exited during startup", "output", strings.TrimSpace(string(output)))
+		return startErr
+	}
+
+	console := stdio
+	if consoleConn != nil {
+		console = newConsoleStream(machineID, consoleConn, consoleLog, proc)
+		go console.run()
+	}
+
+	sessionsMu.Lock()
 	session.ptyFiles[machineID] = ptmx
-	session.cmds[machineID] = cmd
+	session.consoles[machineID] = console
+	if consoleConn != nil {
+		session.consoleConns[machineID] = consoleConn
+	}
+	if auxPty != nil {
+		session.auxPtys[machineID] = auxPty
+		session.consoles[auxConsole.name] = auxConsole
+	}
+	if len(serialPtys) > 0 {
+		session.serialPtys[machineID] = serialPtys
+		for _, serialConsole := range serialConsoles {
+			session.consoles[serialConsole.name] = serialConsole
+		}
+	}
+	session.procs[machineID] = proc
+	if qmpControlPath != "" {
+		session.qmpSockets[machineID] = qmpControlPath
+	}
+	// The saved state is only loaded on the first start
+	delete(session.incoming, machineID)
+	sessionsMu.Unlock()
+
+	go watchMachine(session, machineID, proc)
+	if qmpPath != "" {
+		go watchQMPEvents(session, machineID, qmpPath)
+	}
+
+	logger.Info("Virtual machine started", "pid", cmd.Process.Pid)
+	return nil
+}
+
+// machineMAC returns the MAC address of a machine's NIC, e.g. e6:c8:3f:a2:9b:01 for the first NIC of
+// machine 1 of session 3fa29b. The session ID fills three octets and the last holds the NIC index
+// in its high and the machine number in its low nibble, so MACs are distinct across all live
+// sessions, not just within one. 0xe6 keeps the locally administered bit set and the multicast bit clear.
+func machineMAC(sessionID string, machineNum, nic int) string {
+	return fmt.Sprintf("e6:c8:%s:%s:%s:%02x", sessionID[0:2], sessionID[2:4], sessionID[4:6], nic<<4|machineNum)
+}
+
+// parseImageList parses a comma-separated list of name=path image entries
+func parseImageList(list string) (map[string]string, error) {
+	result := make(map[string]string)
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, path, ok := strings.Cut(entry, "=")
+		if !ok || name == "" || path == "" {
+			return nil, fmt.Errorf("invalid image entry %q (expected name=path)", entry)
+		}
+		if _, exists := result[name]; exists {
+			return nil, fmt.Errorf("duplicate image name %q", name)
+		}
+		result[name] = path
+	}
+	if len(result) == 0 {
+		return nil, fmt.Errorf("no images configured")
+	}
+	return result, nil
+}
+
+// parseOriginList parses a comma-separated list of scheme://host[:port] origins
+func parseOriginList(list string) ([]string, error) {
+	var result []string
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		u, err := url.Parse(entry)
+		if err != nil || u.Scheme == "" || u.Host == "" || (u.Path != "" && u.Path != "/") {
+			return nil, fmt.Errorf("invalid origin %q (expected scheme://host[:port])", entry)
+		}
+		result = append(result, strings.ToLower(u.Scheme+"://"+u.Host))
+	}
+	return result, nil
+}
+
+// checkOrigin decides whether a WebSocket upgrade may proceed. Browsers always send Origin,
+// so a foreign page can't open a shell on behalf of a visitor; requests without one come
+// from non-browser clients and are allowed.
+func checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	logger := requestLogger(r.Context()).With("session", r.URL.Query().Get("sessionID"), "remote", r.RemoteAddr)
+	if len(allowedOrigins) > 0 {
+		for _, allowed := range allowedOrigins {
+			if strings.EqualFold(origin, allowed) {
+				return true
+			}
+		}
+		logger.Warn("Rejected WebSocket from a disallowed origin", "origin", origin)
+		return false
+	}
+	u, err := url.Parse(origin)
+	if err != nil || !strings.EqualFold(u.Host, r.Host) {
+		logger.Warn("Rejected WebSocket from a foreign origin", "origin", origin, "host", r.Host)
+		return false
+	}
+	return true
+}
 
-	log.Printf("Virtual machine %s in session %s started\n", machineID, session.hash)
+// qemuEscape escapes a value for use inside a comma-separated QEMU option string
+func qemuEscape(value string) string {
+	return strings.ReplaceAll(value, ",", ",,")
+}
+
+// resolveAccel turns the -accel mode into the accelerator QEMU is started with. auto picks KVM when
+// /dev/kvm can be opened and falls back to the much slower TCG emulation otherwise.
+func resolveAccel(mode string) (string, error) {
+	switch mode {
+	case "kvm", "tcg":
+		return mode, nil
+	case "auto":
+		if err := checkReadableWritable("/dev/kvm"); err != nil {
+			slog.Warn("KVM is not available, falling back to TCG", "err", err)
+			return "tcg", nil
+		}
+		return "kvm", nil
+	default:
+		return "", fmt.Errorf("unknown mode %q (expected kvm, tcg or auto)", mode)
+	}
+}
+
+// memoryBackingArgs returns the QEMU arguments for the session's guest memory backing.
+// With no options set the guest keeps QEMU's default anonymous memory.
+func memoryBackingArgs(opts sessionOptions) []string {
+	if opts.numaNode >= 0 {
+		backend := fmt.Sprintf("memory-backend-ram,id=mem0,size=%dM,host-nodes=%d,policy=bind", opts.memMB, opts.numaNode)
+		if opts.memBacking == "hugepages" {
+			backend = fmt.Sprintf("memory-backend-file,id=mem0,size=%dM,mem-path=%s,prealloc=on,host-nodes=%d,policy=bind",
+				opts.memMB, hugepagesPath, opts.numaNode)
+		}
+		return []string{"-object", backend, "-numa", "node,memdev=mem0"}
+	}
+	if opts.memBacking == "hugepages" {
+		return []string{"-mem-path", hugepagesPath, "-mem-prealloc"}
+	}
 	return nil
 }
+
+// pollablePTY switches a PTY master to non-blocking mode so it is driven by the Go netpoller.
+// This makes read deadlines work and lets Close interrupt a blocked Read. On failure the
+// original blocking file is returned unchanged along with the error.
+func pollablePTY(f *os.File) (*os.File, error) {
+	rawConn, err := f.SyscallConn()
+	if err != nil {
+		return f, err
+	}
+
+	dup, dupErr := -1, error(nil)
+	err = rawConn.Control(func(fd uintptr) {
+		syscall.ForkLock.RLock()
+		defer syscall.ForkLock.RUnlock()
+		if dup, dupErr = syscall.Dup(int(fd)); dupErr != nil {
+			return
+		}
+		syscall.CloseOnExec(dup)
+		dupErr = syscall.SetNonblock(dup, true)
+	})
+	if err == nil {
+		err = dupErr
+	}
+	if err != nil {
+		if dup >= 0 {
+			_ = syscall.Close(dup) // Best effort
+		}
+		return f, err
+	}
+
+	name := f.Name()
+	if err := f.Close(); err != nil {
+		slog.Error("Error closing blocking PTY", "pty", name, "err", err)
+	}
+	return os.NewFile(uintptr(dup), name), nil
+}
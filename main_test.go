@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestMachineMACUnique(t *testing.T) {
+	sessionIDs := map[string]bool{"000000": true, "ffffff": true, "0f0f0f": true}
+	for len(sessionIDs) < 1000 {
+		hash, err := generateShortHash(sessionIDLength)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sessionIDs[hash] = true
+	}
+
+	seen := make(map[string]string)
+	for sessionID := range sessionIDs {
+		for machineNum := 1; machineNum <= 9; machineNum++ {
+			for nic := 0; nic <= maxExtraNetworks; nic++ {
+				mac := machineMAC(sessionID, machineNum, nic)
+				hw, err := net.ParseMAC(mac)
+				if err != nil {
+					t.Fatalf("machineMAC(%q, %d, %d) = %q: %v", sessionID, machineNum, nic, mac, err)
+				}
+				if hw[0]&0x02 == 0 {
+					t.Errorf("%s is not locally administered", mac)
+				}
+				if hw[0]&0x01 != 0 {
+					t.Errorf("%s is a multicast address", mac)
+				}
+				owner := fmt.Sprintf("NIC %d of machine %d of session %s", nic, machineNum, sessionID)
+				if other, ok := seen[hw.String()]; ok {
+					t.Fatalf("%s is the MAC of both %s and %s", mac, other, owner)
+				}
+				seen[hw.String()] = owner
+			}
+		}
+	}
+}
+
+func TestUTF8BoundarySplitRunes(t *testing.T) {
+	for _, r := range []string{"é", "€", "😀"} {
+		text := "a" + r + "b"
+		for offset := 0; offset <= len(text); offset++ {
+			var b utf8Boundary
+			first := b.complete([]byte(text[:offset]))
+			second := b.complete([]byte(text[offset:]))
+			if !utf8.Valid(first) || !utf8.Valid(second) {
+				t.Errorf("%q split at %d: frames %q and %q are not valid UTF-8", text, offset, first, second)
+			}
+			if got := string(first) + string(second); got != text {
+				t.Errorf("%q split at %d: got %q then %q", text, offset, first, second)
+			}
+			if rest := b.flush(); rest != nil {
+				t.Errorf("%q split at %d: %q left over", text, offset, rest)
+			}
+		}
+	}
+}
+
+func TestUTF8BoundaryByteAtATime(t *testing.T) {
+	text := "é€😀 done"
+	var b utf8Boundary
+	var got []byte
+	for i := 0; i < len(text); i++ {
+		frame := b.complete([]byte{text[i]})
+		if !utf8.Valid(frame) {
+			t.Fatalf("byte %d: frame %q is not valid UTF-8", i, frame)
+		}
+		got = append(got, frame...)
+	}
+	if string(got) != text {
+		t.Errorf("got %q, want %q", got, text)
+	}
+}
+
+func TestUTF8BoundaryInvalid(t *testing.T) {
+	tests := []struct {
+		name   string
+		chunks []string
+		want   string
+	}{
+		{"invalid byte", []string{"a\xffb"}, "a\uFFFDb"},
+		{"stray continuation byte", []string{"a\x80b"}, "a\uFFFDb"},
+		{"truncated sequence before ASCII", []string{"a\xe2\x82b"}, "a\uFFFDb"},
+		{"truncated sequence across chunks", []string{"a\xe2", "\x82b"}, "a\uFFFDb"},
+		{"overlong encoding", []string{"\xc0\xafx"}, "\uFFFDx"},
+		{"surrogate", []string{"\xed\xa0\x80x"}, "\uFFFDx"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b utf8Boundary
+			var got []byte
+			for _, chunk := range tt.chunks {
+				got = append(got, b.complete([]byte(chunk))...)
+			}
+			got = append(got, b.flush()...)
+			if string(got) != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUTF8BoundaryPartialRuneAtEOF(t *testing.T) {
+	for _, partial := range []string{"\xc3", "\xe2\x82", "\xf0\x9f\x98"} {
+		var b utf8Boundary
+		if got := b.complete([]byte("ok" + partial)); string(got) != "ok" {
+			t.Errorf("complete(%q) = %q, want %q with the rest held back", "ok"+partial, got, "ok")
+		}
+		if got := b.flush(); string(got) != "\uFFFD" {
+			t.Errorf("flush after %q = %q, want U+FFFD", partial, got)
+		}
+		if got := b.flush(); got != nil {
+			t.Errorf("second flush after %q = %q, want nothing", partial, got)
+		}
+	}
+}
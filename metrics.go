@@ -0,0 +1,72 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Prometheus metrics served on /metrics. They carry no session IDs, so the endpoint is safe to
+// leave unauthenticated for scrapers.
+var (
+	sessionsCreated = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "vmshell_sessions_created_total",
+		Help: "Sessions created successfully.",
+	})
+	sessionsClosed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "vmshell_sessions_closed_total",
+		Help: "Sessions cleaned up, by reason (client, timeout, shutdown, crash, admin, lifetime).",
+	}, []string{"reason"})
+	vmStartFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "vmshell_vm_start_failures_total",
+		Help: "Virtual machines that failed to start, including restarts.",
+	})
+	machineCrashes = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "vmshell_vm_crashes_total",
+		Help: "Virtual machines whose QEMU process exited without being stopped by the server.",
+	})
+	wsConnections = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "vmshell_websocket_connections",
+		Help: "WebSocket connections currently attached to a machine.",
+	})
+	wsRejected = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "vmshell_websocket_connections_rejected_total",
+		Help: "WebSocket connections closed right after the upgrade for exceeding a connection limit.",
+	})
+	consoleOutputDropped = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "vmshell_console_output_dropped_bytes_total",
+		Help: "Console output bytes dropped for WebSocket clients that read too slowly.",
+	})
+
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "vmshell_sessions_active",
+		Help: "Sessions currently running.",
+	}, func() float64 {
+		sessionsMu.RLock()
+		defer sessionsMu.RUnlock()
+		return float64(len(sessions))
+	})
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "vmshell_warm_pool_sessions",
+		Help: "Sessions ready in the warm pool.",
+	}, func() float64 {
+		sessionsMu.RLock()
+		defer sessionsMu.RUnlock()
+		return float64(len(warmPool))
+	})
+	_ = promauto.NewCounterFunc(prometheus.CounterOpts{
+		Name: "vmshell_pty_reader_restarts_total",
+		Help: "PTY reads resumed after a recoverable error.",
+	}, func() float64 {
+		return float64(ptyReaderRestarts.Load())
+	})
+)
+
+// Reasons recorded in vmshell_sessions_closed_total
+const (
+	closeReasonClient   = "client"
+	closeReasonTimeout  = "timeout"
+	closeReasonShutdown = "shutdown"
+	closeReasonCrash    = "crash"
+	closeReasonAdmin    = "admin"
+	closeReasonLifetime = "lifetime"
+)
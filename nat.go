@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// natUplink is the host interface that NAT'd sessions masquerade out of, empty disables NAT
+var natUplink string
+
+// iptablesRule is a rule added for a session, kept so exactly that rule can be deleted again
+type iptablesRule struct {
+	table string
+	chain string
+	spec  []string
+}
+
+// checkIPForwarding fails unless the kernel routes IPv4 packets between interfaces, which NAT relies on
+func checkIPForwarding() error {
+	data, err := os.ReadFile("/proc/sys/net/ipv4/ip_forward")
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(string(data)) != "1" {
+		return fmt.Errorf("IPv4 forwarding is disabled (run: sysctl -w net.ipv4.ip_forward=1)")
+	}
+	return nil
+}
+
+// setupNAT masquerades the session subnet out of the uplink and allows forwarding between the
+// bridge and the uplink only, so guests reach the internet but not other sessions' bridges.
+// Every rule carries a per-session comment and is recorded so cleanup removes only this session's rules.
+func setupNAT(session *Session) error {
+	subnet := session.subnet.String()
+	comment := []string{"-m", "comment", "--comment", "vmshell-" + session.hash}
+	rules := []iptablesRule{
+		{"nat", "POSTROUTING", append([]string{"-s", subnet, "-o", natUplink, "-j", "MASQUERADE"}, comment...)},
+		{"filter", "FORWARD", append([]string{"-i", session.bridgeName, "-o", natUplink, "-j", "ACCEPT"}, comment...)},
+		{"filter", "FORWARD", append([]string{"-i", natUplink, "-o", session.bridgeName,
+			"-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "ACCEPT"}, comment...)},
+	}
+
+	for _, rule := range rules {
+		slog.Info("Adding iptables rule", "session", session.hash, "table", rule.table, "chain", rule.chain, "rule", strings.Join(rule.spec, " "))
+		// Insert rather than append so the rules take effect ahead of restrictive FORWARD policies
+		args := append([]string{"iptables", "-w", "-t", rule.table, "-I", rule.chain}, rule.spec...)
+		if err := runCommand(args...); err != nil {
+			return fmt.Errorf("failed to add iptables rule to %s/%s: %v", rule.table, rule.chain, err)
+		}
+		session.natRules = append(session.natRules, rule)
+	}
+	return nil
+}
+
+// cleanupNAT deletes the iptables rules added by setupNAT for this session
+func cleanupNAT(session *Session) {
+	for _, rule := range session.natRules {
+		args := append([]string{"iptables", "-w", "-t", rule.table, "-D", rule.chain}, rule.spec...)
+		if err := runCommand(args...); err != nil {
+			slog.Error("Error deleting iptables rule", "session", session.hash, "table", rule.table, "chain", rule.chain, "err", err)
+		}
+	}
+	session.natRules = nil
+}
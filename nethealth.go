@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+var (
+	netHealthInterval time.Duration // How often session networks are verified, 0 disables the check
+	maxNetRepairs     = 3           // Cap on repairs per session and window so a hostile environment can't cause a loop
+	netRepairWindow   = time.Hour   // Period after which a session's repair count starts over
+)
+
+// networkHealthChecker periodically verifies that every session's bridge and TAP devices
+// still exist and repairs the bridge if it was deleted from outside the server
+func networkHealthChecker(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		sessionsMu.RLock()
+		list := make([]*Session, 0, len(sessions))
+		for _, session := range sessions {
+			list = append(list, session)
+		}
+		sessionsMu.RUnlock()
+
+		for _, session := range list {
+			checkSessionNetwork(session)
+		}
+	}
+}
+
+// checkSessionNetwork verifies one session's interfaces and attempts a rate-limited repair
+func checkSessionNetwork(session *Session) {
+	missing, err := missingInterfaces(session)
+	if err != nil {
+		slog.Error("Network health check failed", "session", session.hash, "err", err)
+		return
+	}
+	if len(missing) == 0 {
+		return
+	}
+
+	// Repairs are counted per window, so a session whose network was repaired long ago can be repaired
+	// again, while one that keeps breaking gives up until the window ends. The attempt past the limit
+	// is counted too, so giving up is reported once per window.
+	sessionsMu.Lock()
+	live := sessions[session.hash] == session
+	if now := time.Now(); now.Sub(session.repairsSince) >= netRepairWindow {
+		session.netRepairs, session.repairsSince = 0, now
+	}
+	attempt := session.netRepairs + 1
+	if live && attempt <= maxNetRepairs+1 {
+		session.netRepairs = attempt
+	}
+	sessionsMu.Unlock()
+	if !live {
+		return // Session was closed while being checked
+	}
+
+	slog.Warn("Session is missing network interfaces", "session", session.hash, "missing", missing)
+	if attempt > maxNetRepairs {
+		if attempt == maxNetRepairs+1 {
+			slog.Error("Giving up on repairing the network", "session", session.hash, "attempts", maxNetRepairs, "window", netRepairWindow)
+			notifyClients(session, map[string]any{"type": "network_lost", "missing": missing})
+		}
+		return
+	}
+
+	// Holding lifecycleMu keeps cleanupSession from tearing the network down mid-repair. Once the
+	// session is closed nothing may be recreated, or the recreated bridge would leak.
+	session.lifecycleMu.Lock()
+	if session.closed {
+		session.lifecycleMu.Unlock()
+		return
+	}
+	err = repairNetwork(session)
+	session.lifecycleMu.Unlock()
+	if err != nil {
+		slog.Error("Network repair failed", "session", session.hash, "attempt", attempt, "maxAttempts", maxNetRepairs, "err", err)
+		notifyClients(session, map[string]any{"type": "network_lost", "missing": missing, "error": err.Error()})
+		return
+	}
+
+	slog.Info("Network repaired", "session", session.hash, "attempt", attempt, "maxAttempts", maxNetRepairs)
+	notifyClients(session, map[string]any{"type": "network_restored", "missing": missing})
+}
+
+// missingInterfaces returns the session's interfaces that no longer exist on the host. The names
+// are copied under sessionsMu, since addMachine and removeMachine change the NICs concurrently, but
+// the probes run without it.
+func missingInterfaces(session *Session) ([]string, error) {
+	sessionsMu.RLock()
+	names := append(append([]string(nil), session.bridges...), session.taps()...)
+	if session.vxlanName != "" {
+		names = append(names, session.vxlanName)
+	}
+	sessionsMu.RUnlock()
+
+	var missing []string
+	for _, name := range names {
+		exists, err := interfaceExists(session.netns, name)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			missing = append(missing, name)
+		}
+	}
+	return missing, nil
+}
+
+// repairNetwork recreates deleted bridges and reattaches the session's interfaces to them.
+// Must be called with session.lifecycleMu held.
+// A deleted TAP device cannot be repaired here: QEMU holds the file descriptor of the
+// original device, so a recreated TAP would not be connected to the VM.
+func repairNetwork(session *Session) error {
+	for _, bridge := range session.bridges {
+		exists, err := interfaceExists(session.netns, bridge)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			if err := createBridge(context.Background(), session, bridge); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, id := range session.machineIDs() {
+		for _, nic := range session.nics[id] {
+			exists, err := interfaceExists(session.netns, nic.tap)
+			if err != nil {
+				return err
+			}
+			if !exists {
+				return fmt.Errorf("TAP device %s was deleted and cannot be reattached to its running VM", nic.tap)
+			}
+			if err := runCommand(session.ip("link", "set", nic.tap, "master", nic.bridge)...); err != nil {
+				return fmt.Errorf("failed to reattach TAP device %s to bridge %s: %v", nic.tap, nic.bridge, err)
+			}
+			if err := isolateNIC(session, nic); err != nil {
+				return err
+			}
+		}
+	}
+
+	if session.vxlanName != "" {
+		exists, err := interfaceExists(session.netns, session.vxlanName)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return setupVXLAN(context.Background(), session)
+		}
+		if err := runCommand(session.ip("link", "set", session.vxlanName, "master", session.bridgeName)...); err != nil {
+			return fmt.Errorf("failed to reattach VXLAN interface %s to bridge %s: %v", session.vxlanName, session.bridgeName, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+//go:build integration
+
+package main
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"testing"
+)
+
+// TestNetworkSetupAndCleanup creates a session network with two bridges in a throwaway namespace
+// and checks that cleanupNetwork removes every interface and the namespace itself. It needs root:
+//
+//	sudo go test -tags integration -run TestNetworkSetupAndCleanup
+func TestNetworkSetupAndCleanup(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("needs root to create network namespaces")
+	}
+	if _, err := exec.LookPath("ip"); err != nil {
+		t.Skip("needs the ip command")
+	}
+
+	hash, err := generateShortHash(sessionIDLength)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := sessionOptions{
+		machineCount:        2,
+		networks:            [][]string{{"2"}},
+		isolated:            map[string]bool{"1": true},
+		bridgeStp:           -1,
+		bridgeForwardDelay:  -1,
+		bridgeAgeingTime:    -1,
+		bridgeVlanFiltering: -1,
+	}
+	bridges, nics := sessionTopology(hash, opts)
+	session := &Session{
+		hash:       hash,
+		bridgeName: bridges[0],
+		bridges:    bridges,
+		nics:       nics,
+		netns:      "vmshell-test-" + hash,
+		opts:       opts,
+	}
+	// Deleting the namespace takes everything in it along, should the test fail halfway
+	t.Cleanup(func() { _ = exec.Command("ip", "netns", "delete", session.netns).Run() })
+
+	if err := setupNetwork(context.Background(), session); err != nil {
+		t.Fatalf("setupNetwork: %v", err)
+	}
+	interfaces := append(append([]string(nil), session.bridges...), session.taps()...)
+	if len(interfaces) != 5 {
+		t.Fatalf("got interfaces %v, want 2 bridges and 3 TAP devices", interfaces)
+	}
+	for _, name := range interfaces {
+		exists, err := interfaceExists(session.netns, name)
+		if err != nil {
+			t.Fatalf("checking %s: %v", name, err)
+		}
+		if !exists {
+			t.Errorf("%s missing after setupNetwork", name)
+		}
+	}
+	if missing, err := missingInterfaces(session); err != nil || len(missing) != 0 {
+		t.Errorf("missingInterfaces = %v, %v; want none", missing, err)
+	}
+
+	if err := cleanupNetwork(context.Background(), session); err != nil {
+		t.Fatalf("cleanupNetwork: %v", err)
+	}
+	for _, name := range interfaces {
+		if exists, err := interfaceExists("", name); err != nil || exists {
+			t.Errorf("%s still exists in the host namespace after cleanupNetwork (err %v)", name, err)
+		}
+	}
+	if err := exec.Command("ip", "netns", "exec", session.netns, "true").Run(); err == nil {
+		t.Errorf("namespace %s still exists after cleanupNetwork", session.netns)
+	}
+
+	// Cleaning up twice must not fail, since a session's cleanup may run again after a crash
+	if err := cleanupNetwork(context.Background(), session); err != nil {
+		t.Errorf("second cleanupNetwork: %v", err)
+	}
+}
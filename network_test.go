@@ -0,0 +1,383 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// stubCommands replaces commandRunner for the test, recording every command line. fail decides the
+// result of each command; a nil fail lets every command succeed.
+func stubCommands(t *testing.T, fail func(args []string) error) func() [][]string {
+	t.Helper()
+	var mu sync.Mutex
+	var calls [][]string
+	commandRunner = func(_ context.Context, args ...string) (string, error) {
+		mu.Lock()
+		calls = append(calls, args)
+		mu.Unlock()
+		if fail != nil {
+			return "", fail(args)
+		}
+		return "", nil
+	}
+	t.Cleanup(func() { commandRunner = execCommand })
+	return func() [][]string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([][]string(nil), calls...)
+	}
+}
+
+// missingDevice fails "ip link show" the way ip does for an interface that doesn't exist
+func missingDevice(args []string) error {
+	if len(args) >= 2 && args[len(args)-2] == "show" {
+		return &commandError{args: args, exitCode: 1, stderr: fmt.Sprintf("Device %q does not exist.", args[len(args)-1]), err: errors.New("exit status 1")}
+	}
+	return nil
+}
+
+// testNetworkSession returns a session with the given options and ID that exists only in memory
+func testNetworkSession(hash string, opts sessionOptions, netns string) *Session {
+	bridges, nics := sessionTopology(hash, opts)
+	return &Session{hash: hash, bridgeName: bridges[0], bridges: bridges, nics: nics, netns: netns, opts: opts}
+}
+
+// defaultBridgeOptions are session options that leave every bridge parameter at the kernel default
+func defaultBridgeOptions(machineCount int) sessionOptions {
+	return sessionOptions{machineCount: machineCount, bridgeStp: -1, bridgeForwardDelay: -1, bridgeAgeingTime: -1, bridgeVlanFiltering: -1}
+}
+
+func splitCommands(lines ...string) [][]string {
+	commands := make([][]string, len(lines))
+	for i, line := range lines {
+		commands[i] = strings.Fields(line)
+	}
+	return commands
+}
+
+func TestSetupNetworkCommands(t *testing.T) {
+	isolatedStp := defaultBridgeOptions(2)
+	isolatedStp.bridgeStp = 1
+	isolatedStp.bridgeForwardDelay = 4
+	isolatedStp.networks = [][]string{{"2"}}
+	isolatedStp.isolated = map[string]bool{"1": true}
+
+	tests := []struct {
+		name  string
+		opts  sessionOptions
+		netns string
+		want  [][]string
+	}{
+		{
+			name: "single machine",
+			opts: defaultBridgeOptions(1),
+			want: splitCommands(
+				"ip link show br-abc123",
+				"ip link add br-abc123 type bridge",
+				"ip link set br-abc123 up",
+				"ip tuntap add mode tap tap1-abc123",
+				"ip link set tap1-abc123 master br-abc123",
+				"ip link set tap1-abc123 up",
+			),
+		},
+		{
+			name:  "namespace, second network, isolated port and bridge parameters",
+			opts:  isolatedStp,
+			netns: "vmshell-abc123",
+			want: splitCommands(
+				"ip netns add vmshell-abc123",
+				"ip -n vmshell-abc123 link set lo up",
+				"ip -n vmshell-abc123 link show br-abc123",
+				"ip -n vmshell-abc123 link add br-abc123 type bridge",
+				"ip -n vmshell-abc123 link set br-abc123 type bridge stp_state 1 forward_delay 400",
+				"ip -n vmshell-abc123 link set br-abc123 up",
+				"ip -n vmshell-abc123 link show br2-abc123",
+				"ip -n vmshell-abc123 link add br2-abc123 type bridge",
+				"ip -n vmshell-abc123 link set br2-abc123 type bridge stp_state 1 forward_delay 400",
+				"ip -n vmshell-abc123 link set br2-abc123 up",
+				"ip -n vmshell-abc123 tuntap add mode tap tap1-abc123",
+				"ip -n vmshell-abc123 link set tap1-abc123 master br-abc123",
+				"ip -n vmshell-abc123 link set tap1-abc123 type bridge_slave isolated on",
+				"ip -n vmshell-abc123 link set tap1-abc123 up",
+				"ip -n vmshell-abc123 tuntap add mode tap tap2-abc123",
+				"ip -n vmshell-abc123 link set tap2-abc123 master br-abc123",
+				"ip -n vmshell-abc123 link set tap2-abc123 up",
+				"ip -n vmshell-abc123 tuntap add mode tap tap2n2-abc123",
+				"ip -n vmshell-abc123 link set tap2n2-abc123 master br2-abc123",
+				"ip -n vmshell-abc123 link set tap2n2-abc123 up",
+			),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := stubCommands(t, missingDevice)
+			session := testNetworkSession("abc123", tt.opts, tt.netns)
+			if err := setupNetwork(context.Background(), session); err != nil {
+				t.Fatalf("setupNetwork: %v", err)
+			}
+			if got := calls(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("commands:\n%s\nwant:\n%s", formatCommands(got), formatCommands(tt.want))
+			}
+		})
+	}
+}
+
+func TestSetupNetworkNAT(t *testing.T) {
+	natUplink = "eth9"
+	t.Cleanup(func() { natUplink = "" })
+	calls := stubCommands(t, missingDevice)
+	opts := defaultBridgeOptions(1)
+	opts.nat = true
+	session := testNetworkSession("abc123", opts, "")
+	if err := setupNetwork(context.Background(), session); err != nil {
+		t.Fatalf("setupNetwork: %v", err)
+	}
+	t.Cleanup(func() { releaseSubnet(session) })
+
+	subnet := session.subnet.String()
+	want := splitCommands(
+		"ip -4 route show",
+		"ip link show br-abc123",
+		"ip link add br-abc123 type bridge",
+		"ip link set br-abc123 up",
+		"ip addr add "+gatewayAddress(session.subnet)+" dev br-abc123",
+		"ip tuntap add mode tap tap1-abc123",
+		"ip link set tap1-abc123 master br-abc123",
+		"ip link set tap1-abc123 up",
+		"iptables -w -t nat -I POSTROUTING -s "+subnet+" -o eth9 -j MASQUERADE -m comment --comment vmshell-abc123",
+		"iptables -w -t filter -I FORWARD -i br-abc123 -o eth9 -j ACCEPT -m comment --comment vmshell-abc123",
+		"iptables -w -t filter -I FORWARD -i eth9 -o br-abc123 -m conntrack --ctstate RELATED,ESTABLISHED -j ACCEPT -m comment --comment vmshell-abc123",
+	)
+	if got := calls(); !reflect.DeepEqual(got, want) {
+		t.Errorf("commands:\n%s\nwant:\n%s", formatCommands(got), formatCommands(want))
+	}
+
+	// Cleanup deletes exactly the rules that were added, before the interfaces
+	cleanupCalls := stubCommands(t, nil)
+	if err := cleanupNetwork(context.Background(), session); err != nil {
+		t.Fatalf("cleanupNetwork: %v", err)
+	}
+	wantCleanup := splitCommands(
+		"iptables -w -t nat -D POSTROUTING -s "+subnet+" -o eth9 -j MASQUERADE -m comment --comment vmshell-abc123",
+		"iptables -w -t filter -D FORWARD -i br-abc123 -o eth9 -j ACCEPT -m comment --comment vmshell-abc123",
+		"iptables -w -t filter -D FORWARD -i eth9 -o br-abc123 -m conntrack --ctstate RELATED,ESTABLISHED -j ACCEPT -m comment --comment vmshell-abc123",
+		"ip link set tap1-abc123 nomaster",
+		"ip link set tap1-abc123 down",
+		"ip link delete tap1-abc123",
+		"ip link set br-abc123 down",
+		"ip link delete br-abc123 type bridge",
+	)
+	if got := cleanupCalls(); !reflect.DeepEqual(got, wantCleanup) {
+		t.Errorf("cleanup commands:\n%s\nwant:\n%s", formatCommands(got), formatCommands(wantCleanup))
+	}
+}
+
+func TestAllocateSubnetSkipsHostRoutes(t *testing.T) {
+	var routes string
+	commandRunner = func(_ context.Context, args ...string) (string, error) {
+		if strings.Join(args, " ") != "ip -4 route show" {
+			return "", fmt.Errorf("unexpected command %q", args)
+		}
+		return routes, nil
+	}
+	t.Cleanup(func() { commandRunner = execCommand })
+
+	session := testNetworkSession("abc123", defaultBridgeOptions(1), "")
+	if err := allocateSubnet(session); err != nil {
+		t.Fatalf("allocateSubnet: %v", err)
+	}
+	derived := session.subnet.String()
+	releaseSubnet(session)
+
+	// The host already routes the derived subnet, so the session must probe onwards
+	routes = "default via 192.168.1.1 dev eth0\n" + derived + " dev eth1 proto kernel scope link\n"
+	if err := allocateSubnet(session); err != nil {
+		t.Fatalf("allocateSubnet: %v", err)
+	}
+	t.Cleanup(func() { releaseSubnet(session) })
+	if got := session.subnet.String(); got == derived {
+		t.Errorf("allocateSubnet = %s, which the host already routes", got)
+	}
+}
+
+func TestSetupNetworkStopsAtFailure(t *testing.T) {
+	calls := stubCommands(t, func(args []string) error {
+		if strings.Join(args, " ") == "ip link add br-abc123 type bridge" {
+			return &commandError{args: args, exitCode: 2, stderr: "RTNETLINK answers: Operation not permitted", err: errors.New("exit status 2")}
+		}
+		return missingDevice(args)
+	})
+	err := setupNetwork(context.Background(), testNetworkSession("abc123", defaultBridgeOptions(1), ""))
+	if err == nil || !strings.Contains(err.Error(), "failed to create bridge br-abc123") || !strings.Contains(err.Error(), "Operation not permitted") {
+		t.Fatalf("setupNetwork returned %v, want the failure to create the bridge", err)
+	}
+	if got := calls(); len(got) != 2 {
+		t.Errorf("ran %d commands after the failure, want none:\n%s", len(got)-2, formatCommands(got))
+	}
+}
+
+func TestSetupNetworkRefusesOwnedBridge(t *testing.T) {
+	// Another session, e.g. with an extra network, already has a bridge of the new session's name
+	opts := defaultBridgeOptions(1)
+	owner := testNetworkSession("def456", opts, "")
+	owner.bridges = append(owner.bridges, "br-abc123")
+	sessionsMu.Lock()
+	sessions[owner.hash] = owner
+	sessionsMu.Unlock()
+	t.Cleanup(func() {
+		sessionsMu.Lock()
+		delete(sessions, owner.hash)
+		sessionsMu.Unlock()
+	})
+
+	calls := stubCommands(t, nil) // Every interface exists
+	err := setupNetwork(context.Background(), testNetworkSession("abc123", opts, ""))
+	var ownedErr *bridgeOwnedError
+	if !errors.As(err, &ownedErr) || ownedErr.owner != "session def456" {
+		t.Fatalf("setupNetwork returned %v, want a bridgeOwnedError naming session def456", err)
+	}
+	if got := calls(); len(got) != 1 {
+		t.Errorf("ran %d commands after finding the bridge, want none:\n%s", len(got)-1, formatCommands(got))
+	}
+}
+
+func TestCleanupNetworkCommands(t *testing.T) {
+	opts := defaultBridgeOptions(2)
+	opts.networks = [][]string{{"1"}}
+	session := testNetworkSession("abc123", opts, "vmshell-abc123")
+	session.vxlanName = "vx-abc123"
+
+	// Every device is already gone, which must neither stop cleanup nor make it fail
+	calls := stubCommands(t, func(args []string) error {
+		return &commandError{args: args, exitCode: 1, stderr: "Cannot find device", err: errors.New("exit status 1")}
+	})
+	if err := cleanupNetwork(context.Background(), session); err != nil {
+		t.Fatalf("cleanupNetwork: %v", err)
+	}
+	want := splitCommands(
+		"ip -n vmshell-abc123 link set tap1-abc123 nomaster",
+		"ip -n vmshell-abc123 link set tap1-abc123 down",
+		"ip -n vmshell-abc123 link delete tap1-abc123",
+		"ip -n vmshell-abc123 link set tap1n2-abc123 nomaster",
+		"ip -n vmshell-abc123 link set tap1n2-abc123 down",
+		"ip -n vmshell-abc123 link delete tap1n2-abc123",
+		"ip -n vmshell-abc123 link set tap2-abc123 nomaster",
+		"ip -n vmshell-abc123 link set tap2-abc123 down",
+		"ip -n vmshell-abc123 link delete tap2-abc123",
+		"ip -n vmshell-abc123 link set vx-abc123 nomaster",
+		"ip -n vmshell-abc123 link set vx-abc123 down",
+		"ip -n vmshell-abc123 link delete vx-abc123",
+		"ip -n vmshell-abc123 link set br-abc123 down",
+		"ip -n vmshell-abc123 link delete br-abc123 type bridge",
+		"ip -n vmshell-abc123 link set br2-abc123 down",
+		"ip -n vmshell-abc123 link delete br2-abc123 type bridge",
+		"ip netns delete vmshell-abc123",
+	)
+	if got := calls(); !reflect.DeepEqual(got, want) {
+		t.Errorf("commands:\n%s\nwant:\n%s", formatCommands(got), formatCommands(want))
+	}
+}
+
+func TestInterfaceExists(t *testing.T) {
+	tests := []struct {
+		name    string
+		err     error
+		exists  bool
+		wantErr bool
+	}{
+		{"exists", nil, true, false},
+		{"missing", &commandError{exitCode: 1, stderr: `Device "br-abc123" does not exist.`, err: errors.New("exit status 1")}, false, false},
+		{"other failure", &commandError{exitCode: 255, stderr: "Cannot open netlink socket: Permission denied", err: errors.New("exit status 255")}, false, true},
+		{"not a command error", errors.New("timed out"), false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stubCommands(t, func([]string) error { return tt.err })
+			exists, err := interfaceExists("", "br-abc123")
+			if exists != tt.exists || (err != nil) != tt.wantErr {
+				t.Errorf("interfaceExists = %v, %v; want %v, error %v", exists, err, tt.exists, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCommandErrorDeviceMissing(t *testing.T) {
+	tests := []struct {
+		stderr string
+		want   bool
+	}{
+		{`Device "tap1-abc123" does not exist.`, true},
+		{"Cannot find device \"br-abc123\"", true},
+		{"RTNETLINK answers: No such device", true},
+		{`Cannot open network namespace "vmshell-abc123": No such file or directory`, true},
+		{"RTNETLINK answers: Operation not permitted", false},
+		{"RTNETLINK answers: File exists", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		err := &commandError{args: []string{"ip", "link", "delete", "x"}, exitCode: 1, stderr: tt.stderr, err: errors.New("exit status 1")}
+		if got := err.deviceMissing(); got != tt.want {
+			t.Errorf("deviceMissing() with stderr %q = %v, want %v", tt.stderr, got, tt.want)
+		}
+	}
+}
+
+// formatCommands lists command lines one per line for test failure messages
+func formatCommands(commands [][]string) string {
+	lines := make([]string, len(commands))
+	for i, args := range commands {
+		lines[i] = "  " + strings.Join(args, " ")
+	}
+	return strings.Join(lines, "\n")
+}
+
+func TestNetworkRepairsLimitedPerWindow(t *testing.T) {
+	out := log.Writer()
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(out) })
+
+	// The bridge never comes back, so every check finds it missing and tries again
+	var repairs atomic.Int32
+	stubCommands(t, func(args []string) error {
+		if strings.Join(args, " ") == "ip link add br-abc123 type bridge" {
+			repairs.Add(1)
+		}
+		if strings.Join(args, " ") == "ip link show br-abc123" {
+			return missingDevice(args)
+		}
+		return nil
+	})
+	session := testNetworkSession("abc123", defaultBridgeOptions(1), "")
+	sessionsMu.Lock()
+	sessions[session.hash] = session
+	sessionsMu.Unlock()
+	t.Cleanup(func() {
+		sessionsMu.Lock()
+		delete(sessions, session.hash)
+		sessionsMu.Unlock()
+	})
+
+	for i := 0; i < maxNetRepairs+3; i++ {
+		checkSessionNetwork(session)
+	}
+	if got := int(repairs.Load()); got != maxNetRepairs {
+		t.Fatalf("%d repairs within the window, want %d", got, maxNetRepairs)
+	}
+
+	// Once the window has passed, the session may be repaired again
+	sessionsMu.Lock()
+	session.repairsSince = session.repairsSince.Add(-netRepairWindow)
+	sessionsMu.Unlock()
+	checkSessionNetwork(session)
+	if got := int(repairs.Load()); got != maxNetRepairs+1 {
+		t.Errorf("%d repairs after the window passed, want %d", got, maxNetRepairs+1)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// reclaimInterfaces enables the startup sweep of orphaned session interfaces, set with -reclaim-interfaces
+var reclaimInterfaces bool
+
+// sessionInterfacePattern matches the names sessionTopology and setupNetwork give a session's
+// bridges, TAP devices, and VXLAN device; the last group is the session ID
+var sessionInterfacePattern = regexp.MustCompile(fmt.Sprintf(`^(br[0-9]?|tap[0-9](n[0-9])?|vx)-([0-9a-f]{%d})$`, sessionIDLength))
+
+// reclaimOrphanInterfaces deletes host interfaces named like a session's that belong to no known
+// session, such as those of a crashed run without a state record. It runs after recoverSessions,
+// so the only sessions still known are those kept for their running VMs. Interfaces inside
+// per-session namespaces aren't visible here.
+func reclaimOrphanInterfaces() error {
+	output, err := runCommandOutput(context.Background(), "ip", "-json", "link", "show")
+	if err != nil {
+		return err
+	}
+	var links []struct {
+		Name string `json:"ifname"`
+	}
+	if err := json.Unmarshal([]byte(output), &links); err != nil {
+		return fmt.Errorf("failed to parse 'ip -json link show' output: %v", err)
+	}
+
+	var orphans []string
+	for _, link := range links {
+		match := sessionInterfacePattern.FindStringSubmatch(link.Name)
+		if match == nil || hasSessionState(match[3]) {
+			continue
+		}
+		orphans = append(orphans, link.Name)
+	}
+	// Ports go before their bridges, like in cleanupNetwork
+	sort.SliceStable(orphans, func(i, j int) bool {
+		return !strings.HasPrefix(orphans[i], "br") && strings.HasPrefix(orphans[j], "br")
+	})
+
+	for _, name := range orphans {
+		slog.Info("Reclaiming orphaned interface", "interface", name)
+		for _, args := range [][]string{{"ip", "link", "set", name, "down"}, {"ip", "link", "delete", name}} {
+			if err := runCommand(args...); err != nil {
+				slog.Error("Error executing cleanup command", "command", strings.Join(args, " "), "err", err)
+				break
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// Images a session may open writable with disk=persistent, so guest changes survive the session.
+// A writable image is locked to the one session using it, since concurrent writers corrupt qcow2.
+var (
+	persistentImages = make(map[string]bool)   // Names of images allowed with disk=persistent, set with -persistent-images
+	imageLocks       = make(map[string]string) // Key - image path, Value - ID of the session writing it, guarded by sessionsMu
+)
+
+// imageLockedError is returned by createSession when another session is writing the image
+type imageLockedError struct {
+	image string
+}
+
+func (e *imageLockedError) Error() string {
+	return fmt.Sprintf("image %q is in use by another persistent session, try again once it is closed", e.image)
+}
+
+// parsePersistentImages parses a comma-separated list of image names, each of which must be in the
+// images allow-list
+func parsePersistentImages(list string) (map[string]bool, error) {
+	result := make(map[string]bool)
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if _, ok := images[name]; !ok {
+			return nil, fmt.Errorf("image %q is not in the -images allow-list", name)
+		}
+		result[name] = true
+	}
+	return result, nil
+}
+
+// lockImage claims the writable image of a disk=persistent session for the session with the given
+// ID. The lock is keyed by path, so two image names for the same file share it. Must be called
+// with sessionsMu held.
+func lockImage(hash string, opts sessionOptions) error {
+	if !opts.diskPersistent {
+		return nil
+	}
+	path := filepath.Clean(images[opts.image])
+	if _, locked := imageLocks[path]; locked {
+		return &imageLockedError{image: opts.image}
+	}
+	imageLocks[path] = hash
+	return nil
+}
+
+// unlockImage releases the session's image lock, if it holds one. It must only be called once the
+// session's VMs have exited.
+func unlockImage(hash string, opts sessionOptions) {
+	if !opts.diskPersistent {
+		return
+	}
+	path := filepath.Clean(images[opts.image])
+	sessionsMu.Lock()
+	if imageLocks[path] == hash {
+		delete(imageLocks, path)
+	}
+	sessionsMu.Unlock()
+}
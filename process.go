@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"os/exec"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	closeMachineExited = 4002        // WebSocket close code sent when a machine's QEMU process dies on its own
+	exitStatusWait     = time.Second // How long a client whose console ended waits to learn why
+)
+
+// crashTeardown tears down the whole session when one of its machines crashes, set with -crash-teardown
+var crashTeardown bool
+
+// machineProcess is a machine's QEMU process. Its reaper goroutine is the only caller of cmd.Wait,
+// so startup, terminateMachine, and crash detection can all wait for the exit through done.
+type machineProcess struct {
+	cmd      *exec.Cmd
+	done     chan struct{}    // Closed once the process has exited and been reaped
+	state    *os.ProcessState // Exit status, set before done is closed
+	stopping atomic.Bool      // Set when the server terminates the process, so its exit isn't a crash
+
+	// QEMU leads its own process group, whose ID is QEMU's PID. Once QEMU is reaped that ID may be
+	// reused, so the group is only signaled while holding reapMu and before reaped is set.
+	reapMu sync.Mutex
+	reaped bool
+}
+
+// reapMachine starts waiting for a freshly started QEMU process
+func reapMachine(cmd *exec.Cmd) *machineProcess {
+	proc := &machineProcess{cmd: cmd, done: make(chan struct{})}
+	go func() {
+		// Wait for the exit without reaping, so the group ID stays QEMU's while the helpers it left
+		// behind are killed
+		pid := cmd.Process.Pid
+		var info unix.Siginfo
+		var err error
+		for {
+			err = unix.Waitid(unix.P_PID, pid, &info, unix.WEXITED|unix.WNOWAIT, nil)
+			if !errors.Is(err, unix.EINTR) {
+				break
+			}
+		}
+		proc.reapMu.Lock()
+		if err == nil {
+			killProcessGroup(pid)
+		} else {
+			slog.Error("Error waiting for QEMU process", "pid", pid, "err", err)
+		}
+		// The error only repeats the exit status, which is kept in state
+		_ = cmd.Wait()
+		proc.reaped = true
+		proc.reapMu.Unlock()
+		proc.state = cmd.ProcessState
+		close(proc.done)
+	}()
+	return proc
+}
+
+// signalGroup sends sig to the process's group unless the process was already reaped, in which
+// case there is nothing left to signal
+func (p *machineProcess) signalGroup(sig syscall.Signal) error {
+	p.reapMu.Lock()
+	defer p.reapMu.Unlock()
+	if p.reaped {
+		return nil
+	}
+	if err := syscall.Kill(-p.cmd.Process.Pid, sig); err != nil && !errors.Is(err, syscall.ESRCH) {
+		return err
+	}
+	return nil
+}
+
+// exited reports whether the process is gone, and if so its exit status
+func (p *machineProcess) exited() (bool, string) {
+	select {
+	case <-p.done:
+		return true, p.state.String()
+	default:
+		return false, ""
+	}
+}
+
+// crashStatus waits up to timeout for the process to exit and returns its exit status if it
+// exited on its own, or "" if the server stopped it or it is still running
+func (p *machineProcess) crashStatus(timeout time.Duration) string {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-p.done:
+	case <-timer.C:
+		return ""
+	}
+	if p.stopping.Load() {
+		return ""
+	}
+	return p.state.String()
+}
+
+// watchMachine waits for a running machine's QEMU process to exit. An exit the server didn't ask
+// for, e.g. QEMU crashing or being killed by the OOM killer, is logged and reported to the
+// session's clients; attached consoles end by themselves and close with closeMachineExited. With
+// -crash-teardown the whole session is cleaned up as well.
+func watchMachine(session *Session, machineID string, proc *machineProcess) {
+	<-proc.done
+	if proc.stopping.Load() {
+		return
+	}
+	status := proc.state.String()
+	slog.Error("QEMU process exited unexpectedly", "session", session.hash, "machine", machineID, "status", status)
+	machineCrashes.Inc()
+
+	sessionsMu.Lock()
+	delete(session.bootReady, machineID)
+	sessionsMu.Unlock()
+	notifyClients(session, map[string]any{"type": "machine_exited", "machine": machineID, "status": status})
+
+	if !crashTeardown {
+		return
+	}
+	sessionsMu.Lock()
+	tracked := sessions[session.hash] == session
+	if tracked {
+		removeSession(session)
+	}
+	sessionsMu.Unlock()
+	if tracked {
+		slog.Info("Tearing down session after machine crash", "session", session.hash, "machine", machineID)
+		cleanupSession(session)
+		sessionsClosed.WithLabelValues(closeReasonCrash).Inc()
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// startGroupLeader starts script as the leader of a process group of its own, as pty.Start does for
+// QEMU, and returns it with the PID the script prints first
+func startGroupLeader(t *testing.T, script string) (*machineProcess, int) {
+	t.Helper()
+	cmd := exec.Command("sh", "-c", script)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	line, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil {
+		t.Fatalf("reading the helper's PID: %v", err)
+	}
+	helper, err := strconv.Atoi(strings.TrimSpace(line))
+	if err != nil {
+		t.Fatalf("reading the helper's PID: %v", err)
+	}
+	t.Cleanup(func() { _ = syscall.Kill(helper, syscall.SIGKILL) })
+	return reapMachine(cmd), helper
+}
+
+// processGone reports whether pid has exited. Its parent may never reap it, so a zombie counts too.
+func processGone(pid int) bool {
+	stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return true
+	}
+	fields := strings.Fields(string(stat[strings.LastIndexByte(string(stat), ')')+1:]))
+	return len(fields) > 0 && fields[0] == "Z"
+}
+
+func waitGone(t *testing.T, pid int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !processGone(pid) {
+		if time.Now().After(deadline) {
+			t.Fatalf("process %d is still running", pid)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReaperKillsLeftoverHelpers(t *testing.T) {
+	// The leader exits on its own and leaves a helper behind in its group
+	proc, helper := startGroupLeader(t, "sleep 60 & echo $!; exit 3")
+	select {
+	case <-proc.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the process was not reaped")
+	}
+	waitGone(t, helper)
+
+	// Once reaped, the group ID may belong to someone else, so nothing is signaled any more
+	if err := proc.signalGroup(syscall.SIGKILL); err != nil {
+		t.Errorf("signaling the group of a reaped process: %v", err)
+	}
+}
+
+func TestTerminateMachineStopsGroup(t *testing.T) {
+	proc, helper := startGroupLeader(t, "sleep 60 & echo $!; wait")
+	if err := terminateMachine(proc); err != nil {
+		t.Fatalf("terminateMachine: %v", err)
+	}
+	if exited, _ := proc.exited(); !exited {
+		t.Error("terminateMachine returned before the process exited")
+	}
+	waitGone(t, helper)
+}
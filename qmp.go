@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"time"
+)
+
+const (
+	qmpDialTimeout = 10 * time.Second // How long to wait for QEMU to create its QMP socket
+	qmpDialRetry   = 100 * time.Millisecond
+)
+
+// qmpEvents enables the QMP socket on every VM and the forwarding of its events
+var qmpEvents bool
+
+// forwardedQMPEvents is the subset of QMP events that describe VM state changes clients care about
+var forwardedQMPEvents = map[string]bool{
+	"SHUTDOWN":          true, // Guest initiated or host requested shutdown
+	"POWERDOWN":         true, // ACPI power button pressed
+	"RESET":             true, // Guest reset
+	"STOP":              true, // VM execution paused
+	"RESUME":            true, // VM execution resumed
+	"SUSPEND":           true, // Guest entered S3
+	"WAKEUP":            true, // Guest left S3
+	"GUEST_PANICKED":    true, // Guest kernel panic reported through pvpanic
+	"WATCHDOG":          true, // Guest watchdog fired
+	"DEVICE_TRAY_MOVED": true, // Removable media tray opened or closed
+}
+
+// qmpMessage is a message received from QEMU over QMP
+type qmpMessage struct {
+	Event     string          `json:"event"`
+	Data      json.RawMessage `json:"data"`
+	Timestamp struct {
+		Seconds      int64 `json:"seconds"`
+		Microseconds int64 `json:"microseconds"`
+	} `json:"timestamp"`
+	Return json.RawMessage `json:"return"`
+	Error  *struct {
+		Class string `json:"class"`
+		Desc  string `json:"desc"`
+	} `json:"error"`
+}
+
+// qmpConn is a QMP connection that has completed capability negotiation
+type qmpConn struct {
+	conn    net.Conn
+	decoder *json.Decoder
+}
+
+// dialQMP connects to a QMP socket, retrying until QEMU has created it, and negotiates capabilities
+func dialQMP(path string) (*qmpConn, error) {
+	var conn net.Conn
+	var err error
+	deadline := time.Now().Add(qmpDialTimeout)
+	for {
+		conn, err = net.Dial("unix", path)
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("failed to connect to QMP socket %s: %v", path, err)
+		}
+		time.Sleep(qmpDialRetry)
+	}
+
+	q := &qmpConn{conn: conn, decoder: json.NewDecoder(bufio.NewReader(conn))}
+
+	// QEMU greets with its version and capabilities, then waits for qmp_capabilities
+	var greeting map[string]json.RawMessage
+	if err := q.decoder.Decode(&greeting); err != nil {
+		_ = conn.Close() // Best effort
+		return nil, fmt.Errorf("failed to read QMP greeting: %v", err)
+	}
+	if _, ok := greeting["QMP"]; !ok {
+		_ = conn.Close() // Best effort
+		return nil, fmt.Errorf("unexpected QMP greeting")
+	}
+	if _, err := q.execute("qmp_capabilities", nil); err != nil {
+		_ = conn.Close() // Best effort
+		return nil, err
+	}
+	return q, nil
+}
+
+// execute sends a QMP command with optional arguments and returns its result. Events that arrive
+// before the reply are dropped, so it must not be used on a connection that is also watching events.
+func (q *qmpConn) execute(command string, arguments any) (json.RawMessage, error) {
+	request := map[string]any{"execute": command}
+	if arguments != nil {
+		request["arguments"] = arguments
+	}
+	if err := json.NewEncoder(q.conn).Encode(request); err != nil {
+		return nil, fmt.Errorf("failed to send QMP command %s: %v", command, err)
+	}
+	for {
+		var msg qmpMessage
+		if err := q.decoder.Decode(&msg); err != nil {
+			return nil, fmt.Errorf("failed to read QMP reply to %s: %v", command, err)
+		}
+		if msg.Error != nil {
+			return nil, fmt.Errorf("QMP command %s failed: %s: %s", command, msg.Error.Class, msg.Error.Desc)
+		}
+		if msg.Return != nil {
+			return msg.Return, nil
+		}
+	}
+}
+
+// runQMPCommand connects to a QMP socket, runs a command without arguments, and disconnects
+func runQMPCommand(path, command string, timeout time.Duration) error {
+	q, err := dialQMP(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := q.conn.Close(); err != nil {
+			slog.Error("Error closing QMP connection", "err", err)
+		}
+	}()
+	if err := q.conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+	_, err = q.execute(command, nil)
+	return err
+}
+
+// watchQMPEvents forwards a machine's QMP events to the session's clients until QEMU exits
+func watchQMPEvents(session *Session, machineID, path string) {
+	logger := slog.With("session", session.hash, "machine", machineID)
+	q, err := dialQMP(path)
+	if err != nil {
+		logger.Warn("QMP event stream unavailable", "err", err)
+		return
+	}
+	defer func() {
+		if err := q.conn.Close(); err != nil {
+			slog.Error("Error closing QMP connection", "err", err)
+		}
+	}()
+
+	for {
+		var msg qmpMessage
+		if err := q.decoder.Decode(&msg); err != nil {
+			// QEMU closes the socket when it exits
+			logger.Info("QMP event stream ended", "err", err)
+			return
+		}
+		if !forwardedQMPEvents[msg.Event] {
+			continue
+		}
+
+		logger.Info("QMP event", "event", msg.Event)
+		notification := map[string]any{
+			"type":      "qmp_event",
+			"machine":   machineID,
+			"event":     msg.Event,
+			"timestamp": time.Unix(msg.Timestamp.Seconds, msg.Timestamp.Microseconds*1000),
+		}
+		if len(msg.Data) > 0 {
+			notification["data"] = msg.Data
+		}
+		notifyClients(session, notification)
+	}
+}
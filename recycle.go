@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+)
+
+const minRecycleAfter = time.Minute // Shortest allowed uptime before a VM is recycled
+
+// scheduleRecycle arms the timer that recycles a machine once it reaches the session's
+// recycleAfter uptime. Must be called with session.lifecycleMu held.
+func scheduleRecycle(session *Session, machineID string) {
+	var timer *time.Timer
+	timer = time.AfterFunc(session.opts.recycleAfter, func() {
+		session.lifecycleMu.Lock()
+		defer session.lifecycleMu.Unlock()
+		// A reset, or the removal of the machine, may have replaced or dropped this timer while it
+		// waited for the lock, and the machine it was armed for may be gone
+		if session.recycleTimers[machineID] != timer {
+			return
+		}
+		if err := recycleMachine(session, machineID); err != nil {
+			slog.Error("Error recycling machine", "session", session.hash, "machine", machineID, "err", err)
+		}
+	})
+	session.recycleTimers[machineID] = timer
+}
+
+// recycleMachine restarts a machine from the pristine image and schedules its next recycle.
+// The session itself, including its network, is left untouched.
+// Must be called with session.lifecycleMu held.
+func recycleMachine(session *Session, machineID string) error {
+	// A timer may fire while the session is being cleaned up, whose clients mustn't hear of a recycle
+	if session.closed {
+		return nil
+	}
+	notifyClients(session, map[string]any{"type": "machine_recycled", "machine": machineID})
+	if err := restartMachine(session, machineID); err != nil {
+		return err
+	}
+	scheduleRecycle(session, machineID)
+	slog.Info("Machine recycled", "session", session.hash, "machine", machineID, "after", session.opts.recycleAfter)
+	return nil
+}
+
+// restartMachine terminates a machine's QEMU process and starts a fresh one on the same TAP device.
+// Since VMs run with -snapshot or on a freshly created overlay, the new process boots from the
+// unmodified base image, except with disk=persistent, where it boots the image as the old one left it.
+// Clients attached to the old PTY see it close and have to reconnect.
+// Must be called with session.lifecycleMu held.
+func restartMachine(session *Session, machineID string) error {
+	// The map entries keep pointing at the old machine until startMachine swaps in the new one
+	// in a single step, so a client connecting in between finds the old, ended console and is
+	// closed right away instead of being told the machine doesn't exist
+	sessionsMu.Lock()
+	proc := session.procs[machineID]
+	ptmx := session.ptyFiles[machineID]
+	auxPty := session.auxPtys[machineID]
+	serialPtys := session.serialPtys[machineID]
+	consoleConn := session.consoleConns[machineID]
+	_, ok := session.nics[machineID]
+	delete(session.bootReady, machineID)
+	sessionsMu.Unlock()
+	if !ok {
+		return fmt.Errorf("unknown machine %s", machineID)
+	}
+
+	if proc != nil {
+		if err := terminateMachine(proc); err != nil {
+			slog.Error("Error terminating machine", "session", session.hash, "machine", machineID, "err", err)
+		}
+	}
+	// Closing the PTYs and the console socket ends their console streams, which disconnects attached clients
+	for _, f := range append([]*os.File{ptmx, auxPty}, serialPtys...) {
+		if f != nil {
+			if err := f.Close(); err != nil {
+				slog.Error("Error closing PTY", "session", session.hash, "machine", machineID, "pty", f.Name(), "err", err)
+			}
+		}
+	}
+	if consoleConn != nil {
+		if err := consoleConn.Close(); err != nil {
+			slog.Error("Error closing console socket", "session", session.hash, "machine", machineID, "err", err)
+		}
+	}
+
+	if noVMs {
+		return nil
+	}
+	// Restarts aren't tied to a request; awaitQEMUStartup still bounds how long this takes
+	if err := startMachine(context.Background(), session, machineID); err != nil {
+		vmStartFailures.Inc()
+		sessionsMu.Lock()
+		delete(session.procs, machineID)
+		delete(session.ptyFiles, machineID)
+		delete(session.auxPtys, machineID)
+		delete(session.serialPtys, machineID)
+		delete(session.consoleConns, machineID)
+		deleteConsoles(session, machineID)
+		delete(session.qmpSockets, machineID)
+		sessionsMu.Unlock()
+		return err
+	}
+	saveSessionState(session)
+	return nil
+}
+
+// resetHandler restarts a single machine from the pristine image. The session's bridge and the
+// machine's TAP device stay up, so the other machines keep their connectivity. Attached clients
+// are notified and disconnected, and have to reconnect to the new console.
+func resetHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, errMethodNotAllowed, "Method not allowed")
+		return
+	}
+	sessionID, ok := sessionIDParam(w, r)
+	if !ok {
+		return
+	}
+	machineID := r.URL.Query().Get("machine")
+	logger := requestLogger(r.Context()).With("session", sessionID, "machine", machineID)
+
+	sessionsMu.RLock()
+	session := sessions[sessionID]
+	var known bool
+	if session != nil {
+		_, known = session.nics[machineID]
+	}
+	sessionsMu.RUnlock()
+	if session == nil {
+		writeJSONError(w, http.StatusNotFound, errSessionNotFound, "Session not found")
+		return
+	}
+	if !known {
+		writeJSONError(w, http.StatusBadRequest, errInvalidMachine, "Invalid machine ID")
+		return
+	}
+
+	notifyClients(session, map[string]any{"type": "machine_reset", "machine": machineID})
+
+	session.lifecycleMu.Lock()
+	if session.closed {
+		session.lifecycleMu.Unlock()
+		writeJSONError(w, http.StatusNotFound, errSessionNotFound, "Session not found")
+		return
+	}
+	err := restartMachine(session, machineID)
+	// The recycle uptime counts from the reset
+	if timer := session.recycleTimers[machineID]; timer != nil && err == nil {
+		timer.Stop()
+		scheduleRecycle(session, machineID)
+	}
+	session.lifecycleMu.Unlock()
+	if err != nil {
+		logger.Error("Error resetting machine", "err", err)
+		message := "Error restarting machine"
+		var startErr *machineStartError
+		if errors.As(err, &startErr) {
+			message = startErr.Error()
+		}
+		writeJSONError(w, http.StatusInternalServerError, errResetFailed, message)
+		return
+	}
+
+	session.touch()
+
+	logger.Info("Machine reset by client request")
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]string{"machine": machineID}); err != nil {
+		logger.Error("Error encoding JSON response", "err", err)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRecycleOfClosedSessionIsSilent(t *testing.T) {
+	session, _ := newTestSession(t)
+	conn := dialTestConsole(t, session)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		sessionsMu.RLock()
+		attached := len(session.clients)
+		sessionsMu.RUnlock()
+		if attached == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the client never attached")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	session.lifecycleMu.Lock()
+	session.closed = true
+	recycleErr := recycleMachine(session, "1")
+	session.lifecycleMu.Unlock()
+	if recycleErr != nil {
+		t.Fatalf("recycleMachine: %v", recycleErr)
+	}
+
+	if err := conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	_, msg, err := conn.ReadMessage()
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Errorf("client received %q (%v) from the recycle of a closed session, want nothing", msg, err)
+	}
+}
+
+func TestReplacedRecycleTimerDoesNothing(t *testing.T) {
+	session, _ := newTestSession(t)
+	session.recycleTimers = make(map[string]*time.Timer)
+	session.opts.recycleAfter = time.Millisecond
+	conn := dialTestConsole(t, session)
+
+	// The timer fires while the lock is held, as if a removal were in progress, and finds itself
+	// gone from the map once it gets the lock
+	session.lifecycleMu.Lock()
+	scheduleRecycle(session, "1")
+	time.Sleep(50 * time.Millisecond)
+	delete(session.recycleTimers, "1")
+	session.lifecycleMu.Unlock()
+
+	if err := conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	_, msg, err := conn.ReadMessage()
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Errorf("client received %q (%v) from a replaced recycle timer, want nothing", msg, err)
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+const maxRequestBody = 64 << 10 // Upper bound for a /create_session JSON body
+
+// CreateSessionRequest is the JSON body of /create_session. Its fields are the query parameters of
+// the same name, with numbers and booleans as JSON values, durations as Go duration strings, and
+// networks and isolated as lists of machine numbers. Unset fields keep their defaults.
+type CreateSessionRequest struct {
+	MachineCount *int   `json:"machineCount"`
+	MemMB        *int   `json:"memMB"`
+	VCPUs        *int   `json:"vcpus"`
+	Image        string `json:"image"`
+	MemBacking   string `json:"memBacking"`
+	NUMANode     *int   `json:"numaNode"`
+	AuxConsole   string `json:"auxConsole"`
+	SerialPorts  *int   `json:"serialPorts"`
+	InputMap     string `json:"inputMap"`
+	Template     string `json:"template"`
+	Hostname     string `json:"hostname"`
+	SSHKey       string `json:"sshKey"`
+	RTCBase      string `json:"rtcBase"`
+	RTCClock     string `json:"rtcClock"`
+	RTCDriftfix  string `json:"rtcDriftfix"`
+
+	BridgeStp           *bool `json:"bridgeStp"`
+	BridgeForwardDelay  *int  `json:"bridgeForwardDelay"`
+	BridgeAgeingTime    *int  `json:"bridgeAgeingTime"`
+	BridgeVlanFiltering *bool `json:"bridgeVlanFiltering"`
+
+	Networks    [][]int `json:"networks"`
+	Isolated    []int   `json:"isolated"`
+	VXLANID     *int    `json:"vxlanID"`
+	VXLANRemote string  `json:"vxlanRemote"`
+	NAT         *bool   `json:"nat"`
+	DHCP        *bool   `json:"dhcp"`
+	Disk        string  `json:"disk"`
+	Snapshots   *bool   `json:"snapshots"`
+	Import      string  `json:"import"`
+
+	RecycleAfter string `json:"recycleAfter"`
+	Timeout      string `json:"timeout"`
+	Wait         bool   `json:"wait"`
+	WaitTimeout  string `json:"waitTimeout"`
+}
+
+// values converts the request to the query parameters it stands for, so both forms go through
+// parseSessionOptions
+func (req *CreateSessionRequest) values() url.Values {
+	values := url.Values{}
+	setString := func(key, value string) {
+		if value != "" {
+			values.Set(key, value)
+		}
+	}
+	setInt := func(key string, value *int) {
+		if value != nil {
+			values.Set(key, strconv.Itoa(*value))
+		}
+	}
+	setToggle := func(key string, value *bool) {
+		if value != nil {
+			values.Set(key, map[bool]string{true: "on", false: "off"}[*value])
+		}
+	}
+	machineList := func(machines []int) string {
+		ids := make([]string, len(machines))
+		for i, id := range machines {
+			ids[i] = strconv.Itoa(id)
+		}
+		return strings.Join(ids, ":")
+	}
+
+	setInt("machineCount", req.MachineCount)
+	setInt("memMB", req.MemMB)
+	setInt("vcpus", req.VCPUs)
+	setString("image", req.Image)
+	setString("memBacking", req.MemBacking)
+	setInt("numaNode", req.NUMANode)
+	setString("auxConsole", req.AuxConsole)
+	setInt("serialPorts", req.SerialPorts)
+	setString("inputMap", req.InputMap)
+	setString("template", req.Template)
+	setString("hostname", req.Hostname)
+	setString("sshKey", req.SSHKey)
+	setString("rtcBase", req.RTCBase)
+	setString("rtcClock", req.RTCClock)
+	setString("rtcDriftfix", req.RTCDriftfix)
+	setToggle("bridgeStp", req.BridgeStp)
+	setInt("bridgeForwardDelay", req.BridgeForwardDelay)
+	setInt("bridgeAgeingTime", req.BridgeAgeingTime)
+	setToggle("bridgeVlanFiltering", req.BridgeVlanFiltering)
+	if len(req.Networks) > 0 {
+		networks := make([]string, len(req.Networks))
+		for i, machines := range req.Networks {
+			networks[i] = machineList(machines)
+		}
+		values.Set("networks", strings.Join(networks, ","))
+	}
+	if len(req.Isolated) > 0 {
+		values.Set("isolated", machineList(req.Isolated))
+	}
+	setInt("vxlanID", req.VXLANID)
+	setString("vxlanRemote", req.VXLANRemote)
+	setToggle("nat", req.NAT)
+	setToggle("dhcp", req.DHCP)
+	setString("disk", req.Disk)
+	setToggle("snapshots", req.Snapshots)
+	setString("import", req.Import)
+	setString("recycleAfter", req.RecycleAfter)
+	setString("timeout", req.Timeout)
+	if req.Wait {
+		values.Set("wait", "true")
+	}
+	setString("waitTimeout", req.WaitTimeout)
+	return values
+}
+
+// createSessionParams returns the options of a /create_session request: the JSON body if there is
+// one, and the query parameters otherwise, so an empty body means the query decides, which without
+// parameters is all defaults. A body that isn't a valid CreateSessionRequest yields an *optionsError.
+func createSessionParams(w http.ResponseWriter, r *http.Request) (url.Values, error) {
+	if r.Body == nil {
+		return r.URL.Query(), nil
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestBody))
+	if err != nil {
+		return nil, &optionsError{fields: []fieldError{{Message: fmt.Sprintf("failed to read request body: %v", err)}}}
+	}
+	if len(bytes.TrimSpace(body)) == 0 {
+		return r.URL.Query(), nil
+	}
+
+	var req CreateSessionRequest
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		// Point at the field when the error names one
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) && typeErr.Field != "" {
+			// Errors inside a list name the element, e.g. "isolated.0"
+			field, _, _ := strings.Cut(typeErr.Field, ".")
+			return nil, &optionsError{fields: []fieldError{{
+				Field:   field,
+				Message: fmt.Sprintf("invalid %s: expected %s, got %s", field, jsonTypeName(field, typeErr.Type.Kind()), typeErr.Value),
+			}}}
+		}
+		if field, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+			field, _ = strconv.Unquote(field)
+			return nil, &optionsError{fields: []fieldError{{Field: field, Message: fmt.Sprintf("unknown option: %q", field)}}}
+		}
+		return nil, &optionsError{fields: []fieldError{{Message: fmt.Sprintf("invalid request body: %v", err)}}}
+	}
+	if decoder.More() {
+		return nil, &optionsError{fields: []fieldError{{Message: "invalid request body: more than one JSON value"}}}
+	}
+	return req.values(), nil
+}
+
+// jsonTypeName describes the JSON value expected for a field of CreateSessionRequest
+func jsonTypeName(field string, kind reflect.Kind) string {
+	switch {
+	case field == "networks":
+		return "a list of lists of machine numbers"
+	case field == "isolated":
+		return "a list of machine numbers"
+	case kind == reflect.Int:
+		return "an integer"
+	case kind == reflect.Bool:
+		return "a boolean"
+	}
+	return "a string"
+}
+
+// fieldError is a problem with one option of a /create_session request. Field is empty for
+// problems with the request as a whole.
+type fieldError struct {
+	Field   string `json:"field,omitempty"`
+	Message string `json:"message"`
+}
+
+// optionsError lists every invalid option of a /create_session request
+type optionsError struct {
+	fields []fieldError
+}
+
+// add records a problem with field
+func (e *optionsError) add(field, format string, args ...any) {
+	e.fields = append(e.fields, fieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// has reports whether any of the fields has a problem, so checks depending on them can be skipped
+func (e *optionsError) has(fields ...string) bool {
+	for _, f := range e.fields {
+		for _, field := range fields {
+			if f.Field == field {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (e *optionsError) Error() string {
+	messages := make([]string, len(e.fields))
+	for i, f := range e.fields {
+		messages[i] = f.Message
+	}
+	return strings.Join(messages, "; ")
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// rtcOptions are the -rtc settings of a session's machines. Empty fields keep QEMU's defaults, a
+// UTC clock following the host.
+type rtcOptions struct {
+	base     string // "utc", "localtime", or a start date like "2024-01-01T09:00:00"
+	clock    string // "host", "rt" for a clock the host's time changes don't affect, "vm" to stop with the guest
+	driftfix string // "none" or "slew" to catch up on ticks a busy host lost
+}
+
+// defaultRTC applies to sessions that don't set the rtc options, set with -rtc
+var defaultRTC rtcOptions
+
+// rtcValues are the values allowed for the -rtc keys other than base
+var rtcValues = map[string]map[string]bool{
+	"clock":    {"host": true, "rt": true, "vm": true},
+	"driftfix": {"none": true, "slew": true},
+}
+
+// validateRTC checks a value for one of the -rtc keys. Besides utc and localtime, base takes the
+// two date formats QEMU understands.
+func validateRTC(key, value string) error {
+	if key != "base" {
+		if !rtcValues[key][value] {
+			allowed := make([]string, 0, len(rtcValues[key]))
+			for v := range rtcValues[key] {
+				allowed = append(allowed, v)
+			}
+			sort.Strings(allowed)
+			return fmt.Errorf("%q is not one of %s", value, strings.Join(allowed, ", "))
+		}
+		return nil
+	}
+	if value == "utc" || value == "localtime" {
+		return nil
+	}
+	for _, layout := range []string{"2006-01-02T15:04:05", "2006-01-02"} {
+		if _, err := time.Parse(layout, value); err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("%q is neither utc, localtime, nor a date like 2024-01-01T09:00:00", value)
+}
+
+// parseRTC parses -rtc settings in QEMU's syntax, e.g. "base=2024-01-01,clock=vm"
+func parseRTC(spec string) (rtcOptions, error) {
+	var rtc rtcOptions
+	fields := map[string]*string{"base": &rtc.base, "clock": &rtc.clock, "driftfix": &rtc.driftfix}
+	for _, setting := range strings.Split(spec, ",") {
+		if setting == "" {
+			continue
+		}
+		key, value, _ := strings.Cut(setting, "=")
+		field, ok := fields[key]
+		if !ok {
+			return rtcOptions{}, fmt.Errorf("unknown key %q (expected base, clock or driftfix)", key)
+		}
+		if err := validateRTC(key, value); err != nil {
+			return rtcOptions{}, fmt.Errorf("invalid %s: %v", key, err)
+		}
+		*field = value
+	}
+	return rtc, nil
+}
+
+// args returns the -rtc option for these settings, or nothing if they are all defaults
+func (r rtcOptions) args() []string {
+	var settings []string
+	for _, setting := range [][2]string{{"base", r.base}, {"clock", r.clock}, {"driftfix", r.driftfix}} {
+		if setting[1] != "" {
+			settings = append(settings, setting[0]+"="+setting[1])
+		}
+	}
+	if len(settings) == 0 {
+		return nil
+	}
+	return []string{"-rtc", strings.Join(settings, ",")}
+}
+
+// templateSetsRTC reports whether the named machine template has its own -rtc option
+func templateSetsRTC(name string) bool {
+	for _, arg := range templates[name].Args {
+		if "-"+strings.TrimLeft(arg, "-") == "-rtc" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// snapshotTimeout bounds a savevm or loadvm, which pause the guest while RAM is written or read
+const snapshotTimeout = 2 * time.Minute
+
+// snapshotNamePattern restricts snapshot names to characters that are safe in an HMP command line
+var snapshotNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// snapshotHandler returns a handler that saves (savevm) or restores (loadvm) a named snapshot of a
+// machine through its QMP control socket. Only sessions created with snapshots=on have one.
+func snapshotHandler(save bool) http.HandlerFunc {
+	command := "loadvm"
+	if save {
+		command = "savevm"
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeJSONError(w, http.StatusMethodNotAllowed, errMethodNotAllowed, "Method not allowed")
+			return
+		}
+
+		name := r.URL.Query().Get("name")
+		if !snapshotNamePattern.MatchString(name) {
+			writeJSONError(w, http.StatusBadRequest, errInvalidSnapshotName, "Invalid snapshot name (expected up to 64 letters, digits, '_' and '-')")
+			return
+		}
+		session, machineID, _, ok := lookupConsole(w, r)
+		if !ok {
+			return
+		}
+		logger := requestLogger(r.Context()).With("session", session.hash, "machine", machineID)
+
+		if !session.opts.snapshots {
+			writeJSONError(w, http.StatusConflict, errSnapshotsDisabled, "Session was not created with snapshots=on")
+			return
+		}
+
+		// Restarts and cleanup replace or remove the machine, so they must not run alongside
+		session.lifecycleMu.Lock()
+		var err error
+		if session.closed {
+			err = fmt.Errorf("session is closed")
+		} else {
+			sessionsMu.RLock()
+			path := session.qmpSockets[machineID]
+			sessionsMu.RUnlock()
+			err = runHMPCommand(path, fmt.Sprintf("%s %s", command, name))
+		}
+		session.lifecycleMu.Unlock()
+		if err != nil {
+			logger.Error("Error running snapshot command", "command", command, "snapshot", name, "err", err)
+			writeJSONError(w, http.StatusInternalServerError, errSnapshotFailed, err.Error())
+			return
+		}
+
+		session.touch()
+
+		logger.Info("Ran snapshot command", "command", command, "snapshot", name)
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(map[string]string{"machine": machineID, "snapshot": name}); err != nil {
+			logger.Error("Error encoding JSON response", "err", err)
+		}
+	}
+}
+
+// runHMPCommand runs a human monitor command over QMP. savevm and loadvm have no QMP equivalent
+// that finishes synchronously, and HMP reports their failures as text rather than QMP errors.
+func runHMPCommand(path, commandLine string) error {
+	if path == "" {
+		return fmt.Errorf("machine has no QMP control socket")
+	}
+	q, err := dialQMP(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := q.conn.Close(); err != nil {
+			slog.Error("Error closing QMP connection", "err", err)
+		}
+	}()
+	if err := q.conn.SetDeadline(time.Now().Add(snapshotTimeout)); err != nil {
+		return err
+	}
+
+	result, err := q.execute("human-monitor-command", map[string]string{"command-line": commandLine})
+	if err != nil {
+		return err
+	}
+	var output string
+	if err := json.Unmarshal(result, &output); err != nil {
+		return fmt.Errorf("unexpected reply to %s: %v", commandLine, err)
+	}
+	if output = strings.TrimSpace(output); output != "" {
+		return fmt.Errorf("%s", output)
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	qemuStartupGrace     = 500 * time.Millisecond // How long a new QEMU process is watched for an immediate exit
+	maxStartupReasonSize = 256                    // Longest failure reason passed on to clients
+)
+
+var (
+	// hostPathPattern matches absolute paths in QEMU messages so they aren't passed on to clients
+	hostPathPattern = regexp.MustCompile(`/[^\s'",:]+`)
+	// pathOptionPattern matches the values of QEMU options that name files, which may be relative
+	pathOptionPattern = regexp.MustCompile(`\b(file|filename|path|logfile)=[^\s'",]+`)
+)
+
+// machineStartError reports a QEMU process that exited right after it was started. The reason is
+// taken from QEMU's own error messages with host paths removed, so it is safe to show to clients.
+type machineStartError struct {
+	machineID string
+	reason    string
+}
+
+func (e *machineStartError) Error() string {
+	return fmt.Sprintf("failed to start machine %s: %s", e.machineID, e.reason)
+}
+
+// awaitQEMUStartup watches a freshly started machine's console for qemuStartupGrace. QEMU writes
+// its errors to the console PTY, and the console ends when QEMU exits, so an early end with the
+// output collected so far means the machine failed to start. An error is returned if ctx ends first.
+// sub must have been subscribed before the console started running so no output is missed; it is
+// unsubscribed on return.
+func awaitQEMUStartup(ctx context.Context, console *consoleStream, sub *consoleSubscriber) (exited bool, output []byte, err error) {
+	defer console.unsubscribe(sub)
+	timer := time.NewTimer(qemuStartupGrace)
+	defer timer.Stop()
+	for {
+		select {
+		case chunk, ok := <-sub.output:
+			if !ok {
+				return true, output, nil
+			}
+			if len(output) < consoleBacklogLimit {
+				output = append(output, chunk...)
+			}
+		case <-timer.C:
+			return false, nil, nil
+		case <-ctx.Done():
+			return false, nil, ctx.Err()
+		}
+	}
+}
+
+// hidePaths replaces the host paths in a QEMU message with <path>: the configured images and
+// directories, which may be given relative to the server's working directory, the values of options
+// naming files, and any other absolute path
+func hidePaths(message string) string {
+	if paths := hostPaths(); len(paths) > 0 {
+		for i, path := range paths {
+			paths[i] = regexp.QuoteMeta(path)
+		}
+		// A configured path is hidden together with the rest of the path it starts, e.g. a file in a
+		// session's directory
+		configured := regexp.MustCompile(`(^|[\s'"=,:(])(?:` + strings.Join(paths, "|") + `)[^\s'",:]*`)
+		message = configured.ReplaceAllString(message, "${1}<path>")
+	}
+	message = pathOptionPattern.ReplaceAllString(message, "$1=<path>")
+	return hostPathPattern.ReplaceAllString(message, "<path>")
+}
+
+// hostPaths returns the image paths and directories the server was configured with, as given and in
+// their absolute and relative forms, longest first so the longest match wins
+func hostPaths() []string {
+	configured := []string{workRoot, consoleLogDir, exportDir, auditDir}
+	for _, path := range images {
+		configured = append(configured, path)
+	}
+	cwd, _ := os.Getwd()
+	seen := make(map[string]bool)
+	var paths []string
+	for _, path := range configured {
+		if path == "" {
+			continue
+		}
+		forms := []string{path, filepath.Clean(path)}
+		if cwd != "" {
+			if abs, err := filepath.Abs(path); err == nil {
+				forms = append(forms, abs)
+				if rel, err := filepath.Rel(cwd, abs); err == nil {
+					forms = append(forms, rel)
+				}
+			}
+		}
+		for _, form := range forms {
+			if form != "." && !seen[form] {
+				seen[form] = true
+				paths = append(paths, form)
+			}
+		}
+	}
+	sort.Slice(paths, func(i, j int) bool { return len(paths[i]) > len(paths[j]) })
+	return paths
+}
+
+// qemuStartupReason extracts QEMU's error messages from its early console output, e.g.
+// "qemu-system-x86_64: -drive file=/srv/img.qcow2,...: Could not open '/srv/img.qcow2': No such file
+// or directory" becomes "Could not open '<path>': No such file or directory"
+func qemuStartupReason(output []byte) string {
+	prefix := filepath.Base(qemuBinary) + ": "
+	var messages []string
+	for _, line := range strings.Split(strings.ReplaceAll(string(output), "\r\n", "\n"), "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, prefix) {
+			continue // Guest or firmware output, not a QEMU message
+		}
+		message := strings.TrimPrefix(line, prefix)
+		// Messages about an option start with the option and its value, which hold host paths
+		if strings.HasPrefix(message, "-") {
+			if i := strings.Index(message, ": "); i >= 0 {
+				message = message[i+2:]
+			}
+		}
+		message = hidePaths(message)
+		if message != "" {
+			messages = append(messages, message)
+		}
+	}
+	if len(messages) == 0 {
+		return "QEMU exited during startup"
+	}
+	reason := strings.Join(messages, "; ")
+	if len(reason) > maxStartupReasonSize {
+		reason = reason[:maxStartupReasonSize] + "..."
+	}
+	return reason
+}
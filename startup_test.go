@@ -0,0 +1,68 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestQEMUStartupReasonHidesPaths(t *testing.T) {
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	savedImages, savedWorkRoot := images, workRoot
+	images = map[string]string{"debian-12": "images/debian-12.qcow2", "alpine": filepath.Join(cwd, "images", "alpine.qcow2")}
+	workRoot = filepath.Join(cwd, "sessions")
+	t.Cleanup(func() { images, workRoot = savedImages, savedWorkRoot })
+
+	tests := []struct {
+		name   string
+		output string
+		want   string
+	}{
+		{
+			name:   "absolute path",
+			output: "qemu-system-x86_64: -drive file=/srv/img.qcow2,if=virtio: Could not open '/srv/img.qcow2': No such file or directory",
+			want:   "Could not open '<path>': No such file or directory",
+		},
+		{
+			name:   "relative image path",
+			output: "qemu-system-x86_64: Could not open 'images/debian-12.qcow2': Permission denied",
+			want:   "Could not open '<path>': Permission denied",
+		},
+		{
+			name:   "absolute image path printed relative to the server's directory",
+			output: "qemu-system-x86_64: Could not open 'images/alpine.qcow2': Permission denied",
+			want:   "Could not open '<path>': Permission denied",
+		},
+		{
+			name:   "working directory given relative to the server's",
+			output: "qemu-system-x86_64: Failed to lock 'sessions/3fa29b/disk-1.qcow2'",
+			want:   "Failed to lock '<path>'",
+		},
+		{
+			name:   "file option with a relative path",
+			output: "qemu-system-x86_64: warning: opening file=backing.qcow2,format=qcow2 failed",
+			want:   "warning: opening file=<path>,format=qcow2 failed",
+		},
+		{
+			name:   "no paths",
+			output: "qemu-system-x86_64: Parameter 'driver' expects a pluggable device type",
+			want:   "Parameter 'driver' expects a pluggable device type",
+		},
+		{
+			name:   "guest output only",
+			output: "SeaBIOS (version 1.16)\r\nBooting from Hard Disk...",
+			want:   "QEMU exited during startup",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := qemuStartupReason([]byte(tt.output))
+			if got != tt.want {
+				t.Errorf("qemuStartupReason(%q) = %q, want %q", tt.output, got, tt.want)
+			}
+		})
+	}
+}
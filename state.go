@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// stateDir holds one JSON record per live session so a restarted server can reclaim what a crashed
+// one left behind. Empty disables the records.
+var stateDir = filepath.Join(os.TempDir(), "vm-web-shells-state")
+
+// sessionRecord is the on-disk description of a session: everything needed to find its processes
+// and tear down its network without the in-memory Session
+type sessionRecord struct {
+	Hash       string                 `json:"hash"`
+	BridgeName string                 `json:"bridgeName"`
+	Bridges    []string               `json:"bridges"`
+	Netns      string                 `json:"netns,omitempty"`
+	VxlanName  string                 `json:"vxlanName,omitempty"`
+	WorkDir    string                 `json:"workDir"`
+	NICs       map[string][]nicRecord `json:"nics"`
+	TapNames   map[string]string      `json:"tapNames,omitempty"` // Single NIC per machine, in records of earlier versions
+	PIDs       map[string]int         `json:"pids"`               // Key - Machine ID, Value - QEMU process ID
+	DHCPPID    int                    `json:"dhcpPid,omitempty"`
+	NATRules   []natRuleRecord        `json:"natRules,omitempty"`
+	Cgroup     string                 `json:"cgroup,omitempty"`
+}
+
+// nicRecord is the on-disk form of a machineNIC
+type nicRecord struct {
+	Tap    string `json:"tap"`
+	Bridge string `json:"bridge"`
+}
+
+// natRuleRecord is the on-disk form of an iptablesRule
+type natRuleRecord struct {
+	Table string   `json:"table"`
+	Chain string   `json:"chain"`
+	Spec  []string `json:"spec"`
+}
+
+// sessionStatePath returns the path of the session's record
+func sessionStatePath(hash string) string {
+	return filepath.Join(stateDir, hash+".json")
+}
+
+// hasSessionState reports whether a record exists for the session ID
+func hasSessionState(hash string) bool {
+	if stateDir == "" {
+		return false
+	}
+	_, err := os.Stat(sessionStatePath(hash))
+	return err == nil
+}
+
+// saveSessionState writes the session's record, replacing any previous one. It is called whenever
+// the set of processes changes; a failure only costs crash recovery, so it is logged and ignored.
+func saveSessionState(session *Session) {
+	if stateDir == "" {
+		return
+	}
+
+	record := sessionRecord{
+		Hash:       session.hash,
+		BridgeName: session.bridgeName,
+		Bridges:    session.bridges,
+		Netns:      session.netns,
+		VxlanName:  session.vxlanName,
+		WorkDir:    session.workDir,
+		NICs:       make(map[string][]nicRecord),
+		PIDs:       make(map[string]int),
+		Cgroup:     session.cgroup,
+	}
+	if session.dnsmasq != nil && session.dnsmasq.Process != nil {
+		record.DHCPPID = session.dnsmasq.Process.Pid
+	}
+	for id, nics := range session.nics {
+		for _, nic := range nics {
+			record.NICs[id] = append(record.NICs[id], nicRecord{nic.tap, nic.bridge})
+		}
+	}
+	for _, rule := range session.natRules {
+		record.NATRules = append(record.NATRules, natRuleRecord{rule.table, rule.chain, rule.spec})
+	}
+	sessionsMu.RLock()
+	for id, proc := range session.procs {
+		record.PIDs[id] = proc.cmd.Process.Pid
+	}
+	sessionsMu.RUnlock()
+
+	if err := writeSessionRecord(record); err != nil {
+		slog.Error("Error saving session state", "session", session.hash, "err", err)
+	}
+}
+
+// writeSessionRecord writes record through a temporary file so a crash never leaves half a record
+func writeSessionRecord(record sessionRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	tmp := sessionStatePath(record.Hash) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, sessionStatePath(record.Hash))
+}
+
+// removeSessionState deletes the session's record once its resources are gone
+func removeSessionState(session *Session) {
+	if stateDir == "" {
+		return
+	}
+	if err := os.Remove(sessionStatePath(session.hash)); err != nil && !os.IsNotExist(err) {
+		slog.Error("Error removing session state", "session", session.hash, "err", err)
+	}
+}
+
+// recoverSessions scans the state directory for sessions left behind by a previous run. Sessions
+// whose VMs are all gone have their DHCP server, network and working directory reclaimed. Sessions
+// with a VM still running are reported and kept, since their consoles can't be reattached but the
+// VMs may still be in use.
+func recoverSessions() error {
+	if stateDir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(stateDir, 0o700); err != nil {
+		return fmt.Errorf("failed to create state directory: %v", err)
+	}
+	paths, err := filepath.Glob(filepath.Join(stateDir, "*.json"))
+	if err != nil {
+		return err
+	}
+
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			slog.Error("Error reading session record", "path", path, "err", err)
+			continue
+		}
+		var record sessionRecord
+		if err := json.Unmarshal(data, &record); err != nil || !isValidSessionID(record.Hash) {
+			slog.Warn("Ignoring malformed session record", "path", path)
+			continue
+		}
+
+		var running []string
+		for id, pid := range record.PIDs {
+			if processRunning(pid, "qemu") {
+				running = append(running, fmt.Sprintf("%s (pid %d)", id, pid))
+			}
+		}
+		if len(running) > 0 {
+			slog.Warn("Session from a previous run still has running machines, leaving it alone", "session", record.Hash, "machines", strings.Join(running, ","))
+			continue
+		}
+
+		slog.Info("Reclaiming resources of orphaned session", "session", record.Hash)
+		if record.DHCPPID != 0 && processRunning(record.DHCPPID, "dnsmasq") {
+			if proc, err := os.FindProcess(record.DHCPPID); err == nil {
+				if err := proc.Kill(); err != nil {
+					slog.Error("Error killing dnsmasq", "session", record.Hash, "pid", record.DHCPPID, "err", err)
+				}
+			}
+		}
+		session := &Session{
+			hash:       record.Hash,
+			bridgeName: record.BridgeName,
+			netns:      record.Netns,
+			vxlanName:  record.VxlanName,
+			workDir:    record.WorkDir,
+			bridges:    record.Bridges,
+			nics:       make(map[string][]machineNIC),
+			cgroup:     record.Cgroup,
+		}
+		if len(session.bridges) == 0 {
+			session.bridges = []string{record.BridgeName}
+		}
+		for id, nics := range record.NICs {
+			for _, nic := range nics {
+				session.nics[id] = append(session.nics[id], machineNIC{tap: nic.Tap, bridge: nic.Bridge})
+			}
+		}
+		for id, tap := range record.TapNames {
+			session.nics[id] = []machineNIC{{tap: tap, bridge: record.BridgeName}}
+		}
+		for _, rule := range record.NATRules {
+			session.natRules = append(session.natRules, iptablesRule{rule.Table, rule.Chain, rule.Spec})
+		}
+		if err := cleanupNetwork(context.Background(), session); err != nil {
+			slog.Error("Error cleaning up network of orphaned session", "session", record.Hash, "err", err)
+			continue
+		}
+		removeSessionCgroup(session)
+		removeWorkDir(session)
+		removeSessionState(session)
+	}
+	return nil
+}
+
+// processRunning reports whether pid is a live process whose name starts with name, so a PID
+// reused by an unrelated process isn't mistaken for the one that was recorded
+func processRunning(pid int, name string) bool {
+	comm, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "comm"))
+	if err != nil {
+		return false
+	}
+	return strings.HasPrefix(strings.TrimSpace(string(comm)), name)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// clockTicks is the unit of the CPU times in /proc/<pid>/stat, USER_HZ, which is 100 on every
+// architecture Linux runs QEMU on
+const clockTicks = 100
+
+// machineStats is the resource usage of one machine's QEMU process. The figures are zero for a
+// machine whose process has exited.
+type machineStats struct {
+	Machine       string  `json:"machine"`
+	Running       bool    `json:"running"`
+	PID           int     `json:"pid,omitempty"`
+	CPUSeconds    float64 `json:"cpuSeconds"`      // User plus system time since the machine started
+	UserSeconds   float64 `json:"userSeconds"`     // CPU time spent running the guest and QEMU itself
+	SystemSeconds float64 `json:"systemSeconds"`   // CPU time spent in the kernel on the process's behalf
+	RSSBytes      int64   `json:"rssBytes"`        // Resident memory, guest RAM the guest has touched included
+	PeakRSSBytes  int64   `json:"peakRSSBytes"`    // Highest RSS so far
+	Error         string  `json:"error,omitempty"` // Set if the process runs but its figures couldn't be read
+}
+
+// statsHandler reports the CPU time and memory use of each of a session's machines
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	sessionID, ok := sessionIDParam(w, r)
+	if !ok {
+		return
+	}
+
+	sessionsMu.RLock()
+	session, exists := sessions[sessionID]
+	if !exists {
+		sessionsMu.RUnlock()
+		writeJSONError(w, http.StatusNotFound, errSessionNotFound, "Session not found")
+		return
+	}
+	procs := make(map[string]*machineProcess, len(session.procs))
+	machines := make([]string, 0, len(session.procs))
+	for id, proc := range session.procs {
+		procs[id] = proc
+		machines = append(machines, id)
+	}
+	sessionsMu.RUnlock()
+	sort.Strings(machines)
+
+	logger := requestLogger(r.Context()).With("session", sessionID)
+	stats := make([]machineStats, 0, len(machines))
+	for _, id := range machines {
+		stat, err := processStats(procs[id])
+		if err != nil {
+			logger.Error("Error reading machine stats", "machine", id, "err", err)
+			stat = machineStats{Running: true, Error: "stats unavailable"}
+		}
+		stat.Machine = id
+		stats = append(stats, stat)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]any{"sessionID": sessionID, "machines": stats}); err != nil {
+		logger.Error("Error encoding JSON response", "err", err)
+	}
+}
+
+// processStats reads a QEMU process's usage from /proc. A process that exits meanwhile is reported
+// as not running rather than as an error, and so are its figures if it was reaped before they were
+// complete, since its PID may already belong to another process.
+func processStats(proc *machineProcess) (machineStats, error) {
+	if exited, _ := proc.exited(); exited {
+		return machineStats{}, nil
+	}
+	pid := proc.cmd.Process.Pid
+	stats := machineStats{Running: true, PID: pid}
+
+	read := func(name string) ([]byte, error) {
+		return os.ReadFile(fmt.Sprintf("/proc/%d/%s", pid, name))
+	}
+	stat, err := read("stat")
+	var status []byte
+	if err == nil {
+		status, err = read("status")
+	}
+	// Without /proc/<pid> the process has exited, and once it is reaped the figures may be another's
+	if exited, _ := proc.exited(); exited || os.IsNotExist(err) || errors.Is(err, syscall.ESRCH) {
+		return machineStats{}, nil
+	}
+	if err != nil {
+		return machineStats{}, fmt.Errorf("failed to read /proc/%d: %v", pid, err)
+	}
+
+	// The command name in parentheses may contain spaces, so fields are counted from the last ')'
+	end := bytes.LastIndexByte(stat, ')')
+	if end < 0 {
+		return machineStats{}, fmt.Errorf("malformed /proc/%d/stat", pid)
+	}
+	fields := strings.Fields(string(stat[end+1:]))
+	if len(fields) < 13 {
+		return machineStats{}, fmt.Errorf("malformed /proc/%d/stat", pid)
+	}
+	if fields[0] == "Z" {
+		return machineStats{}, nil // Exited, but not reaped yet
+	}
+	// utime and stime are fields 14 and 15 of the whole line, the state being field 3
+	utime, err := strconv.ParseUint(fields[11], 10, 64)
+	if err != nil {
+		return machineStats{}, fmt.Errorf("invalid utime in /proc/%d/stat: %v", pid, err)
+	}
+	stime, err := strconv.ParseUint(fields[12], 10, 64)
+	if err != nil {
+		return machineStats{}, fmt.Errorf("invalid stime in /proc/%d/stat: %v", pid, err)
+	}
+	stats.UserSeconds = float64(utime) / clockTicks
+	stats.SystemSeconds = float64(stime) / clockTicks
+	stats.CPUSeconds = stats.UserSeconds + stats.SystemSeconds
+
+	scanner := bufio.NewScanner(bytes.NewReader(status))
+	for scanner.Scan() {
+		// VmRSS:	  524288 kB
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 || fields[2] != "kB" {
+			continue
+		}
+		kb, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		switch fields[0] {
+		case "VmRSS:":
+			stats.RSSBytes = kb << 10
+		case "VmHWM:":
+			stats.PeakRSSBytes = kb << 10
+		}
+	}
+	return stats, nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Bridge subnets handed out to sessions, guarded by sessionsMu
+var subnetsInUse = make(map[string]bool)
+
+// allocateSubnet reserves a 10.x.y.0/24 subnet for the session. The subnet is derived from the
+// session hash so it is stable for the session's lifetime, and probes onwards when the derived
+// subnet is already taken by another session or overlaps a network the host already uses.
+func allocateSubnet(session *Session) error {
+	// A namespaced bridge has no routes to the host, so only the host namespace can collide
+	var hostNets []*net.IPNet
+	if session.netns == "" {
+		var err error
+		if hostNets, err = hostNetworks(); err != nil {
+			return fmt.Errorf("failed to list host networks: %v", err)
+		}
+	}
+
+	sum := sha256.Sum256([]byte(session.hash))
+	start := int(sum[0])<<8 | int(sum[1])
+
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	for i := 0; i < 1<<16; i++ {
+		n := (start + i) % (1 << 16)
+		x, y := n>>8, n&0xff
+		// 10.0.0.0/16 and 10.255.0.0/16 are left alone, they're the most likely to be in use already
+		if x == 0 || x == 255 {
+			continue
+		}
+		_, subnet, _ := net.ParseCIDR(fmt.Sprintf("10.%d.%d.0/24", x, y))
+		if subnetsInUse[subnet.String()] || overlapsAny(subnet, hostNets) {
+			continue
+		}
+		subnetsInUse[subnet.String()] = true
+		session.subnet = subnet
+		return nil
+	}
+	return fmt.Errorf("no free bridge subnet")
+}
+
+// releaseSubnet returns the session's subnet to the pool
+func releaseSubnet(session *Session) {
+	if session.subnet == nil {
+		return
+	}
+	sessionsMu.Lock()
+	delete(subnetsInUse, session.subnet.String())
+	sessionsMu.Unlock()
+}
+
+// hostNetworks returns the IPv4 networks the host is attached to or routes to
+func hostNetworks() ([]*net.IPNet, error) {
+	var result []*net.IPNet
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.To4() != nil {
+			result = append(result, ipNet)
+		}
+	}
+
+	output, err := runCommandOutput(context.Background(), "ip", "-4", "route", "show")
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || fields[0] == "default" {
+			continue
+		}
+		dst := fields[0]
+		if !strings.Contains(dst, "/") {
+			dst += "/32"
+		}
+		if _, ipNet, err := net.ParseCIDR(dst); err == nil {
+			result = append(result, ipNet)
+		}
+	}
+	return result, nil
+}
+
+// overlapsAny reports whether subnet overlaps any of the given networks
+func overlapsAny(subnet *net.IPNet, networks []*net.IPNet) bool {
+	for _, other := range networks {
+		if subnet.Contains(other.IP) || other.Contains(subnet.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// hostAddress returns the n-th host address of the subnet in dotted notation
+func hostAddress(subnet *net.IPNet, n int) string {
+	ip := subnet.IP.To4()
+	return fmt.Sprintf("%d.%d.%d.%d", ip[0], ip[1], ip[2], int(ip[3])+n)
+}
+
+// gatewayAddress returns the bridge's address in CIDR notation, the first host of the subnet
+func gatewayAddress(subnet *net.IPNet) string {
+	ones, _ := subnet.Mask.Size()
+	return fmt.Sprintf("%s/%d", hostAddress(subnet, 1), ones)
+}
+
+// machineAddress returns the address reserved for a machine of the session: 10.x.y.(100+N)
+// for machine N, mirroring the last byte of its MAC address
+func machineAddress(subnet *net.IPNet, machineNum int) string {
+	return hostAddress(subnet, 100+machineNum)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// machineTemplate adjusts the QEMU invocation of a session's machines
+type machineTemplate struct {
+	Args     []string `json:"args"`     // Extra QEMU options, appended after the server's own
+	NICModel string   `json:"nicModel"` // Device model of every NIC, "" for virtio-net-pci
+}
+
+// templateOptions are the QEMU options a template may use. Everything the server relies on, the
+// console, monitors, networking, the sandbox, and the accelerator, stays off limits.
+var templateOptions = map[string]bool{
+	"-boot": true, "-cdrom": true, "-cpu": true, "-device": true, "-drive": true, "-global": true,
+	"-machine": true, "-rtc": true, "-smbios": true, "-usb": true, "-vga": true,
+}
+
+// nicModels are the NIC device models a template may select
+var nicModels = map[string]bool{
+	"virtio-net-pci": true, "e1000": true, "e1000e": true, "rtl8139": true, "vmxnet3": true,
+}
+
+// loadMachineTemplates reads named machine templates from a JSON file of the form
+//
+//	{"tools-cd": {"args": ["-cdrom", "/srv/iso/tools.iso"]}, "legacy-nic": {"nicModel": "e1000"}}
+//
+// Each option in args must be allowed by templateOptions and may be followed by values. Values
+// can't wire devices to character or network backends, which only the server creates, or pick
+// the accelerator.
+func loadMachineTemplates(path string) (map[string]machineTemplate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var templates map[string]machineTemplate
+	if err := json.Unmarshal(data, &templates); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+
+	for name, template := range templates {
+		if name == "" {
+			return nil, fmt.Errorf("machine template with empty name in %s", path)
+		}
+		if template.NICModel != "" && !nicModels[template.NICModel] {
+			return nil, fmt.Errorf("machine template %q has unsupported nicModel %q", name, template.NICModel)
+		}
+		if err := validateTemplateArgs(template.Args); err != nil {
+			return nil, fmt.Errorf("machine template %q: %v", name, err)
+		}
+	}
+	return templates, nil
+}
+
+// validateTemplateArgs checks a template's QEMU arguments against templateOptions
+func validateTemplateArgs(args []string) error {
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		return fmt.Errorf("argument %q does not follow an option", args[0])
+	}
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "-") {
+			// QEMU accepts options with one or two dashes
+			option := "-" + strings.TrimLeft(arg, "-")
+			if !templateOptions[option] {
+				return fmt.Errorf("option %s is not allowed in templates", arg)
+			}
+			continue
+		}
+		for _, key := range []string{"chardev", "netdev", "accel"} {
+			if strings.Contains(arg, key+"=") {
+				return fmt.Errorf("value %q may not set %s, which the server controls", arg, key)
+			}
+		}
+	}
+	return nil
+}
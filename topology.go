@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const maxExtraNetworks = 4 // Upper bound for the networks option, bounded by the bridge and TAP name scheme
+
+// machineNIC is one network interface of a machine: a TAP device enslaved to one of the session's bridges
+type machineNIC struct {
+	tap      string
+	bridge   string
+	isolated bool // The bridge port is isolated, so it only forwards to and from non-isolated ports
+}
+
+// parseNetworks parses the networks option: a comma-separated list of additional networks, each
+// the colon-separated IDs of the machines attached to it, e.g. "1:2,2:3". Every machine is on the
+// session's first network anyway, so each network listed here gives its machines one more NIC.
+func parseNetworks(value string, machineCount int) ([][]string, error) {
+	if value == "" {
+		return nil, nil
+	}
+	var networks [][]string
+	for _, entry := range strings.Split(value, ",") {
+		machines, err := parseMachineList(entry, machineCount)
+		if err != nil {
+			return nil, fmt.Errorf("network %q: %v", entry, err)
+		}
+		networks = append(networks, machines)
+	}
+	if len(networks) > maxExtraNetworks {
+		return nil, fmt.Errorf("too many networks: %d (at most %d)", len(networks), maxExtraNetworks)
+	}
+	return networks, nil
+}
+
+// parseMachineList parses a colon-separated list of distinct machine IDs, e.g. "1:3"
+func parseMachineList(value string, machineCount int) ([]string, error) {
+	var machines []string
+	seen := make(map[string]bool)
+	for _, id := range strings.Split(value, ":") {
+		n, err := strconv.Atoi(id)
+		if err != nil || n < 1 || n > machineCount {
+			return nil, fmt.Errorf("invalid machine %q (expected 1 to %d)", id, machineCount)
+		}
+		if seen[id] {
+			return nil, fmt.Errorf("machine %s listed twice", id)
+		}
+		seen[id] = true
+		machines = append(machines, id)
+	}
+	return machines, nil
+}
+
+// sessionTopology names the bridges and TAP devices of a session: br-<id> with a tap<m>-<id> for
+// every machine, and for the k-th additional network (counting from 2) br<k>-<id> with a
+// tap<m>n<k>-<id> for each of its machines. NICs are listed in the order the guest sees them, and
+// every NIC of a machine in the isolated option is isolated.
+func sessionTopology(hash string, opts sessionOptions) (bridges []string, nics map[string][]machineNIC) {
+	bridges = []string{fmt.Sprintf("br-%s", hash)}
+	nics = make(map[string][]machineNIC, opts.machineCount)
+	for i := 1; i <= opts.machineCount; i++ {
+		id := strconv.Itoa(i)
+		nics[id] = []machineNIC{primaryNIC(hash, id, opts)}
+	}
+	for i, machines := range opts.networks {
+		network := i + 2
+		bridge := fmt.Sprintf("br%d-%s", network, hash)
+		bridges = append(bridges, bridge)
+		for _, id := range machines {
+			nics[id] = append(nics[id], machineNIC{
+				tap:      fmt.Sprintf("tap%sn%d-%s", id, network, hash),
+				bridge:   bridge,
+				isolated: opts.isolated[id],
+			})
+		}
+	}
+	return bridges, nics
+}
+
+// primaryNIC returns a machine's NIC on the session's first bridge
+func primaryNIC(hash, machineID string, opts sessionOptions) machineNIC {
+	return machineNIC{tap: fmt.Sprintf("tap%s-%s", machineID, hash), bridge: fmt.Sprintf("br-%s", hash), isolated: opts.isolated[machineID]}
+}
+
+// machineIDs returns the IDs of the session's machines in order
+func (s *Session) machineIDs() []string {
+	ids := make([]string, 0, len(s.nics))
+	for id := range s.nics {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// taps returns every TAP device of the session in a fixed order
+func (s *Session) taps() []string {
+	var taps []string
+	for _, nics := range s.nics {
+		for _, nic := range nics {
+			taps = append(taps, nic.tap)
+		}
+	}
+	sort.Strings(taps)
+	return taps
+}
+
+// isolateNIC marks the bridge port of an isolated NIC as such. Isolated ports can't exchange
+// traffic with each other, only with the bridge's other ports and the host. The flag belongs to
+// the port, so it has to be set again whenever the TAP device is enslaved.
+func isolateNIC(session *Session, nic machineNIC) error {
+	if !nic.isolated {
+		return nil
+	}
+	if err := runCommand(session.ip("link", "set", nic.tap, "type", "bridge_slave", "isolated", "on")...); err != nil {
+		return fmt.Errorf("failed to isolate TAP device %s: %v", nic.tap, err)
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"regexp"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+// requestIDPattern matches the incoming request IDs that are reused. Anything else, which might
+// forge log lines or bloat them, is replaced with a generated ID.
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,64}$`)
+
+type requestIDKey struct{}
+
+// withRequestID gives every request an ID, the caller's X-Request-ID if it sent a usable one and a
+// random one otherwise. The ID is echoed in the response header and carried in the request's
+// context, where requestLogger picks it up.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !requestIDPattern.MatchString(id) {
+			var err error
+			if id, err = generateShortHash(12); err != nil {
+				slog.Error("Error generating request ID", "err", err)
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		w.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// requestLogger returns the default logger with the ID of the request ctx belongs to, if any, so
+// the log lines of one request can be told apart from those of concurrent ones
+func requestLogger(ctx context.Context) *slog.Logger {
+	if id, ok := ctx.Value(requestIDKey{}).(string); ok {
+		return slog.With("request", id)
+	}
+	return slog.Default()
+}
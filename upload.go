@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	uploadLineLength = 76                   // Length of the base64 lines typed into the guest
+	uploadDelimiter  = "VMSHELL_UPLOAD_EOF" // Here-document delimiter; never part of base64 output
+)
+
+// maxUploadSize limits the size of a file accepted by /upload
+var maxUploadSize int64 = 1 << 20
+
+// uploadPathPattern restricts upload destinations to absolute paths without shell metacharacters
+var uploadPathPattern = regexp.MustCompile(`^/[A-Za-z0-9._/-]{1,255}$`)
+
+// uploadHandler copies a file into a running VM by typing it into the machine's console as a
+// base64 here-document. The console must be sitting at a shell prompt for this to work.
+func uploadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, errMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	dest := r.URL.Query().Get("path")
+	if !isValidUploadPath(dest) {
+		writeJSONError(w, http.StatusBadRequest, errInvalidPath, "Invalid path (expected an absolute path of letters, digits, '.', '_', '-' and '/')")
+		return
+	}
+
+	session, machineID, console, ok := lookupConsole(w, r)
+	if !ok {
+		return
+	}
+	logger := requestLogger(r.Context()).With("session", session.hash, "machine", machineID)
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize+1<<16) // Leave room for the multipart framing
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, errInvalidUpload, fmt.Sprintf("Expected a multipart form with a \"file\" field of at most %d bytes", maxUploadSize))
+		return
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(io.LimitReader(file, maxUploadSize+1))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, errInvalidUpload, "Error reading uploaded file")
+		return
+	}
+	if int64(len(data)) > maxUploadSize {
+		writeJSONError(w, http.StatusRequestEntityTooLarge, errUploadTooLarge, fmt.Sprintf("File exceeds the limit of %d bytes", maxUploadSize))
+		return
+	}
+
+	// Recorded before it is written, like /exec commands, so a failed upload shows up as well
+	session.audit.write(auditRecord{Time: time.Now(), Machine: machineID, Channel: "console", Source: "upload", Remote: r.RemoteAddr,
+		Input: uploadCommand(dest), Path: dest, Bytes: len(data)})
+
+	// Written in one go so keystrokes from attached clients can't end up inside the here-document
+	if err := console.write(uploadScript(dest, data)); err != nil {
+		logger.Error("Error uploading", "err", err)
+		writeJSONError(w, http.StatusInternalServerError, errInternal, "Error writing to machine console")
+		return
+	}
+
+	session.touch()
+
+	logger.Info("Uploaded a file", "path", dest, "bytes", len(data))
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]any{"path": dest, "bytes": len(data)}); err != nil {
+		logger.Error("Error encoding JSON response", "err", err)
+	}
+}
+
+// isValidUploadPath reports whether path is safe to paste into a shell command unquoted
+func isValidUploadPath(path string) bool {
+	if !uploadPathPattern.MatchString(path) || strings.HasSuffix(path, "/") {
+		return false
+	}
+	for _, part := range strings.Split(path, "/") {
+		if part == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// uploadCommand returns the command line that starts an upload's here-document. The quoted
+// delimiter keeps the shell from expanding anything inside the document.
+func uploadCommand(dest string) string {
+	return fmt.Sprintf("base64 -d > %s << '%s'", dest, uploadDelimiter)
+}
+
+// uploadScript returns the shell input that recreates data at dest inside the guest
+func uploadScript(dest string, data []byte) []byte {
+	encoded := base64.StdEncoding.EncodeToString(data)
+
+	var script strings.Builder
+	script.WriteString(uploadCommand(dest) + "\n")
+	for len(encoded) > uploadLineLength {
+		script.WriteString(encoded[:uploadLineLength])
+		script.WriteByte('\n')
+		encoded = encoded[uploadLineLength:]
+	}
+	if encoded != "" {
+		script.WriteString(encoded)
+		script.WriteByte('\n')
+	}
+	script.WriteString(uploadDelimiter + "\n")
+	return []byte(script.String())
+}
+
+// lookupConsole resolves the sessionID and machine query parameters to the machine's console,
+// writing a JSON error and returning false if they don't name a running machine
+func lookupConsole(w http.ResponseWriter, r *http.Request) (*Session, string, *consoleStream, bool) {
+	sessionID, ok := sessionIDParam(w, r)
+	if !ok {
+		return nil, "", nil, false
+	}
+	machineID := r.URL.Query().Get("machine")
+
+	sessionsMu.RLock()
+	session := sessions[sessionID]
+	var console *consoleStream
+	if session != nil {
+		console = session.consoles[machineID]
+	}
+	sessionsMu.RUnlock()
+	if session == nil {
+		writeJSONError(w, http.StatusNotFound, errSessionNotFound, "Session not found")
+		return nil, "", nil, false
+	}
+	if console == nil {
+		writeJSONError(w, http.StatusBadRequest, errInvalidMachine, "Invalid machine ID")
+		return nil, "", nil, false
+	}
+	return session, machineID, console, true
+}
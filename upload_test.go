@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUploadIsAudited(t *testing.T) {
+	session, guest := newTestSession(t)
+	auditDir = t.TempDir()
+	t.Cleanup(func() { auditDir = "" })
+	if err := openAuditLog(session); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		_, _ = io.Copy(io.Discard, guest) // The guest swallows the here-document
+	}()
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("file", "notes.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := part.Write([]byte("secret contents\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := form.Close(); err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/upload?sessionID="+session.hash+"&machine=1&path=/tmp/notes.txt", &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	rec := httptest.NewRecorder()
+	uploadHandler(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("upload returned %d: %s", rec.Code, rec.Body)
+	}
+	session.audit.close()
+
+	data, err := os.ReadFile(filepath.Join(auditDir, session.hash+".audit.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var record auditRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		t.Fatalf("audit log %q: %v", data, err)
+	}
+	if record.Source != "upload" || record.Path != "/tmp/notes.txt" || record.Bytes != 16 || record.Machine != "1" {
+		t.Errorf("got audit record %+v, want an upload of 16 bytes to /tmp/notes.txt on machine 1", record)
+	}
+	if bytes.Contains(data, []byte("secret")) {
+		t.Errorf("audit log contains the uploaded contents: %s", data)
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"reflect"
+	"time"
+)
+
+const (
+	warmPoolRetry      = 30 * time.Second // Delay before the pool is refilled again after a failed start
+	warmPoolQMPTimeout = 10 * time.Second // Bound on pausing or resuming one pooled machine
+)
+
+// Sessions started ahead of time for requests with the default options, set up with -warm-pool.
+// A pooled session has its own ID, bridges, TAP devices, and booting VMs like any other; it just
+// isn't in the sessions map yet, and its ID stays reserved in pendingSessions, so it counts
+// towards -max-sessions.
+var (
+	warmPoolSize    int                      // Sessions kept ready, 0 disables the pool
+	warmPoolOptions sessionOptions           // Options of pooled sessions, the defaults of /create_session
+	warmPool        []*Session               // Ready sessions, oldest first, guarded by sessionsMu
+	warmPoolClosed  bool                     // Set on shutdown, guarded by sessionsMu
+	warmPoolRefill  = make(chan struct{}, 1) // Wakes maintainWarmPool after a session was taken
+)
+
+// defaultSessionOptions returns the options of a /create_session request that sets none
+func defaultSessionOptions() (sessionOptions, error) {
+	return parseSessionOptions(url.Values{})
+}
+
+// maintainWarmPool keeps warmPoolSize sessions ready, starting one at a time so refilling the pool
+// never competes with itself for the host
+func maintainWarmPool() {
+	for {
+		sessionsMu.RLock()
+		closed, ready := warmPoolClosed, len(warmPool)
+		sessionsMu.RUnlock()
+		if closed {
+			return
+		}
+		if ready >= warmPoolSize {
+			<-warmPoolRefill
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), vmStartupTimeout)
+		session, err := startSession(ctx, warmPoolOptions, true)
+		cancel()
+		if err != nil {
+			slog.Error("Error starting a session for the warm pool", "retry", warmPoolRetry, "err", err)
+			time.Sleep(warmPoolRetry)
+			continue
+		}
+
+		// Once booted, the machines are paused so waiting sessions cost no CPU. One that can't be
+		// paused is still handed out, running.
+		booted := waitForSessionBoot(session, time.Now().Add(bootWaitTimeout))
+		if err := runQMPCommandOnMachines(session, "stop"); err != nil {
+			slog.Error("Error pausing session for the warm pool", "session", session.hash, "booted", booted, "err", err)
+		}
+
+		sessionsMu.Lock()
+		closed = warmPoolClosed
+		if !closed {
+			warmPool = append(warmPool, session)
+		}
+		sessionsMu.Unlock()
+		if closed {
+			discardWarmSession(session)
+			return
+		}
+		slog.Info("Session ready in the warm pool", "session", session.hash)
+	}
+}
+
+// takeWarmSession removes a ready session from the pool if opts are the pool's options, and
+// returns nil otherwise. Sessions whose VMs died while they waited are discarded.
+func takeWarmSession(opts sessionOptions) *Session {
+	// Options given explicitly with their default values make no difference
+	opts.params = nil
+	if warmPoolSize == 0 || !reflect.DeepEqual(opts, warmPoolOptions) {
+		return nil
+	}
+	for {
+		sessionsMu.Lock()
+		if len(warmPool) == 0 {
+			sessionsMu.Unlock()
+			return nil
+		}
+		session := warmPool[0]
+		warmPool = warmPool[1:]
+		sessionsMu.Unlock()
+
+		select {
+		case warmPoolRefill <- struct{}{}:
+		default: // A refill is already pending
+		}
+
+		if machineExited(session) {
+			slog.Warn("Discarding session from the warm pool, one of its machines exited", "session", session.hash)
+			go discardWarmSession(session)
+			continue
+		}
+		if err := runQMPCommandOnMachines(session, "cont"); err != nil {
+			slog.Error("Discarding session from the warm pool, its machines could not be resumed", "session", session.hash, "err", err)
+			go discardWarmSession(session)
+			continue
+		}
+		return session
+	}
+}
+
+// runQMPCommandOnMachines runs a QMP command without arguments, such as stop or cont, on every
+// machine of the session through its control socket
+func runQMPCommandOnMachines(session *Session, command string) error {
+	sessionsMu.RLock()
+	ids := session.machineIDs()
+	paths := make([]string, len(ids))
+	for i, id := range ids {
+		paths[i] = session.qmpSockets[id]
+	}
+	sessionsMu.RUnlock()
+
+	for i, path := range paths {
+		if path == "" {
+			return fmt.Errorf("machine %s has no QMP control socket", ids[i])
+		}
+		if err := runQMPCommand(path, command, warmPoolQMPTimeout); err != nil {
+			return fmt.Errorf("machine %s: %v", ids[i], err)
+		}
+	}
+	return nil
+}
+
+// machineExited reports whether any of the session's QEMU processes is gone
+func machineExited(session *Session) bool {
+	sessionsMu.RLock()
+	defer sessionsMu.RUnlock()
+	for _, proc := range session.procs {
+		if exited, _ := proc.exited(); exited {
+			return true
+		}
+	}
+	return false
+}
+
+// discardWarmSession cleans up a pooled session that won't be handed out, then releases its ID
+func discardWarmSession(session *Session) {
+	cleanupSession(session)
+	sessionsMu.Lock()
+	delete(pendingSessions, session.hash)
+	sessionsMu.Unlock()
+}
+
+// drainWarmPool stops refilling the pool and returns the sessions in it for cleanup on shutdown
+func drainWarmPool() []*Session {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	warmPoolClosed = true
+	drained := warmPool
+	warmPool = nil
+	select {
+	case warmPoolRefill <- struct{}{}:
+	default:
+	}
+	return drained
+}